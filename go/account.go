@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	client "github.com/zelenin/go-tdlib/client"
+)
+
+// Account bundles a Telegram client with the state kept for it by the gateway.
+type Account struct {
+	cfg      *AccountSettings
+	contacts *ContactCache
+	imported *ImportedContacts
+	flood    *FloodControl
+
+	mu        sync.RWMutex
+	client    *client.Client
+	listener  *client.Listener
+	connState string
+	authState string
+	revoked   bool
+}
+
+// NewAccount creates an Account for an authorized Telegram client.
+func NewAccount(cfg *AccountSettings, cl *client.Client, flood *FloodControl, negativeTTL time.Duration) *Account {
+	imported := NewImportedContacts(filepath.Join(accountDataDir(cfg), "imported.json"))
+	return &Account{
+		cfg:       cfg,
+		client:    cl,
+		contacts:  NewContactCache(filepath.Join(accountDataDir(cfg), "contacts.json"), flood, imported, negativeTTL),
+		imported:  imported,
+		flood:     flood,
+		connState: client.TypeConnectionStateReady,
+		authState: client.TypeAuthorizationStateReady,
+	}
+}
+
+// Client returns the current TDLib client of the account.
+func (a *Account) Client() *client.Client {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.client
+}
+
+// removeImported removes imported contacts from the address book and from
+// the contact cache, so that their phone numbers are imported again when
+// dialed.
+func (a *Account) removeImported(ids []int64) error {
+	if err := a.imported.Remove(a.Client(), ids); err != nil {
+		return err
+	}
+	a.contacts.Forget(ids)
+	return nil
+}
+
+// listen returns a new listener for updates of the current client. The
+// listener of the previous client, if any, is closed, which ends its
+// forwarding goroutine.
+func (a *Account) listen() *client.Listener {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.listener != nil {
+		a.listener.Close()
+	}
+	a.listener = a.client.GetListener()
+	return a.listener
+}
+
+// closeListener closes the listener returned by listen.
+func (a *Account) closeListener() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.listener != nil {
+		a.listener.Close()
+		a.listener = nil
+	}
+}
+
+// closeOnDone closes the current TDLib client of the account once ctx is
+// canceled.
+func (a *Account) closeOnDone(ctx context.Context) {
+	<-ctx.Done()
+	if _, err := a.Client().Close(); err != nil {
+		coreLog.Warnf("telegram client %s close: %v", a.Name(), err)
+	}
+}
+
+// setClient replaces the TDLib client after it was recreated. The previous
+// client has reached the Closed state, so only its listener is left to
+// close.
+func (a *Account) setClient(cl *client.Client) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.listener != nil {
+		a.listener.Close()
+		a.listener = nil
+	}
+	a.client = cl
+	a.connState = client.TypeConnectionStateReady
+	a.authState = client.TypeAuthorizationStateReady
+	a.revoked = false
+}
+
+// setConnectionState records the last TDLib connection state.
+func (a *Account) setConnectionState(state client.ConnectionState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.connState = state.ConnectionStateType()
+}
+
+// setAuthorizationState records the last TDLib authorization state. A
+// transition to LoggingOut or Closed without a preceding local shutdown
+// means the session was revoked.
+func (a *Account) setAuthorizationState(state client.AuthorizationState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.authState = state.AuthorizationStateType()
+	if a.authState == client.TypeAuthorizationStateLoggingOut {
+		a.revoked = true
+	}
+}
+
+// Online reports whether TDLib is connected to Telegram servers.
+func (a *Account) Online() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	switch a.connState {
+	case client.TypeConnectionStateReady, client.TypeConnectionStateUpdating:
+		return true
+	}
+	return false
+}
+
+// Ready reports whether the account is authorized and online.
+func (a *Account) Ready() bool {
+	a.mu.RLock()
+	revoked := a.revoked
+	authorized := a.authState == client.TypeAuthorizationStateReady
+	a.mu.RUnlock()
+	return authorized && !revoked && a.Online()
+}
+
+// ConnectionState returns the last known connection and authorization states.
+func (a *Account) ConnectionState() (conn, auth string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.connState, a.authState
+}
+
+// Name returns the account name used in settings and SIP headers.
+func (a *Account) Name() string { return a.cfg.Name() }
+
+// CallbackURI returns the SIP URI receiving Telegram calls of this account.
+func (a *Account) CallbackURI() string { return a.cfg.CallbackURI() }
+
+// selectAccount picks the Telegram account for an incoming SIP request and
+// returns the extension with any account prefix stripped. The X-TG-Account
+// header takes precedence over request-URI domain and extension prefix
+// matching; requests matching nothing go to the first configured account.
+func (g *Gateway) selectAccount(req sip.Request, ext string) (*Account, string, bool) {
+	if hdrs := req.GetHeaders("X-TG-Account"); len(hdrs) > 0 {
+		acc, ok := g.accounts[strings.TrimSpace(hdrs[0].Value())]
+		return acc, ext, ok
+	}
+
+	host := ""
+	if uri := req.Recipient(); uri != nil {
+		host = strings.ToLower(uri.Host())
+	}
+	for _, acc := range g.accountList {
+		if d := acc.cfg.SIPDomain(); d != "" && d == host {
+			return acc, ext, true
+		}
+	}
+	for _, acc := range g.accountList {
+		if p := acc.cfg.SIPPrefix(); p != "" && strings.HasPrefix(ext, p) {
+			return acc, strings.TrimPrefix(ext, p), true
+		}
+	}
+	if len(g.accountList) == 0 {
+		return nil, ext, false
+	}
+	return g.accountList[0], ext, true
+}
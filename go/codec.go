@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"tg2sip/opus"
+)
+
+// tgvoipRate is the sampling rate of the PCM tgvoip produces and consumes.
+const tgvoipRate = 48000
+
+// payloadCodec codes PCM at the sampling rate of an RTP payload format.
+type payloadCodec interface {
+	encode(dst []byte, pcm []int16) []byte
+	decode(dst []int16, payload []byte) []int16
+}
+
+// l16Codec is linear 16 bit PCM in network byte order (RFC 3551 4.5.11).
+type l16Codec struct{}
+
+func (l16Codec) encode(dst []byte, pcm []int16) []byte {
+	for _, s := range pcm {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s))
+	}
+	return dst
+}
+
+func (l16Codec) decode(dst []int16, payload []byte) []int16 {
+	for i := 0; i+1 < len(payload); i += 2 {
+		dst = append(dst, int16(binary.BigEndian.Uint16(payload[i:])))
+	}
+	return dst
+}
+
+// codecCloser is implemented by payload codecs holding libopus state. The
+// encoder and decoder run on different goroutines and are released by them.
+type codecCloser interface {
+	closeEncoder()
+	closeDecoder()
+}
+
+// codecOptions are the local encoder settings of the SIP leg.
+type codecOptions struct {
+	Ptime       int // packet duration in ms
+	OpusBitrate int
+	OpusFEC     bool
+	OpusDTX     bool
+}
+
+// opusExpectedLoss is the loss percentage the Opus encoder plans FEC for.
+const opusExpectedLoss = 10
+
+// opusFmtp returns the format parameters offered for Opus (RFC 7587 6.1).
+// useinbandfec announces that the gateway decodes FEC.
+func opusFmtp(opts codecOptions) string {
+	params := []string{"minptime=10", "useinbandfec=1"}
+	if opts.OpusDTX {
+		params = append(params, "usedtx=1")
+	}
+	if opts.OpusBitrate > 0 {
+		params = append(params, "maxaveragebitrate="+strconv.Itoa(opts.OpusBitrate))
+	}
+	return strings.Join(params, ";")
+}
+
+// opusCodec codes Opus with libopus. The decoder is mono, the encoder
+// stereo only if the peer asks for it with stereo=1.
+type opusCodec struct {
+	enc      opus.Encoder
+	dec      opus.Decoder
+	channels int
+	stereo   []int16
+	packet   [opus.MaxPacket]byte
+	pcm      [opusMaxFrame]int16
+}
+
+// opusMaxFrame is the longest Opus frame, 120 ms at 48 kHz.
+const opusMaxFrame = opus.SampleRate * 120 / 1000
+
+// newOpusCodec creates an Opus coder honouring the fmtp parameters of the
+// peer: stereo, useinbandfec, maxplaybackrate and maxaveragebitrate.
+func newOpusCodec(fmtp string, opts codecOptions) (*opusCodec, error) {
+	remote := fmtpParams(fmtp)
+	c := &opusCodec{channels: 1}
+	if remote["stereo"] == "1" {
+		c.channels = 2
+	}
+	eo := opus.EncoderOptions{
+		Bitrate:      opts.OpusBitrate,
+		FEC:          opts.OpusFEC && remote["useinbandfec"] == "1",
+		DTX:          opts.OpusDTX,
+		MaxBandwidth: opusBandwidth(remote["maxplaybackrate"]),
+	}
+	if limit, err := strconv.Atoi(remote["maxaveragebitrate"]); err == nil && limit > 0 && (eo.Bitrate == 0 || limit < eo.Bitrate) {
+		eo.Bitrate = limit
+	}
+	if eo.FEC {
+		eo.PacketLoss = opusExpectedLoss
+	}
+	var err error
+	if c.enc, err = opus.NewEncoder(c.channels, eo); err != nil {
+		return nil, err
+	}
+	if c.dec, err = opus.NewDecoder(1); err != nil {
+		c.enc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// opusBandwidth maps maxplaybackrate to the widest bandwidth the peer
+// plays back, 0 for full band.
+func opusBandwidth(rate string) int {
+	r, err := strconv.Atoi(rate)
+	switch {
+	case err != nil || r > 24000:
+		return 0
+	case r > 16000:
+		return opus.BandwidthSuperWide
+	case r > 12000:
+		return opus.BandwidthWide
+	case r > 8000:
+		return opus.BandwidthMedium
+	}
+	return opus.BandwidthNarrow
+}
+
+// encode encodes one frame. DTX packets of up to two bytes are dropped, as
+// RFC 7587 allows, and come back as an empty payload.
+func (c *opusCodec) encode(dst []byte, pcm []int16) []byte {
+	if c.channels == 2 {
+		c.stereo = c.stereo[:0]
+		for _, s := range pcm {
+			c.stereo = append(c.stereo, s, s)
+		}
+		pcm = c.stereo
+	}
+	n, err := c.enc.Encode(pcm, c.packet[:])
+	if err != nil {
+		coreLog.Debugf("opus encode: %v", err)
+		return dst
+	}
+	if n <= 2 {
+		return dst
+	}
+	return append(dst, c.packet[:n]...)
+}
+
+func (c *opusCodec) decode(dst []int16, payload []byte) []int16 {
+	n, err := c.dec.Decode(payload, c.pcm[:])
+	if err != nil {
+		coreLog.Debugf("opus decode: %v", err)
+		return dst
+	}
+	return append(dst, c.pcm[:n]...)
+}
+
+func (c *opusCodec) closeEncoder() { c.enc.Close() }
+func (c *opusCodec) closeDecoder() { c.dec.Close() }
+
+// concealer is implemented by payload codecs with their own loss
+// concealment at 48 kHz.
+type concealer interface {
+	// conceal appends n samples replacing a lost packet. next is the
+	// following packet if it arrived, a source of FEC data.
+	conceal(dst []int16, next []byte, n int) []int16
+}
+
+func (c *opusCodec) conceal(dst []int16, next []byte, n int) []int16 {
+	n = min(n, len(c.pcm))
+	var err error
+	if len(next) > 0 {
+		n, err = c.dec.DecodeFEC(next, c.pcm[:n])
+	} else {
+		n, err = c.dec.Decode(nil, c.pcm[:n])
+	}
+	if err != nil {
+		coreLog.Debugf("opus conceal: %v", err)
+		return append(dst, make([]int16, n)...)
+	}
+	return append(dst, c.pcm[:n]...)
+}
+
+// plcMaxRepeats is the number of lost packets waveform substitution
+// bridges before falling silent.
+const plcMaxRepeats = 3
+
+// supportedCodecs are the formats the gateway can bridge, by name as used in
+// the codecs setting. Static payload types are kept, dynamic ones are the
+// types the gateway offers.
+var supportedCodecs = map[string]sdpCodec{
+	"PCMU": {PT: 0, Name: "PCMU", Rate: 8000},
+	"PCMA": {PT: 8, Name: "PCMA", Rate: 8000},
+	"G722": {PT: 9, Name: "G722", Rate: 8000},
+	"L16":  {PT: 96, Name: "L16", Rate: 48000},
+	"OPUS": {PT: 111, Name: "opus", Rate: 48000, Channels: 2},
+}
+
+// defaultCodecs returns the codec preference used when [sip] codecs is not
+// set: the format of raw_pcm first, then G.722 and G.711.
+func defaultCodecs(rawPCM bool) []string {
+	if rawPCM {
+		return []string{"L16", "G722", "PCMU", "PCMA"}
+	}
+	return []string{"OPUS", "G722", "PCMU", "PCMA"}
+}
+
+// localCodecs returns the formats of names in preference order. Unknown
+// names are skipped; settings validate them.
+func localCodecs(names []string, opts codecOptions) []sdpCodec {
+	var codecs []sdpCodec
+	for _, name := range names {
+		c, ok := supportedCodecs[strings.ToUpper(name)]
+		if !ok {
+			continue
+		}
+		if c.Name == "opus" {
+			c.Fmtp = opusFmtp(opts)
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs
+}
+
+// opusAvailable reports whether Opus can be coded, i.e. libopus is linked.
+func opusAvailable() bool {
+	enc, err := opus.NewEncoder(1, opus.EncoderOptions{})
+	if err != nil {
+		return false
+	}
+	enc.Close()
+	return true
+}
+
+// codecSampleRate returns the rate the payload of c is sampled at. G.722
+// signals an 8 kHz RTP clock for 16 kHz audio (RFC 3551 4.5.2).
+func codecSampleRate(c sdpCodec) int {
+	if strings.EqualFold(c.Name, "G722") {
+		return 16000
+	}
+	return c.Rate
+}
+
+// audioCodec converts between 48 kHz tgvoip frames and RTP payloads of the
+// negotiated format, resampling as needed. It is not safe for concurrent
+// use, but encoding and decoding may run in parallel.
+type audioCodec struct {
+	format sdpCodec
+	codec  payloadCodec
+	down   *resampler // 48 kHz to the payload rate
+	up     *resampler // payload rate to 48 kHz
+	encBuf []int16
+	decBuf []int16
+	last   []int16 // last decoded packet at 48 kHz, for PLC
+	lost   int     // packets concealed since then
+}
+
+// newAudioCodec returns the coder of the negotiated format f.
+func newAudioCodec(f sdpCodec, opts codecOptions) (*audioCodec, error) {
+	c := &audioCodec{format: f}
+	switch strings.ToUpper(f.Name) {
+	case "PCMU":
+		c.codec = g711Codec{}
+	case "PCMA":
+		c.codec = g711Codec{alaw: true}
+	case "G722":
+		c.codec = newG722Codec()
+	case "L16":
+		if f.Channels > 1 {
+			return nil, fmt.Errorf("unsupported codec %s", f.rtpmap())
+		}
+		c.codec = l16Codec{}
+	case "OPUS":
+		codec, err := newOpusCodec(f.Fmtp, opts)
+		if err != nil {
+			return nil, err
+		}
+		c.codec = codec
+	default:
+		return nil, fmt.Errorf("unsupported codec %s", f.rtpmap())
+	}
+	var err error
+	rate := codecSampleRate(f)
+	if c.down, err = newResampler(tgvoipRate, rate); err != nil {
+		return nil, err
+	}
+	if c.up, err = newResampler(rate, tgvoipRate); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Encode appends the payload of the 48 kHz frame pcm to dst.
+func (c *audioCodec) Encode(dst []byte, pcm []int16) []byte {
+	if c.down != nil {
+		c.encBuf = c.down.Process(c.encBuf[:0], pcm)
+		pcm = c.encBuf
+	}
+	return c.codec.encode(dst, pcm)
+}
+
+// Decode appends the 48 kHz samples of payload to dst.
+func (c *audioCodec) Decode(dst []int16, payload []byte) []int16 {
+	start := len(dst)
+	if c.up == nil {
+		dst = c.codec.decode(dst, payload)
+	} else {
+		c.decBuf = c.codec.decode(c.decBuf[:0], payload)
+		dst = c.up.Process(dst, c.decBuf)
+	}
+	c.last = append(c.last[:0], dst[start:]...)
+	c.lost = 0
+	return dst
+}
+
+// Conceal appends 48 kHz samples replacing a lost packet of n samples.
+// Opus uses its own PLC and FEC; other codecs repeat the last packet with
+// a fade out, which falls silent after plcMaxRepeats packets.
+func (c *audioCodec) Conceal(dst []int16, next []byte, n int) []int16 {
+	if len(c.last) > 0 {
+		n = len(c.last)
+	}
+	if cc, ok := c.codec.(concealer); ok {
+		return cc.conceal(dst, next, n)
+	}
+	c.lost++
+	if c.lost > plcMaxRepeats || len(c.last) == 0 {
+		return append(dst, make([]int16, n)...)
+	}
+	total := plcMaxRepeats * n
+	done := (c.lost - 1) * n
+	for i := range n {
+		s := c.last[i%len(c.last)]
+		gain := float32(total-done-i) / float32(total)
+		dst = append(dst, int16(float32(s)*gain))
+	}
+	return dst
+}
+
+// CloseEncoder releases the encoder once no frame is encoded any more.
+func (c *audioCodec) CloseEncoder() {
+	if cl, ok := c.codec.(codecCloser); ok {
+		cl.closeEncoder()
+	}
+}
+
+// CloseDecoder releases the decoder once no payload is decoded any more.
+func (c *audioCodec) CloseDecoder() {
+	if cl, ok := c.codec.(codecCloser); ok {
+		cl.closeDecoder()
+	}
+}
+
+// Timestamp returns the RTP timestamp increment of n samples at 48 kHz.
+func (c *audioCodec) Timestamp(n int) uint32 {
+	return uint32(n * c.format.Rate / tgvoipRate)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// runCommand executes an operator subcommand instead of running the gateway.
+func runCommand(ctx context.Context, cfg *Settings, args []string) error {
+	switch args[0] {
+	case "imported":
+		return importedCommand(ctx, cfg, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// importedCommand lists or purges contacts imported for phone dialing.
+//
+//	imported [list]          print recorded contacts of all accounts
+//	imported purge [account] remove recorded contacts from Telegram
+func importedCommand(ctx context.Context, cfg *Settings, args []string) error {
+	sub := "list"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	switch sub {
+	case "list":
+		for _, accCfg := range cfg.Accounts() {
+			imported := NewImportedContacts(filepath.Join(accountDataDir(accCfg), "imported.json"))
+			for _, ic := range imported.List() {
+				fmt.Printf("%s\t%d\t%s\t%s\n", accCfg.Name(), ic.UserID, formatE164(ic.Phone), ic.Imported.Format(time.RFC3339))
+			}
+		}
+		return nil
+	case "purge":
+		only := ""
+		if len(args) > 1 {
+			only = args[1]
+		}
+		accounts, err := startTG(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		for _, acc := range accounts {
+			if only != "" && acc.Name() != only {
+				continue
+			}
+			var ids []int64
+			for _, ic := range acc.imported.List() {
+				ids = append(ids, ic.UserID)
+			}
+			if err := acc.removeImported(ids); err != nil {
+				return fmt.Errorf("account %s: %w", acc.Name(), err)
+			}
+			fmt.Printf("%s: removed %d imported contacts\n", acc.Name(), len(ids))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown imported command %q", sub)
+	}
+}
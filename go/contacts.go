@@ -1,66 +1,136 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	client "github.com/zelenin/go-tdlib/client"
 )
 
+const (
+	// contactMaxAge is how long an entry that is neither a contact nor
+	// updated by TDLib is kept.
+	contactMaxAge = 30 * 24 * time.Hour
+	// contactFlushInterval is how often changed caches are written to disk.
+	contactFlushInterval = time.Minute
+)
+
+// contactEntry is a cached user together with the keys that resolve to it.
+type contactEntry struct {
+	ID        int64     `json:"id"`
+	Usernames []string  `json:"usernames,omitempty"`
+	Phone     string    `json:"phone,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
 // ContactCache stores mappings from username and phone to Telegram user IDs.
+// Entries are indexed by user ID as well, so that a changed or dropped
+// username or phone stops resolving to its previous owner. The cache is
+// persisted to disk by Flush and usable right after startup.
 type ContactCache struct {
 	mu           sync.RWMutex
+	path         string
+	dirty        bool       // changed since the last Flush
+	flushMu      sync.Mutex // orders concurrent writes of the file
+	entries      map[int64]*contactEntry
 	usernameToID map[string]int64
 	phoneToID    map[string]int64
+	flood        *FloodControl
+	imported     *ImportedContacts
+
+	// negative remembers lookups that found nothing until the deadline.
+	negMu       sync.Mutex
+	negative    map[string]time.Time
+	negativeTTL time.Duration
+	lookups     lookupGroup
 }
 
-// NewContactCache creates an empty ContactCache.
-func NewContactCache() *ContactCache {
-	return &ContactCache{
+// NewContactCache creates a ContactCache persisted to path and loads any
+// previously saved entries. Lookups honour the flood limits tracked by flood,
+// record phone numbers they import in imported and are not repeated for
+// negativeTTL after finding nothing.
+func NewContactCache(path string, flood *FloodControl, imported *ImportedContacts, negativeTTL time.Duration) *ContactCache {
+	c := &ContactCache{
+		path:         path,
+		entries:      make(map[int64]*contactEntry),
 		usernameToID: make(map[string]int64),
 		phoneToID:    make(map[string]int64),
+		flood:        flood,
+		imported:     imported,
+		negative:     make(map[string]time.Time),
+		negativeTTL:  negativeTTL,
+	}
+	if err := c.load(); err != nil {
+		coreLog.Warnf("load contacts %s: %v", path, err)
 	}
+	return c
 }
 
-// Refresh reloads contacts using GetContacts and SearchContacts.
+// Refresh reloads the contact list with a GetContacts call. TDLib sends
+// UpdateUser for every user once per session and again whenever the user
+// changes; the gateway feeds these updates to Update. Contacts whose update
+// was sent before the gateway listened are fetched with GetUser, which TDLib
+// answers from its local database. Entries that are neither contacts nor
+// updated within contactMaxAge are evicted.
 func (c *ContactCache) Refresh(cl *client.Client) error {
-	ids := map[int64]struct{}{}
-	// Get all contacts
 	contacts, err := cl.GetContacts()
 	if err != nil {
 		return err
 	}
+
+	isContact := make(map[int64]bool, len(contacts.UserIds))
+	var missing []int64
+	c.mu.RLock()
 	for _, id := range contacts.UserIds {
-		ids[id] = struct{}{}
-	}
-	// Also search all contacts to fill ids (query empty returns all)
-	if res, err := cl.SearchContacts(&client.SearchContactsRequest{Query: "", Limit: 100}); err == nil {
-		for _, id := range res.UserIds {
-			ids[id] = struct{}{}
+		isContact[id] = true
+		if _, ok := c.entries[id]; !ok {
+			missing = append(missing, id)
 		}
 	}
-	users := make([]*client.User, 0, len(ids))
-	for id := range ids {
+	c.mu.RUnlock()
+	for _, id := range missing {
 		u, err := cl.GetUser(&client.GetUserRequest{UserId: id})
 		if err != nil {
+			coreLog.Warnf("get contact %d: %v", id, err)
 			continue
 		}
-		users = append(users, u)
+		c.Update(u)
 	}
-	c.Set(users)
-	return nil
+
+	now := time.Now()
+	c.mu.Lock()
+	evicted := 0
+	for id, e := range c.entries {
+		if !isContact[id] && now.Sub(e.Updated) > contactMaxAge {
+			c.removeLocked(id)
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		c.dirty = true
+	}
+	c.mu.Unlock()
+
+	coreLog.Debugf("contacts refreshed: %d contacts, %d fetched, %d evicted", len(contacts.UserIds), len(missing), evicted)
+	return c.Flush()
 }
 
 // Set replaces cache content with provided users.
 func (c *ContactCache) Set(users []*client.User) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.entries = make(map[int64]*contactEntry)
 	c.usernameToID = make(map[string]int64)
 	c.phoneToID = make(map[string]int64)
 	for _, u := range users {
 		c.addLocked(u)
 	}
+	c.dirty = true
 }
 
 // Update adds or updates a single user in the cache.
@@ -68,23 +138,98 @@ func (c *ContactCache) Update(u *client.User) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.addLocked(u)
+	c.dirty = true
 }
 
-// addLocked stores user info; caller must hold write lock.
+// addLocked stores user info replacing keys the user no longer owns;
+// caller must hold write lock.
 func (c *ContactCache) addLocked(u *client.User) {
 	if u == nil {
 		return
 	}
+	e := &contactEntry{ID: u.Id, Phone: u.PhoneNumber, Updated: time.Now()}
 	if u.Usernames != nil {
-		if u.Usernames.EditableUsername != "" {
-			c.usernameToID[strings.ToLower(u.Usernames.EditableUsername)] = u.Id
+		seen := map[string]bool{}
+		names := append([]string{u.Usernames.EditableUsername}, u.Usernames.ActiveUsernames...)
+		for _, uname := range names {
+			uname = strings.ToLower(uname)
+			if uname != "" && !seen[uname] {
+				seen[uname] = true
+				e.Usernames = append(e.Usernames, uname)
+			}
+		}
+	}
+	c.putLocked(e)
+}
+
+// putLocked indexes e, evicting its previous keys and any key now owned by
+// e but indexed for another user; caller must hold write lock.
+func (c *ContactCache) putLocked(e *contactEntry) {
+	c.removeLocked(e.ID)
+	for _, uname := range e.Usernames {
+		if prev, ok := c.usernameToID[uname]; ok && prev != e.ID {
+			c.dropKeysLocked(prev, uname, "")
+		}
+		c.usernameToID[uname] = e.ID
+	}
+	if e.Phone != "" {
+		if prev, ok := c.phoneToID[e.Phone]; ok && prev != e.ID {
+			c.dropKeysLocked(prev, "", e.Phone)
+		}
+		c.phoneToID[e.Phone] = e.ID
+	}
+	c.entries[e.ID] = e
+}
+
+// removeLocked drops a user and all keys resolving to it; caller must hold
+// write lock.
+func (c *ContactCache) removeLocked(id int64) {
+	e, ok := c.entries[id]
+	if !ok {
+		return
+	}
+	for _, uname := range e.Usernames {
+		if c.usernameToID[uname] == id {
+			delete(c.usernameToID, uname)
+		}
+	}
+	if e.Phone != "" && c.phoneToID[e.Phone] == id {
+		delete(c.phoneToID, e.Phone)
+	}
+	delete(c.entries, id)
+}
+
+// Forget drops users and every key resolving to them, e.g. after they were
+// removed from the account's contacts.
+func (c *ContactCache) Forget(ids []int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := c.entries[id]; ok {
+			c.removeLocked(id)
+			c.dirty = true
 		}
-		for _, uname := range u.Usernames.ActiveUsernames {
-			c.usernameToID[strings.ToLower(uname)] = u.Id
+	}
+}
+
+// dropKeysLocked removes a username or phone from the entry of user id after
+// it moved to another user; caller must hold write lock.
+func (c *ContactCache) dropKeysLocked(id int64, uname, phone string) {
+	e, ok := c.entries[id]
+	if !ok {
+		return
+	}
+	if uname != "" {
+		kept := e.Usernames[:0]
+		for _, n := range e.Usernames {
+			if n != uname {
+				kept = append(kept, n)
+			}
 		}
+		e.Usernames = kept
 	}
-	if u.PhoneNumber != "" {
-		c.phoneToID[u.PhoneNumber] = u.Id
+	if phone != "" && e.Phone == phone {
+		e.Phone = ""
 	}
 }
 
@@ -101,22 +246,162 @@ func (c *ContactCache) Resolve(ext string) (int64, bool) {
 	return 0, false
 }
 
+// load restores entries saved by Flush.
+func (c *ContactCache) load() error {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*contactEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		c.putLocked(e)
+	}
+	coreLog.Infof("loaded %d cached contacts from %s", len(entries), c.path)
+	return nil
+}
+
+// Flush writes the cache to disk if it changed since the last Flush.
+func (c *ContactCache) Flush() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	entries := make([]*contactEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	data, err := json.Marshal(entries)
+	c.dirty = false
+	c.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(c.path, data)
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// lookup runs a TDLib lookup for key unless it recently found nothing.
+// Concurrent lookups of the same key share a single call.
+func (c *ContactCache) lookup(key string, fn func() (int64, bool, error)) (int64, bool, error) {
+	now := time.Now()
+	c.negMu.Lock()
+	until, negative := c.negative[key]
+	if negative && now.After(until) {
+		delete(c.negative, key)
+		negative = false
+	}
+	c.negMu.Unlock()
+	if negative {
+		return 0, false, nil
+	}
+
+	id, ok, err := c.lookups.do(key, fn)
+	if err == nil && !ok && c.negativeTTL > 0 {
+		c.negMu.Lock()
+		c.negative[key] = now.Add(c.negativeTTL)
+		c.negMu.Unlock()
+	}
+	return id, ok, err
+}
+
+// PruneNegative drops expired negative entries. Lookups only expire the
+// key they look up, so scans of unique extensions would otherwise grow the
+// map without bound.
+func (c *ContactCache) PruneNegative() {
+	now := time.Now()
+	c.negMu.Lock()
+	defer c.negMu.Unlock()
+	for key, until := range c.negative {
+		if now.After(until) {
+			delete(c.negative, key)
+		}
+	}
+}
+
 var digitsOnly = regexp.MustCompile(`^\d+$`)
 
-// SearchAndAdd searches contact by query and adds it to cache.
+// ResolveUsername looks up a public Telegram username with SearchPublicChat
+// and caches the resulting user. Usernames of groups and channels are
+// reported as not found.
+func (c *ContactCache) ResolveUsername(cl *client.Client, username string) (int64, bool, error) {
+	username = strings.TrimPrefix(username, "@")
+	if id, ok := c.Resolve(username); ok {
+		return id, true, nil
+	}
+	return c.lookup("public:"+strings.ToLower(username), func() (int64, bool, error) {
+		return c.searchPublic(cl, username)
+	})
+}
+
+// searchPublic resolves username through SearchPublicChat.
+func (c *ContactCache) searchPublic(cl *client.Client, username string) (int64, bool, error) {
+	if err := c.flood.Allow(floodSearchPublic); err != nil {
+		return 0, false, err
+	}
+	chat, err := cl.SearchPublicChat(&client.SearchPublicChatRequest{Username: username})
+	if err != nil {
+		var respErr client.ResponseError
+		if errors.As(err, &respErr) && respErr.Err.Code == 400 {
+			return 0, false, nil
+		}
+		return 0, false, c.flood.Record(floodSearchPublic, err)
+	}
+	private, ok := chat.Type.(*client.ChatTypePrivate)
+	if !ok {
+		return 0, false, nil
+	}
+	u, err := cl.GetUser(&client.GetUserRequest{UserId: private.UserId})
+	if err != nil {
+		return 0, false, err
+	}
+	c.Update(u)
+	return u.Id, true, nil
+}
+
+// SearchAndAdd searches contact by query and adds it to cache. Flood limits
+// are reported as *FloodWaitError.
 func (c *ContactCache) SearchAndAdd(cl *client.Client, query string) (int64, bool, error) {
+	return c.lookup("search:"+strings.ToLower(query), func() (int64, bool, error) {
+		return c.searchAndAdd(cl, query)
+	})
+}
+
+// searchAndAdd runs SearchContacts and imports unknown phone numbers.
+func (c *ContactCache) searchAndAdd(cl *client.Client, query string) (int64, bool, error) {
+	if err := c.flood.Allow(floodSearchContacts); err != nil {
+		return 0, false, err
+	}
 	res, err := cl.SearchContacts(&client.SearchContactsRequest{Query: query, Limit: 1})
 	if err != nil {
-		return 0, false, err
+		return 0, false, c.flood.Record(floodSearchContacts, err)
 	}
 	if len(res.UserIds) == 0 && digitsOnly.MatchString(query) {
+		if err := c.flood.Allow(floodImportContacts); err != nil {
+			return 0, false, err
+		}
 		imp, err := cl.ImportContacts(&client.ImportContactsRequest{Contacts: []*client.Contact{{PhoneNumber: query}}})
 		if err != nil {
-			return 0, false, err
+			return 0, false, c.flood.Record(floodImportContacts, err)
 		}
 		if len(imp.UserIds) == 0 || imp.UserIds[0] == 0 {
 			return 0, false, nil
 		}
+		c.imported.Add(imp.UserIds[0], query)
 		u, err := cl.GetUser(&client.GetUserRequest{UserId: imp.UserIds[0]})
 		if err != nil {
 			return 0, false, err
@@ -134,3 +419,41 @@ func (c *ContactCache) SearchAndAdd(cl *client.Client, query string) (int64, boo
 	c.Update(u)
 	return u.Id, true, nil
 }
+
+// lookupGroup deduplicates concurrent lookups of the same key.
+type lookupGroup struct {
+	mu    sync.Mutex
+	calls map[string]*lookupCall
+}
+
+type lookupCall struct {
+	done chan struct{}
+	id   int64
+	ok   bool
+	err  error
+}
+
+// do runs fn for key, or waits for and shares the result of a run that is
+// already in flight.
+func (g *lookupGroup) do(key string, fn func() (int64, bool, error)) (int64, bool, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*lookupCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.id, call.ok, call.err
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.id, call.ok, call.err = fn()
+	close(call.done)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return call.id, call.ok, call.err
+}
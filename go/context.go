@@ -1,5 +1,7 @@
 package main
 
+import "context"
+
 // Controller represents an external media controller.
 type Controller interface {
 	Stop()
@@ -13,17 +15,48 @@ const (
 	StateOutgoing
 	StateWaitMedia
 	StateWaitDTMF
+	StateMediaActive
 	StateCleanup
 )
 
 // Context holds state for a single bridged call.
 type Context struct {
 	ID         string
+	Account    *Account
 	SIPCallID  string
 	TGCallID   int64
 	UserID     int64
 	Controller Controller
 	State      CallState
+	// FromSIP is set for calls placed from SIP to Telegram. Answered is
+	// set once their 200 OK is sent; no media flows to the caller before.
+	FromSIP  bool
+	Answered bool
+	// CancelDial stops ringing SIP targets of a Telegram->SIP call.
+	CancelDial context.CancelFunc
+	// Media holds the RTP/RTCP sockets of the call.
+	Media *mediaPorts
+	// SRTPPolicy is the SRTP policy of the trunk the call uses.
+	SRTPPolicy string
+	// OfferedCrypto are the SDES keys of our SDP offer.
+	OfferedCrypto []*cryptoAttribute
+	// Codec, SRTP and RTPPeer are set once SDP is negotiated. SRTP is
+	// nil for plain RTP.
+	Codec   sdpCodec
+	Ptime   int // ms of audio per RTP packet
+	SRTP    *srtpSession
+	RTPPeer *rtpLatch
+	// Bridge carries audio between Controller and RTP once both legs
+	// are ready.
+	Bridge *rtpBridge
+	// Ringback plays early media to a queued SIP caller until the bridge
+	// starts; EarlyTag is the To tag of its 183 response.
+	Ringback *ringback
+	EarlyTag string
+
+	// closed is set by cleanUp under the gateway lock; no media is
+	// started afterwards.
+	closed bool
 }
 
 // internalEventType enumerates internal gateway events.
@@ -34,6 +67,8 @@ const (
 	evOutgoing
 	evWaitMedia
 	evWaitDTMF
+	evMediaEstablished
+	evMediaFailed
 	evCleanup
 )
 
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	client "github.com/zelenin/go-tdlib/client"
+	ini "gopkg.in/ini.v1"
+)
+
+// dialRuleHeaderPrefix prefixes dial plan keys holding extra SIP headers,
+// e.g. header.X-Queue=vip.
+const dialRuleHeaderPrefix = "header."
+
+// DialRule routes matching Telegram->SIP calls to SIP targets. Empty match
+// criteria match every call.
+type DialRule struct {
+	name string
+
+	userIDs       map[int64]bool
+	usernames     map[string]bool
+	phonePrefixes []string
+	contact       *bool
+	accounts      map[string]bool
+	days          map[time.Weekday]bool
+	timeFrom      int // minutes since midnight, -1 if unset
+	timeTo        int
+	location      *time.Location
+
+	route *dialRoute
+}
+
+// callerInfo describes a Telegram caller for dial plan matching.
+type callerInfo struct {
+	account   string
+	userID    int64
+	usernames []string
+	phone     string // E.164 with leading "+", empty if hidden
+	contact   bool
+}
+
+func newCallerInfo(acc *Account, phones *PhoneRules, u *client.User) callerInfo {
+	c := callerInfo{account: acc.Name(), userID: u.Id, contact: u.IsContact}
+	if u.Usernames != nil {
+		c.usernames = append(c.usernames, u.Usernames.ActiveUsernames...)
+		if u.Usernames.EditableUsername != "" {
+			c.usernames = append(c.usernames, u.Usernames.EditableUsername)
+		}
+	}
+	// TDLib numbers are international without "+".
+	if phone, ok := phones.Normalize(formatE164(u.PhoneNumber)); ok {
+		c.phone = phone
+	}
+	return c
+}
+
+// Name returns the rule name taken from its [dialplan.<name>] section.
+func (r *DialRule) Name() string { return r.name }
+
+// Matches reports whether the rule applies to caller at time now.
+func (r *DialRule) Matches(c callerInfo, now time.Time) bool {
+	if len(r.accounts) > 0 && !r.accounts[c.account] {
+		return false
+	}
+	if len(r.userIDs) > 0 && !r.userIDs[c.userID] {
+		return false
+	}
+	if len(r.usernames) > 0 {
+		found := false
+		for _, u := range c.usernames {
+			if r.usernames[strings.ToLower(u)] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.phonePrefixes) > 0 {
+		found := false
+		for _, p := range r.phonePrefixes {
+			if c.phone != "" && strings.HasPrefix(c.phone, p) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.contact != nil && *r.contact != c.contact {
+		return false
+	}
+
+	now = now.In(r.location)
+	if len(r.days) > 0 && !r.days[now.Weekday()] {
+		return false
+	}
+	if r.timeFrom >= 0 {
+		m := now.Hour()*60 + now.Minute()
+		if r.timeFrom <= r.timeTo {
+			if m < r.timeFrom || m >= r.timeTo {
+				return false
+			}
+		} else if m < r.timeFrom && m >= r.timeTo {
+			// The window wraps around midnight.
+			return false
+		}
+	}
+	return true
+}
+
+// route picks the SIP targets, From user and extra headers for a call from u
+// received by acc. Calls matching no dial plan rule go to the account's
+// callback_uri.
+func (g *Gateway) route(acc *Account, u *client.User) *dialRoute {
+	caller := newCallerInfo(acc, g.phones, u)
+	now := time.Now()
+	for _, r := range g.dialPlan {
+		if r.Matches(caller, now) {
+			coreLog.Infof("telegram call from %d on %s matched dial plan rule %s", u.Id, acc.Name(), r.Name())
+			return r.route
+		}
+	}
+	return &dialRoute{
+		targets:  splitList(acc.CallbackURI()),
+		timeouts: g.ringTimeouts,
+		fork:     g.forkMode,
+		fromUser: defaultFromUser,
+	}
+}
+
+// defaultFromUser is the From user of Telegram->SIP calls.
+const defaultFromUser = "tg"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// loadDialRule reads a [dialplan.<name>] section.
+func loadDialRule(sec *ini.Section, name string) (*DialRule, error) {
+	r := &DialRule{
+		name:     name,
+		timeFrom: -1,
+		location: time.Local,
+		route: &dialRoute{
+			targets:  splitList(sec.Key("target").String()),
+			fork:     sec.Key("fork").In(forkSequential, []string{forkSequential, forkParallel}),
+			fromUser: sec.Key("from_user").MustString(defaultFromUser),
+			headers:  make(map[string]string),
+			srtp:     sec.Key("srtp").In("", []string{srtpOff, srtpOptional, srtpMandatory}),
+		},
+	}
+	if len(r.route.targets) == 0 {
+		return nil, fmt.Errorf("dial plan rule %s: target is required", name)
+	}
+	timeouts, err := parseRingTimeouts(sec.Key("ring_timeout").String())
+	if err != nil {
+		return nil, fmt.Errorf("dial plan rule %s: %w", name, err)
+	}
+	r.route.timeouts = timeouts
+
+	for _, v := range splitList(sec.Key("match_user_id").String()) {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("dial plan rule %s: invalid user id %q", name, v)
+		}
+		if r.userIDs == nil {
+			r.userIDs = make(map[int64]bool)
+		}
+		r.userIDs[id] = true
+	}
+	for _, v := range splitList(sec.Key("match_username").String()) {
+		if r.usernames == nil {
+			r.usernames = make(map[string]bool)
+		}
+		r.usernames[strings.ToLower(strings.TrimPrefix(v, "@"))] = true
+	}
+	for _, v := range splitList(sec.Key("match_phone_prefix").String()) {
+		r.phonePrefixes = append(r.phonePrefixes, "+"+strings.TrimPrefix(v, "+"))
+	}
+	if sec.HasKey("match_contact") {
+		contact, err := sec.Key("match_contact").Bool()
+		if err != nil {
+			return nil, fmt.Errorf("dial plan rule %s: invalid match_contact: %w", name, err)
+		}
+		r.contact = &contact
+	}
+	for _, v := range splitList(sec.Key("match_account").String()) {
+		if r.accounts == nil {
+			r.accounts = make(map[string]bool)
+		}
+		r.accounts[v] = true
+	}
+
+	days, err := parseDays(sec.Key("match_days").String())
+	if err != nil {
+		return nil, fmt.Errorf("dial plan rule %s: %w", name, err)
+	}
+	r.days = days
+	if v := sec.Key("match_time").String(); v != "" {
+		from, to, ok := strings.Cut(v, "-")
+		if !ok {
+			return nil, fmt.Errorf("dial plan rule %s: match_time must be HH:MM-HH:MM", name)
+		}
+		if r.timeFrom, err = parseClock(from); err == nil {
+			r.timeTo, err = parseClock(to)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("dial plan rule %s: %w", name, err)
+		}
+	}
+	if v := sec.Key("timezone").String(); v != "" {
+		if r.location, err = time.LoadLocation(v); err != nil {
+			return nil, fmt.Errorf("dial plan rule %s: %w", name, err)
+		}
+	}
+
+	for _, k := range sec.Keys() {
+		if h := strings.TrimPrefix(k.Name(), dialRuleHeaderPrefix); h != k.Name() && h != "" {
+			r.route.headers[h] = k.String()
+		}
+	}
+	return r, nil
+}
+
+// splitList splits a comma separated list and drops empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// parseDays parses weekday lists such as "mon-fri,sun".
+func parseDays(s string) (map[time.Weekday]bool, error) {
+	items := splitList(strings.ToLower(s))
+	if len(items) == 0 {
+		return nil, nil
+	}
+	days := make(map[time.Weekday]bool)
+	for _, v := range items {
+		from, to, isRange := strings.Cut(v, "-")
+		first, ok1 := weekdays[from]
+		last, ok2 := weekdays[to]
+		if !isRange {
+			last, ok2 = first, ok1
+		}
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("invalid day %q", v)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight; 24:00 is allowed as
+// the end of a day.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		if strings.TrimSpace(s) == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// dialTarget returns the extension dialed by a SIP request and whether it is
+// a telephone number. The called party is taken from P-Called-Party-ID, the
+// request-URI and the To header, in that order. tel: URIs of the request
+// line and To header arrive as sip: URIs with user=phone, see telConn.
+func dialTarget(req sip.Request) (string, bool) {
+	for _, hdr := range req.GetHeaders("P-Called-Party-ID") {
+		if ext, phone := targetFromString(addrSpec(hdr.Value())); ext != "" {
+			return ext, phone
+		}
+	}
+	if ext, phone := targetFromURI(req.Recipient()); ext != "" {
+		return ext, phone
+	}
+	if toHdr, _ := req.To(); toHdr != nil {
+		return targetFromURI(toHdr.Address)
+	}
+	return "", false
+}
+
+// addrSpec extracts the URI from a name-addr such as `"Bob" <tel:+1234>`.
+func addrSpec(value string) string {
+	value = strings.TrimSpace(value)
+	if start := strings.IndexByte(value, '<'); start >= 0 {
+		if end := strings.IndexByte(value[start:], '>'); end > 0 {
+			return value[start+1 : start+end]
+		}
+	}
+	return value
+}
+
+// targetFromString parses a sip:, sips: or tel: URI into an extension.
+func targetFromString(raw string) (string, bool) {
+	lower := strings.ToLower(raw)
+	switch {
+	case strings.HasPrefix(lower, "tel:"):
+		return telephoneSubscriber(raw[len("tel:"):]), true
+	case strings.HasPrefix(lower, "sip:"), strings.HasPrefix(lower, "sips:"):
+		uri, err := parser.ParseUri(raw)
+		if err != nil {
+			coreLog.Debugf("parse called party %q: %v", raw, err)
+			return "", false
+		}
+		return targetFromURI(uri)
+	}
+	return "", false
+}
+
+// targetFromURI returns the extension in the user part of a SIP URI. With
+// user=phone the user part is a telephone number, otherwise Telegram links
+// are decoded.
+func targetFromURI(uri sip.Uri) (string, bool) {
+	if uri == nil || uri.User() == nil {
+		return "", false
+	}
+	user := uri.User().String()
+	if uri.Password() != nil && uri.Password().String() != "" {
+		// An unescaped "tg://..." or "https://..." user part is split at
+		// the first colon like user:password.
+		user += ":" + uri.Password().String()
+	}
+	if params := uri.UriParams(); params != nil {
+		if v, ok := params.Get("user"); ok && v != nil && strings.EqualFold(v.String(), "phone") {
+			return telephoneSubscriber(user), true
+		}
+	}
+	return decodeTelegramLink(user), false
+}
+
+// telephoneSubscriber converts the telephone-subscriber part of a tel: URI
+// (RFC 3966) to a dialable number. Visual separators are dropped and a local
+// number is prefixed with a global phone-context.
+func telephoneSubscriber(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		s = u
+	}
+	parts := strings.Split(s, ";")
+	number := phoneSeparators.Replace(strings.TrimSpace(parts[0]))
+	if strings.HasPrefix(number, "+") {
+		return number
+	}
+	for _, p := range parts[1:] {
+		name, value, _ := strings.Cut(p, "=")
+		if strings.EqualFold(strings.TrimSpace(name), "phone-context") {
+			if ctx := phoneSeparators.Replace(strings.TrimSpace(value)); strings.HasPrefix(ctx, "+") {
+				return ctx + number
+			}
+		}
+	}
+	return number
+}
+
+// decodeTelegramLink turns t.me/<username> and tg://resolve?domain=<username>
+// user parts into tg#<username> and their phone forms into +<number>. Other
+// extensions are returned unchanged.
+func decodeTelegramLink(ext string) string {
+	lower := strings.ToLower(ext)
+	if strings.HasPrefix(lower, "tg://resolve?") || strings.HasPrefix(lower, "tg:resolve?") {
+		q, err := url.ParseQuery(ext[strings.IndexByte(ext, '?')+1:])
+		if err != nil {
+			return ext
+		}
+		if d := q.Get("domain"); d != "" {
+			return "tg#" + d
+		}
+		if p := q.Get("phone"); p != "" {
+			return "+" + strings.TrimPrefix(p, "+")
+		}
+		return ext
+	}
+
+	link := ext
+	for _, scheme := range []string{"https://", "http://"} {
+		if strings.HasPrefix(strings.ToLower(link), scheme) {
+			link = link[len(scheme):]
+		}
+	}
+	for _, host := range []string{"t.me/", "telegram.me/", "telegram.dog/"} {
+		if !strings.HasPrefix(strings.ToLower(link), host) {
+			continue
+		}
+		name := link[len(host):]
+		if i := strings.IndexAny(name, "/?#"); i >= 0 {
+			name = name[:i]
+		}
+		switch {
+		case name == "":
+			return ext
+		case strings.HasPrefix(name, "+") && isDigits(name[1:]):
+			return name
+		default:
+			return "tg#" + strings.TrimPrefix(name, "@")
+		}
+	}
+	return ext
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DNS record types used for SIP server location.
+const (
+	dnsTypeA     uint16 = 1
+	dnsTypeAAAA  uint16 = 28
+	dnsTypeSRV   uint16 = 33
+	dnsTypeNAPTR uint16 = 35
+)
+
+// dnsTimeout limits a single query to one name server.
+const dnsTimeout = 3 * time.Second
+
+// errDNSNotFound is returned for names without records of the queried type.
+var errDNSNotFound = errors.New("no such record")
+
+// dnsRecord is a resource record of one of the supported types.
+type dnsRecord struct {
+	Name string
+	Type uint16
+	TTL  time.Duration
+
+	IP net.IP // A, AAAA
+
+	Priority uint16 // SRV
+	Weight   uint16
+	Port     uint16
+	Target   string
+
+	Order       uint16 // NAPTR
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+// dnsClient queries DNS records. The SIP resolver depends on this interface
+// so that it can be pointed at a local stand-in.
+type dnsClient interface {
+	Query(ctx context.Context, name string, qtype uint16) ([]dnsRecord, error)
+}
+
+// udpDNSClient is a minimal stub resolver asking the given name servers over
+// UDP and retrying truncated answers over TCP.
+type udpDNSClient struct {
+	servers []string
+}
+
+// newDNSClient creates a client for server ("host[:port]"), or for the name
+// servers of /etc/resolv.conf if server is empty.
+func newDNSClient(server string) *udpDNSClient {
+	if server != "" {
+		return &udpDNSClient{servers: []string{withDefaultPort(server, "53")}}
+	}
+	servers := readResolvConf("/etc/resolv.conf")
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return &udpDNSClient{servers: servers}
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// readResolvConf returns the name servers listed in path.
+func readResolvConf(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, withDefaultPort(fields[1], "53"))
+		}
+	}
+	return servers
+}
+
+// Query asks the name servers in turn until one answers.
+func (c *udpDNSClient) Query(ctx context.Context, name string, qtype uint16) ([]dnsRecord, error) {
+	query, id, err := buildDNSQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, server := range c.servers {
+		resp, err := exchangeDNS(ctx, "udp", server, query)
+		if err == nil && len(resp) > 3 && resp[2]&0x02 != 0 {
+			// Truncated, repeat over TCP.
+			resp, err = exchangeDNS(ctx, "tcp", server, query)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return parseDNSResponse(resp, id, qtype)
+	}
+	return nil, fmt.Errorf("query %s: %w", name, lastErr)
+}
+
+func exchangeDNS(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		msg := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		copy(msg[2:], query)
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+		_, err := io.ReadFull(conn, resp)
+		return resp, err
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 65535)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp[:n], nil
+}
+
+// buildDNSQuery encodes a recursive query for name and qtype.
+func buildDNSQuery(name string, qtype uint16) ([]byte, uint16, error) {
+	id := uint16(rand.Intn(1 << 16))
+	msg := make([]byte, 12, 12+len(name)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)      // QDCOUNT
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid domain name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1) // class IN
+	return msg, id, nil
+}
+
+var errDNSMalformed = errors.New("malformed DNS response")
+
+// parseDNSResponse returns the answer records of type qtype.
+func parseDNSResponse(msg []byte, id, qtype uint16) ([]dnsRecord, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id {
+		return nil, errDNSMalformed
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		return nil, errDNSNotFound
+	default:
+		return nil, fmt.Errorf("DNS server failure, rcode %d", rcode)
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		var err error
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	var records []dnsRecord
+	for i := 0; i < anCount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, errDNSMalformed
+		}
+		rr := dnsRecord{
+			Name: name,
+			Type: binary.BigEndian.Uint16(msg[next:]),
+			TTL:  time.Duration(binary.BigEndian.Uint32(msg[next+4:])) * time.Second,
+		}
+		rdLen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		off = rdata + rdLen
+		if off > len(msg) {
+			return nil, errDNSMalformed
+		}
+		if rr.Type != qtype {
+			// CNAME chains are followed by the recursive server.
+			continue
+		}
+		if err := parseRData(msg, rdata, rdLen, &rr); err != nil {
+			return nil, err
+		}
+		records = append(records, rr)
+	}
+	if len(records) == 0 {
+		return nil, errDNSNotFound
+	}
+	return records, nil
+}
+
+func parseRData(msg []byte, off, length int, rr *dnsRecord) error {
+	end := off + length
+	var err error
+	switch rr.Type {
+	case dnsTypeA, dnsTypeAAAA:
+		if (rr.Type == dnsTypeA && length != net.IPv4len) || (rr.Type == dnsTypeAAAA && length != net.IPv6len) {
+			return errDNSMalformed
+		}
+		rr.IP = net.IP(append([]byte(nil), msg[off:end]...))
+	case dnsTypeSRV:
+		if length < 7 {
+			return errDNSMalformed
+		}
+		rr.Priority = binary.BigEndian.Uint16(msg[off:])
+		rr.Weight = binary.BigEndian.Uint16(msg[off+2:])
+		rr.Port = binary.BigEndian.Uint16(msg[off+4:])
+		rr.Target, _, err = readDNSName(msg, off+6)
+	case dnsTypeNAPTR:
+		if length < 7 {
+			return errDNSMalformed
+		}
+		rr.Order = binary.BigEndian.Uint16(msg[off:])
+		rr.Preference = binary.BigEndian.Uint16(msg[off+2:])
+		off += 4
+		for _, s := range []*string{&rr.Flags, &rr.Service, &rr.Regexp} {
+			if off >= end || off+1+int(msg[off]) > end {
+				return errDNSMalformed
+			}
+			*s = string(msg[off+1 : off+1+int(msg[off])])
+			off += 1 + int(msg[off])
+		}
+		rr.Replacement, _, err = readDNSName(msg, off)
+	}
+	return err
+}
+
+// readDNSName decodes a possibly compressed domain name at off and returns it
+// with the offset following it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errDNSMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
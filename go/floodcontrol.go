@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	client "github.com/zelenin/go-tdlib/client"
+)
+
+// floodMethod names a Telegram method with its own FLOOD_WAIT window.
+type floodMethod string
+
+const (
+	floodImportContacts floodMethod = "ImportContacts"
+	floodSearchContacts floodMethod = "SearchContacts"
+	floodCreateCall     floodMethod = "CreateCall"
+	floodSearchPublic   floodMethod = "SearchPublicChat"
+	// floodCallRate is reported when the local call-rate limiter is empty.
+	floodCallRate floodMethod = "CallRate"
+)
+
+var retryAfterRe = regexp.MustCompile(`(?i)retry after (\d+)`)
+var peerFloodRe = regexp.MustCompile(`(?i)PEER_FLOOD`)
+
+// parseFloodError extracts the requested wait time from a TDLib error. The
+// second result is true for PEER_FLOOD, the third if err is a flood error.
+func parseFloodError(err error) (time.Duration, bool, bool) {
+	var respErr client.ResponseError
+	if !errors.As(err, &respErr) {
+		return 0, false, false
+	}
+	if m := retryAfterRe.FindStringSubmatch(respErr.Err.Message); len(m) > 1 {
+		if s, e := strconv.Atoi(m[1]); e == nil {
+			return time.Duration(s) * time.Second, false, true
+		}
+	}
+	if peerFloodRe.MatchString(respErr.Err.Message) {
+		return 0, true, true
+	}
+	return 0, false, false
+}
+
+// FloodWaitError reports that a Telegram method is blocked by flood control.
+type FloodWaitError struct {
+	Method floodMethod
+	Wait   time.Duration
+}
+
+func (e *FloodWaitError) Error() string {
+	return fmt.Sprintf("%s blocked: FLOOD_WAIT %d", e.Method, e.Seconds())
+}
+
+// Seconds returns the remaining wait rounded up to whole seconds.
+func (e *FloodWaitError) Seconds() int {
+	return int((e.Wait + time.Second - 1) / time.Second)
+}
+
+// FloodControl tracks Telegram flood limits of a single account. Block
+// windows are kept per method and persisted so that a restart does not
+// immediately hit FLOOD_WAIT again. It is safe for concurrent use.
+type FloodControl struct {
+	mu        sync.Mutex
+	path      string
+	blocks    map[floodMethod]time.Time
+	extraWait time.Duration
+	peerFlood time.Duration
+	calls     *tokenBucket
+}
+
+// NewFloodControl creates a FloodControl persisting its state to path. The
+// outbound call rate is limited to callRate calls per minute with bursts of
+// callBurst; a zero callRate disables the limiter.
+func NewFloodControl(path string, extraWait, peerFlood time.Duration, callRate float64, callBurst int) *FloodControl {
+	f := &FloodControl{
+		path:      path,
+		blocks:    make(map[floodMethod]time.Time),
+		extraWait: extraWait,
+		peerFlood: peerFlood,
+	}
+	if callRate > 0 {
+		f.calls = newTokenBucket(callRate/60, callBurst)
+	}
+	if err := f.load(); err != nil {
+		coreLog.Warnf("load flood state %s: %v", path, err)
+	}
+	return f
+}
+
+// Remaining returns how long method stays blocked.
+func (f *FloodControl) Remaining(method floodMethod) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.remainingLocked(method, time.Now())
+}
+
+func (f *FloodControl) remainingLocked(method floodMethod, now time.Time) time.Duration {
+	until, ok := f.blocks[method]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(f.blocks, method)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// Allow returns a *FloodWaitError if method is currently blocked. Calls to
+// CreateCall additionally take a token from the call-rate limiter.
+func (f *FloodControl) Allow(method floodMethod) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if wait := f.remainingLocked(method, now); wait > 0 {
+		return &FloodWaitError{Method: method, Wait: wait}
+	}
+	if method == floodCreateCall && f.calls != nil {
+		if wait := f.calls.take(now); wait > 0 {
+			return &FloodWaitError{Method: floodCallRate, Wait: wait}
+		}
+	}
+	return nil
+}
+
+// Record inspects the result of a method call. Flood errors open a block
+// window for method and are returned as *FloodWaitError; other errors are
+// returned unchanged.
+func (f *FloodControl) Record(method floodMethod, err error) error {
+	if err == nil {
+		return nil
+	}
+	wait, peer, matched := parseFloodError(err)
+	if !matched {
+		return err
+	}
+	if peer {
+		wait = f.peerFlood
+	}
+	wait += f.extraWait
+	coreLog.Warnf("telegram flood limit on %s, blocking for %d seconds", method, int(wait.Seconds()))
+
+	f.mu.Lock()
+	f.blocks[method] = time.Now().Add(wait)
+	if saveErr := f.saveLocked(); saveErr != nil {
+		coreLog.Warnf("save flood state %s: %v", f.path, saveErr)
+	}
+	f.mu.Unlock()
+	return &FloodWaitError{Method: method, Wait: wait}
+}
+
+// load restores unexpired block windows from disk.
+func (f *FloodControl) load() error {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var blocks map[floodMethod]time.Time
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for m, until := range blocks {
+		if until.After(now) {
+			f.blocks[m] = until
+			coreLog.Warnf("%s blocked by flood control until %s", m, until.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// saveLocked writes block windows to disk; caller must hold f.mu.
+func (f *FloodControl) saveLocked() error {
+	data, err := json.Marshal(f.blocks)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
+
+// writeFileAtomic replaces path with data via a temporary file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// tokenBucket is a simple token bucket; caller must serialize access.
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take consumes a token and returns zero, or returns how long to wait for
+// the next token without consuming anything.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// errCallCanceled is returned when the caller cancels a queued INVITE.
+var errCallCanceled = errors.New("call canceled by caller")
+
+// floodQueue holds SIP->Telegram calls while CreateCall is blocked for a
+// short time instead of rejecting them right away. A nil queue never
+// accepts calls.
+type floodQueue struct {
+	mu        sync.Mutex
+	depth     int
+	maxDepth  int
+	threshold time.Duration
+	maxWait   time.Duration
+}
+
+// newFloodQueue creates a queue for blocks shorter than threshold, holding
+// at most maxDepth calls for no longer than maxWait each.
+func newFloodQueue(threshold, maxWait time.Duration, maxDepth int) *floodQueue {
+	return &floodQueue{threshold: threshold, maxWait: maxWait, maxDepth: maxDepth}
+}
+
+// accepts reports whether a block of wait is short enough to be queued.
+func (q *floodQueue) accepts(wait time.Duration) bool {
+	return q != nil && wait <= q.threshold && wait <= q.maxWait
+}
+
+// enter reserves a queue slot for a call blocked for wait.
+func (q *floodQueue) enter(wait time.Duration) bool {
+	if !q.accepts(wait) {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.depth >= q.maxDepth {
+		return false
+	}
+	q.depth++
+	return true
+}
+
+// leave releases a slot reserved by enter.
+func (q *floodQueue) leave() {
+	q.mu.Lock()
+	q.depth--
+	q.mu.Unlock()
+}
+
+// waitFloodQueue keeps a blocked INVITE ringing and places the Telegram call
+// as soon as the flood window opens, returning its ID. The caller must hold
+// a queue slot. sdp is the local session description of the call.
+func (g *Gateway) waitFloodQueue(req sip.Request, tx sip.ServerTransaction, ctx *Context, sdp string, userID int64, fw *FloodWaitError) (int64, error) {
+	acc := ctx.Account
+	coreLog.Infof("queueing call on %s for %d seconds due to flood limit on %s", acc.Name(), fw.Seconds(), fw.Method)
+	var cancels <-chan sip.Request
+	if tx != nil {
+		cancels = tx.Cancels()
+		g.earlyMedia(req, ctx, sdp)
+	}
+
+	deadline := time.Now().Add(g.queue.maxWait)
+	for {
+		if time.Now().Add(fw.Wait).After(deadline) {
+			return 0, fw
+		}
+		timer := time.NewTimer(fw.Wait)
+		select {
+		case <-timer.C:
+		case cancel, ok := <-cancels:
+			timer.Stop()
+			if !ok {
+				// The transaction ended, there is nothing left to answer.
+				coreLog.Infof("queued call on %s ended by its transaction", acc.Name())
+				return 0, errCallCanceled
+			}
+			coreLog.Infof("queued call on %s canceled by caller", acc.Name())
+			_ = g.sipServer.Send(sip.NewResponseFromRequest("", cancel, statusOK, "OK", ""))
+			g.sipServer.RespondOnRequest(req, statusRequestTerminated, "Request Terminated", "", nil)
+			return 0, errCallCanceled
+		}
+
+		id, err := g.placeTelegramCall(acc, userID)
+		if !errors.As(err, &fw) || fw.Wait > g.queue.threshold {
+			return id, err
+		}
+	}
+}
+
+// earlyMedia answers a queued INVITE with 183 Session Progress and plays a
+// ringback tone until the call is bridged. An INVITE without an offer has
+// no negotiated stream yet, so it gets 180 Ringing and the caller's phone
+// plays the ringback itself.
+func (g *Gateway) earlyMedia(req sip.Request, ctx *Context, sdp string) {
+	if ctx.RTPPeer != nil {
+		tag, err := g.sipClient.Progress(req, sdp)
+		if err == nil {
+			ctx.EarlyTag = tag
+			if ctx.Ringback, err = startRingback(ctx, g.codecOpts); err == nil {
+				return
+			}
+		}
+		coreLog.Warnf("early media for call %s: %v", ctx.ID, err)
+		if ctx.EarlyTag != "" {
+			return
+		}
+	}
+	g.sipServer.RespondOnRequest(req, statusRinging, "Ringing", "", nil)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Forking modes of Telegram->SIP calls with several targets.
+const (
+	forkParallel   = "parallel"
+	forkSequential = "sequential"
+)
+
+// defaultRingTimeout limits how long a single target rings.
+const defaultRingTimeout = 30 * time.Second
+
+// dialRoute describes where a Telegram->SIP call is sent.
+type dialRoute struct {
+	targets  []string
+	timeouts []time.Duration // per target, the last one repeats
+	fork     string
+	fromUser string
+	headers  map[string]string
+	srtp     string // SRTP policy, empty for the [sip] default
+}
+
+// ringTimeout returns the ring timeout of the i-th target.
+func (r *dialRoute) ringTimeout(i int) time.Duration {
+	switch {
+	case len(r.timeouts) == 0:
+		return defaultRingTimeout
+	case i < len(r.timeouts):
+		return r.timeouts[i]
+	default:
+		return r.timeouts[len(r.timeouts)-1]
+	}
+}
+
+// parseRingTimeouts parses a comma separated list of seconds.
+func parseRingTimeouts(s string) ([]time.Duration, error) {
+	var timeouts []time.Duration
+	for _, v := range splitList(s) {
+		var sec int
+		if _, err := fmt.Sscan(v, &sec); err != nil || sec <= 0 {
+			return nil, fmt.Errorf("invalid ring timeout %q", v)
+		}
+		timeouts = append(timeouts, time.Duration(sec)*time.Second)
+	}
+	return timeouts, nil
+}
+
+// errNoAnswer is returned when no forked target answered.
+var errNoAnswer = errors.New("no target answered")
+
+// errGlobalFailure is returned when a target answered with a 6xx response,
+// which tells not to try any other target (RFC 3261 section 16.7).
+var errGlobalFailure = errors.New("call declined everywhere")
+
+// Fork dials the targets of route and returns the Call-ID of the answered
+// call. In parallel mode all targets ring at once and the first 2xx wins;
+// in sequential mode the next target is tried after a timeout or failure.
+// Branches that lose are canceled, late answers are hung up. A 6xx response
+// ends the hunt in both modes.
+func (c *SIPClient) Fork(ctx context.Context, route *dialRoute, headers map[string]string, sdp string) (string, error) {
+	if route.fork == forkParallel && len(route.targets) > 1 {
+		return c.forkParallel(ctx, route, headers, sdp)
+	}
+	for i, target := range route.targets {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		branchCtx, cancel := context.WithTimeout(ctx, route.ringTimeout(i))
+		callID, results, err := c.Dial(branchCtx, route.fromUser, target, headers, sdp)
+		if err != nil {
+			cancel()
+			coreLog.Warnf("SIP dial %s failed: %v", target, err)
+			continue
+		}
+		res := <-results
+		cancel()
+		if res.Answered() {
+			return callID, nil
+		}
+		coreLog.Infof("SIP target %s did not answer: %s", target, describeDialResult(res))
+		if globalFailure(res) {
+			return "", errGlobalFailure
+		}
+	}
+	return "", errNoAnswer
+}
+
+func (c *SIPClient) forkParallel(ctx context.Context, route *dialRoute, headers map[string]string, sdp string) (string, error) {
+	results := make(chan DialResult, len(route.targets))
+	cancels := make(map[string]context.CancelFunc)
+	for i, target := range route.targets {
+		branchCtx, cancel := context.WithTimeout(ctx, route.ringTimeout(i))
+		callID, branch, err := c.Dial(branchCtx, route.fromUser, target, headers, sdp)
+		if err != nil {
+			cancel()
+			coreLog.Warnf("SIP dial %s failed: %v", target, err)
+			continue
+		}
+		cancels[callID] = cancel
+		go func() { results <- <-branch }()
+	}
+
+	for pending := len(cancels); pending > 0; pending-- {
+		res := <-results
+		cancels[res.CallID]()
+		if !res.Answered() {
+			coreLog.Infof("SIP target %s did not answer: %s", res.Target, describeDialResult(res))
+			if globalFailure(res) {
+				c.dropBranches(results, cancels, "", pending-1)
+				return "", errGlobalFailure
+			}
+			continue
+		}
+		coreLog.Infof("SIP target %s answered", res.Target)
+		c.dropBranches(results, cancels, res.CallID, pending-1)
+		return res.CallID, nil
+	}
+	return "", errNoAnswer
+}
+
+// dropBranches cancels all branches but keep and collects the pending ones
+// in the background, so that late answers are released without delaying
+// the caller.
+func (c *SIPClient) dropBranches(results <-chan DialResult, cancels map[string]context.CancelFunc, keep string, pending int) {
+	for id, cancel := range cancels {
+		if id != keep {
+			cancel()
+		}
+	}
+	go func() {
+		for ; pending > 0; pending-- {
+			res := <-results
+			cancels[res.CallID]()
+			if res.Answered() {
+				coreLog.Infof("SIP target %s answered late, hanging up", res.Target)
+				_ = c.Hangup(context.Background(), res.CallID)
+			}
+		}
+	}()
+}
+
+// globalFailure reports whether a target rejected the call with a 6xx
+// response.
+func globalFailure(res DialResult) bool {
+	return res.Err == nil && res.Response != nil && res.Response.StatusCode() >= 600
+}
+
+func describeDialResult(res DialResult) string {
+	if res.Err != nil {
+		return res.Err.Error()
+	}
+	if res.Response == nil {
+		return "no response"
+	}
+	return strings.TrimSpace(fmt.Sprintf("%d %s", res.Response.StatusCode(), res.Response.Reason()))
+}
@@ -0,0 +1,121 @@
+package main
+
+// G.711 companding (ITU-T G.711) of 16 bit linear PCM at 8 kHz. Encoding
+// follows the segment search of the reference implementation, decoding
+// uses tables built at start.
+
+const (
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+var (
+	ulawTable [256]int16
+	alawTable [256]int16
+)
+
+func init() {
+	for i := range 256 {
+		ulawTable[i] = ulawDecode(byte(i))
+		alawTable[i] = alawDecode(byte(i))
+	}
+}
+
+// ulawEncode compresses a sample to µ-law.
+func ulawEncode(sample int16) byte {
+	s := int(sample)
+	sign := 0
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > ulawClip {
+		s = ulawClip
+	}
+	s += ulawBias
+	exp := 7
+	for mask := 0x4000; s&mask == 0 && exp > 0; mask >>= 1 {
+		exp--
+	}
+	mantissa := (s >> (exp + 3)) & 0x0f
+	return ^byte(sign | exp<<4 | mantissa)
+}
+
+func ulawDecode(b byte) int16 {
+	b = ^b
+	exp := int(b>>4) & 0x07
+	s := ((int(b&0x0f) << 3) + ulawBias) << exp
+	s -= ulawBias
+	if b&0x80 != 0 {
+		return int16(-s)
+	}
+	return int16(s)
+}
+
+// alawEncode compresses a sample to A-law.
+func alawEncode(sample int16) byte {
+	s := int(sample) >> 3 // A-law uses 13 bit magnitudes
+	mask := byte(0xd5)
+	if s < 0 {
+		s = -s - 1
+		mask = 0x55
+	}
+	seg := 0
+	for limit := 0x1f; s > limit && seg < 8; limit = limit<<1 | 1 {
+		seg++
+	}
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	v := byte(seg << 4)
+	if seg < 2 {
+		v |= byte(s>>1) & 0x0f
+	} else {
+		v |= byte(s>>seg) & 0x0f
+	}
+	return v ^ mask
+}
+
+func alawDecode(b byte) int16 {
+	b ^= 0x55
+	t := int(b&0x0f) << 4
+	switch seg := int(b&0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t = (t + 0x108) << (seg - 1)
+	}
+	if b&0x80 == 0 {
+		return int16(-t)
+	}
+	return int16(t)
+}
+
+// g711Codec is PCMU or PCMA.
+type g711Codec struct {
+	alaw bool
+}
+
+func (c g711Codec) encode(dst []byte, pcm []int16) []byte {
+	for _, s := range pcm {
+		if c.alaw {
+			dst = append(dst, alawEncode(s))
+		} else {
+			dst = append(dst, ulawEncode(s))
+		}
+	}
+	return dst
+}
+
+func (c g711Codec) decode(dst []int16, payload []byte) []int16 {
+	table := &ulawTable
+	if c.alaw {
+		table = &alawTable
+	}
+	for _, b := range payload {
+		dst = append(dst, table[b])
+	}
+	return dst
+}
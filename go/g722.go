@@ -0,0 +1,258 @@
+package main
+
+// G.722 sub-band ADPCM (ITU-T G.722) at 64 kbit/s: 16 kHz PCM is split by a
+// QMF into a low band coded with 6 bits and a high band coded with 2 bits
+// per 8 kHz sample pair. The arithmetic follows the ITU reference code.
+
+var (
+	g722QMF = [12]int{3, -11, 12, 32, -210, 951, 3876, -805, 362, -156, 53, -11}
+	g722Q6  = [32]int{0, 35, 72, 110, 150, 190, 233, 276, 323, 370, 422, 473, 530, 587, 650, 714,
+		786, 858, 940, 1023, 1121, 1219, 1339, 1458, 1612, 1765, 1980, 2195, 2557, 2919, 0, 0}
+	g722ILN = [32]int{0, 63, 62, 31, 30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 20, 19,
+		18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 0}
+	g722ILP = [32]int{0, 61, 60, 59, 58, 57, 56, 55, 54, 53, 52, 51, 50, 49, 48, 47,
+		46, 45, 44, 43, 42, 41, 40, 39, 38, 37, 36, 35, 34, 33, 32, 0}
+	g722WL   = [8]int{-60, -30, 58, 172, 334, 538, 1198, 3042}
+	g722RL42 = [16]int{0, 7, 6, 5, 4, 3, 2, 1, 7, 6, 5, 4, 3, 2, 1, 0}
+	g722ILB  = [32]int{2048, 2093, 2139, 2186, 2233, 2282, 2332, 2383, 2435, 2489, 2543, 2599,
+		2656, 2714, 2774, 2834, 2896, 2960, 3025, 3091, 3158, 3228, 3298, 3371, 3444, 3520,
+		3597, 3676, 3756, 3838, 3922, 4008}
+	g722QM4 = [16]int{0, -20456, -12896, -8968, -6288, -4240, -2584, -1200,
+		20456, 12896, 8968, 6288, 4240, 2584, 1200, 0}
+	g722QM6 = [64]int{-136, -136, -136, -136, -24808, -21904, -19008, -16704,
+		-14984, -13512, -12280, -11192, -10232, -9360, -8576, -7856,
+		-7192, -6576, -6000, -5456, -4944, -4464, -4008, -3576,
+		-3168, -2776, -2400, -2032, -1688, -1360, -1040, -728,
+		24808, 21904, 19008, 16704, 14984, 13512, 12280, 11192,
+		10232, 9360, 8576, 7856, 7192, 6576, 6000, 5456,
+		4944, 4464, 4008, 3576, 3168, 2776, 2400, 2032,
+		1688, 1360, 1040, 728, 432, 136, -432, -136}
+	g722QM2 = [4]int{-7408, -1616, 7408, 1616}
+	g722IHN = [3]int{0, 1, 0}
+	g722IHP = [3]int{0, 3, 2}
+	g722WH  = [3]int{0, -214, 798}
+	g722RH2 = [4]int{2, 1, 2, 1}
+)
+
+// g722Band is the adaptive predictor state of one sub-band.
+type g722Band struct {
+	s, sp, sz, nb, det int
+	r, a, ap, p        [3]int
+	d, b, bp, sg       [7]int
+}
+
+// g722State is the state of one direction: the QMF delay line and both
+// sub-bands.
+type g722State struct {
+	x    [24]int
+	band [2]g722Band
+}
+
+func newG722State() *g722State {
+	s := &g722State{}
+	s.band[0].det = 32
+	s.band[1].det = 8
+	return s
+}
+
+func sat16(v int) int {
+	return min(max(v, -32768), 32767)
+}
+
+// update runs block 4 of the reference: reconstruction, pole and zero
+// predictor adaptation and prediction of the next sample.
+func (b *g722Band) update(d int) {
+	b.d[0] = d
+	b.r[0] = sat16(b.s + d)
+	b.p[0] = sat16(b.sz + d)
+
+	// UPPOL2
+	for i := range 3 {
+		b.sg[i] = b.p[i] >> 15
+	}
+	wd1 := sat16(b.a[1] << 2)
+	wd2 := wd1
+	if b.sg[0] == b.sg[1] {
+		wd2 = -wd1
+	}
+	wd2 = min(wd2, 32767)
+	wd3 := wd2 >> 7
+	if b.sg[0] == b.sg[2] {
+		wd3 += 128
+	} else {
+		wd3 -= 128
+	}
+	wd3 += (b.a[2] * 32512) >> 15
+	b.ap[2] = min(max(wd3, -12288), 12288)
+
+	// UPPOL1
+	b.sg[0] = b.p[0] >> 15
+	b.sg[1] = b.p[1] >> 15
+	wd1 = -192
+	if b.sg[0] == b.sg[1] {
+		wd1 = 192
+	}
+	wd2 = (b.a[1] * 32640) >> 15
+	b.ap[1] = sat16(wd1 + wd2)
+	wd3 = sat16(15360 - b.ap[2])
+	b.ap[1] = min(max(b.ap[1], -wd3), wd3)
+
+	// UPZERO
+	wd1 = 128
+	if d == 0 {
+		wd1 = 0
+	}
+	b.sg[0] = d >> 15
+	for i := 1; i < 7; i++ {
+		b.sg[i] = b.d[i] >> 15
+		wd2 = -wd1
+		if b.sg[i] == b.sg[0] {
+			wd2 = wd1
+		}
+		wd3 = (b.b[i] * 32640) >> 15
+		b.bp[i] = sat16(wd2 + wd3)
+	}
+
+	// DELAYA
+	for i := 6; i > 0; i-- {
+		b.d[i] = b.d[i-1]
+		b.b[i] = b.bp[i]
+	}
+	for i := 2; i > 0; i-- {
+		b.r[i] = b.r[i-1]
+		b.p[i] = b.p[i-1]
+		b.a[i] = b.ap[i]
+	}
+
+	// FILTEP
+	wd1 = (b.a[1] * sat16(b.r[1]+b.r[1])) >> 15
+	wd2 = (b.a[2] * sat16(b.r[2]+b.r[2])) >> 15
+	b.sp = sat16(wd1 + wd2)
+
+	// FILTEZ
+	b.sz = 0
+	for i := 6; i > 0; i-- {
+		b.sz += (b.b[i] * sat16(b.d[i]+b.d[i])) >> 15
+	}
+	b.sz = sat16(b.sz)
+
+	// PREDIC
+	b.s = sat16(b.sp + b.sz)
+}
+
+// scale adapts the quantizer scale factor (LOGSCL/SCALEL, LOGSCH/SCALEH).
+func (b *g722Band) scale(w, limit, shift int) {
+	b.nb = min(max((b.nb*127)>>7+w, 0), limit)
+	wd1 := (b.nb >> 6) & 31
+	wd2 := shift - (b.nb >> 11)
+	var wd3 int
+	if wd2 < 0 {
+		wd3 = g722ILB[wd1] << -wd2
+	} else {
+		wd3 = g722ILB[wd1] >> wd2
+	}
+	b.det = wd3 << 2
+}
+
+// encode appends one code byte per two 16 kHz samples of pcm. A trailing odd
+// sample is ignored.
+func (s *g722State) encode(dst []byte, pcm []int16) []byte {
+	for j := 0; j+1 < len(pcm); j += 2 {
+		copy(s.x[:22], s.x[2:])
+		s.x[22] = int(pcm[j])
+		s.x[23] = int(pcm[j+1])
+		sumEven, sumOdd := 0, 0
+		for i := range 12 {
+			sumOdd += s.x[2*i] * g722QMF[i]
+			sumEven += s.x[2*i+1] * g722QMF[11-i]
+		}
+		xlow := (sumEven + sumOdd) >> 14
+		xhigh := (sumEven - sumOdd) >> 14
+
+		low := &s.band[0]
+		el := sat16(xlow - low.s)
+		wd := el
+		if el < 0 {
+			wd = -(el + 1)
+		}
+		i := 1
+		for ; i < 30; i++ {
+			if wd < (g722Q6[i]*low.det)>>12 {
+				break
+			}
+		}
+		ilow := g722ILP[i]
+		if el < 0 {
+			ilow = g722ILN[i]
+		}
+		ril := ilow >> 2
+		dlow := (low.det * g722QM4[ril]) >> 15
+		low.scale(g722WL[g722RL42[ril]], 18432, 8)
+		low.update(dlow)
+
+		high := &s.band[1]
+		eh := sat16(xhigh - high.s)
+		wd = eh
+		if eh < 0 {
+			wd = -(eh + 1)
+		}
+		mih := 1
+		if wd >= (564*high.det)>>12 {
+			mih = 2
+		}
+		ihigh := g722IHP[mih]
+		if eh < 0 {
+			ihigh = g722IHN[mih]
+		}
+		dhigh := (high.det * g722QM2[ihigh]) >> 15
+		high.scale(g722WH[g722RH2[ihigh]], 22528, 10)
+		high.update(dhigh)
+
+		dst = append(dst, byte(ihigh<<6|ilow))
+	}
+	return dst
+}
+
+// decode appends two 16 kHz samples per code byte of payload.
+func (s *g722State) decode(dst []int16, payload []byte) []int16 {
+	for _, code := range payload {
+		low, high := &s.band[0], &s.band[1]
+		ilow := int(code & 0x3f)
+		ihigh := int(code>>6) & 0x03
+
+		rlow := low.s + (low.det*g722QM6[ilow])>>15
+		rlow = min(max(rlow, -16384), 16383)
+		ril := ilow >> 2
+		dlow := (low.det * g722QM4[ril]) >> 15
+		low.scale(g722WL[g722RL42[ril]], 18432, 8)
+		low.update(dlow)
+
+		dhigh := (high.det * g722QM2[ihigh]) >> 15
+		rhigh := min(max(dhigh+high.s, -16384), 16383)
+		high.scale(g722WH[g722RH2[ihigh]], 22528, 10)
+		high.update(dhigh)
+
+		copy(s.x[:22], s.x[2:])
+		s.x[22] = rlow + rhigh
+		s.x[23] = rlow - rhigh
+		out1, out2 := 0, 0
+		for i := range 12 {
+			out2 += s.x[2*i] * g722QMF[i]
+			out1 += s.x[2*i+1] * g722QMF[11-i]
+		}
+		dst = append(dst, int16(sat16(out1>>11)), int16(sat16(out2>>11)))
+	}
+	return dst
+}
+
+// g722Codec holds separate encoder and decoder states.
+type g722Codec struct {
+	enc, dec *g722State
+}
+
+func newG722Codec() *g722Codec {
+	return &g722Codec{enc: newG722State(), dec: newG722State()}
+}
+
+func (c *g722Codec) encode(dst []byte, pcm []int16) []byte      { return c.enc.encode(dst, pcm) }
+func (c *g722Codec) decode(dst []int16, payload []byte) []int16 { return c.dec.decode(dst, payload) }
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -13,38 +14,85 @@ import (
 	gosip "github.com/ghettovoice/gosip"
 	"github.com/ghettovoice/gosip/sip"
 	client "github.com/zelenin/go-tdlib/client"
+	"tg2sip/tgvoip"
 )
 
 // Gateway connects SIP server and Telegram client.
 type Gateway struct {
 	sipServer      gosip.Server
-	tgClient       *client.Client
 	sipClient      *SIPClient
+	accounts       map[string]*Account
+	accountList    []*Account
+	updates        chan accountUpdate
 	events         chan interface{}
 	internalEvents chan internalEvent
 	calls          map[string]*Context
-	contacts       *ContactCache
-	callback       string
+	queue          *floodQueue
+	cleanupPolicy  string
+	retention      time.Duration
+	phones         *PhoneRules
+	phonebook      *Phonebook
+	dialPlan       []*DialRule
+	forkMode       string
+	ringTimeouts   []time.Duration
+	keepalive      time.Duration
+	keepaliveTo    []string
+	rtpPorts       *RTPPortAllocator
+	codecs         []sdpCodec // SIP leg formats in preference order
+	codecOpts      codecOptions
+	jitterOpts     jitterOptions
+	srtpPolicy     string
+	symmetricRTP   bool
+	stun           *stunServer // maps RTP ports when no public address is set
 	mu             sync.Mutex
-	blockUntil     time.Time
-	extraWait      time.Duration
-	peerFlood      time.Duration
+}
+
+// accountUpdate is a TDLib update tagged with the account that received it.
+type accountUpdate struct {
+	account *Account
+	update  client.Type
 }
 
 // NewGateway creates a new Gateway instance.
-func NewGateway(sipSrv gosip.Server, tgCl *client.Client, callback string, extraWait, peerFlood time.Duration) *Gateway {
-	return &Gateway{
+func NewGateway(sipSrv gosip.Server, accounts []*Account, cfg *Settings) *Gateway {
+	var queue *floodQueue
+	if cfg.FloodQueue() {
+		queue = newFloodQueue(cfg.FloodQueueThreshold(), cfg.FloodQueueMaxWait(), cfg.FloodQueueDepth())
+	}
+	g := &Gateway{
 		sipServer:      sipSrv,
-		tgClient:       tgCl,
-		sipClient:      NewSIPClient(sipSrv),
+		sipClient:      NewSIPClient(sipSrv, sipAdvertised, NewSIPResolver(newDNSClient(cfg.DNSServer())), cfg.OutboundProxy(), cfg.FixContact()),
+		accounts:       make(map[string]*Account),
+		accountList:    accounts,
+		updates:        make(chan accountUpdate, 16),
 		events:         make(chan interface{}, 16),
 		internalEvents: make(chan internalEvent, 16),
 		calls:          make(map[string]*Context),
-		contacts:       NewContactCache(),
-		callback:       callback,
-		extraWait:      extraWait,
-		peerFlood:      peerFlood,
+		queue:          queue,
+		cleanupPolicy:  cfg.ImportedCleanup(),
+		retention:      cfg.ImportedRetention(),
+		phones:         cfg.PhoneRules(),
+		phonebook:      NewPhonebook(cfg.Phonebook()),
+		dialPlan:       cfg.DialPlan(),
+		forkMode:       cfg.ForkMode(),
+		ringTimeouts:   cfg.RingTimeouts(),
+		keepalive:      cfg.KeepaliveInterval(),
+		keepaliveTo:    cfg.KeepaliveTargets(),
+		rtpPorts:       NewRTPPortAllocator(sipBindHost, cfg.RTPPortStart(), cfg.RTPPortEnd()),
+		codecOpts:      cfg.CodecOptions(),
+		jitterOpts:     cfg.JitterOptions(),
+		srtpPolicy:     cfg.SRTP(),
+		symmetricRTP:   cfg.SymmetricRTP(),
+	}
+	g.codecs = localCodecs(cfg.Codecs(), g.codecOpts)
+	if cfg.PublicAddress() == "" && cfg.StunServer() != "" {
+		g.stun = newSTUNServer(cfg.StunServer())
 	}
+	for _, acc := range accounts {
+		g.accounts[acc.Name()] = acc
+	}
+	metrics.Set("telegram_ready", expvar.Func(func() any { return g.Ready() }))
+	return g
 }
 
 // CallStateEvent represents a change in call state.
@@ -62,9 +110,6 @@ type MediaEvent struct {
 // dtmfRegex matches valid DTMF digit sequences.
 var dtmfRegex = regexp.MustCompile(`^[0-9A-D*#]+$`)
 
-var retryAfterRe = regexp.MustCompile(`(?i)retry after (\d+)`)
-var peerFloodRe = regexp.MustCompile(`(?i)PEER_FLOOD`)
-
 func formatE164(phone string) string {
 	phone = strings.TrimSpace(phone)
 	if phone == "" {
@@ -77,28 +122,27 @@ func formatE164(phone string) string {
 }
 
 const (
-	statusTrying              = sip.StatusCode(100)
-	statusOK                  = sip.StatusCode(200)
-	statusNotFound            = sip.StatusCode(404)
-	statusInternalServerError = sip.StatusCode(500)
-	statusServiceUnavailable  = sip.StatusCode(503)
+	statusTrying                 = sip.StatusCode(100)
+	statusRinging                = sip.StatusCode(180)
+	statusSessionProgress        = sip.StatusCode(183)
+	statusOK                     = sip.StatusCode(200)
+	statusNotFound               = sip.StatusCode(404)
+	statusTemporarilyUnavailable = sip.StatusCode(480)
+	statusCallDoesNotExist       = sip.StatusCode(481)
+	statusLoopDetected           = sip.StatusCode(482)
+	statusRequestTerminated      = sip.StatusCode(487)
+	statusNotAcceptableHere      = sip.StatusCode(488)
+	statusInternalServerError    = sip.StatusCode(500)
+	statusServiceUnavailable     = sip.StatusCode(503)
 )
 
-func parseFloodError(err error) (time.Duration, bool, bool) {
-	var respErr client.ResponseError
-	if !errors.As(err, &respErr) {
-		return 0, false, false
-	}
-	if m := retryAfterRe.FindStringSubmatch(respErr.Err.Message); len(m) > 1 {
-		if s, e := strconv.Atoi(m[1]); e == nil {
-			return time.Duration(s) * time.Second, false, true
-		}
-	}
-	if peerFloodRe.MatchString(respErr.Err.Message) {
-		return 0, true, true
-	}
-	return 0, false, false
-}
+// noMediaRetryAfter is the Retry-After value, in seconds, sent with 503
+// responses while no RTP ports are free.
+const noMediaRetryAfter = 5
+
+// offlineRetryAfter is the Retry-After value, in seconds, sent with 503
+// responses while a Telegram account is offline.
+const offlineRetryAfter = 30
 
 // Start runs the gateway until ctx is canceled.
 func (g *Gateway) Start(ctx context.Context) error {
@@ -114,26 +158,45 @@ func (g *Gateway) Start(ctx context.Context) error {
 	if err := g.sipServer.OnRequest(sip.INFO, g.handleInfo); err != nil {
 		return err
 	}
+	if err := g.sipServer.OnRequest(sip.OPTIONS, g.handleOptions); err != nil {
+		return err
+	}
 
-	if err := g.contacts.Refresh(g.tgClient); err != nil {
-		coreLog.Warnf("initial contacts load failed: %v", err)
+	for _, acc := range g.accountList {
+		// Listen first so that no later UpdateUser is missed; Refresh fetches
+		// the contacts TDLib announced before.
+		defer acc.closeListener()
+		go g.forwardUpdates(ctx, acc, acc.listen())
+		// The persisted cache already serves lookups while this runs.
+		go func(acc *Account) {
+			if err := acc.contacts.Refresh(acc.Client()); err != nil {
+				coreLog.Warnf("initial contacts load for %s failed: %v", acc.Name(), err)
+			}
+		}(acc)
 	}
 	go g.refreshContactsLoop(ctx)
-
-	listener := g.tgClient.GetListener()
-	defer listener.Close()
+	go g.phonebook.Watch(ctx)
+	if g.keepalive > 0 && len(g.keepaliveTo) > 0 {
+		go g.sipClient.keepAlive(ctx, g.keepaliveTo, g.keepalive)
+	}
 
 	for {
 		select {
-		case update := <-listener.Updates:
-			switch u := update.(type) {
+		case au := <-g.updates:
+			acc := au.account
+			switch u := au.update.(type) {
 			case *client.UpdateCall:
-				coreLog.Infof("received telegram call update: %d", u.Call.Id)
-				g.handleTelegramCall(u)
+				coreLog.Infof("received telegram call update on %s: %d", acc.Name(), u.Call.Id)
+				g.handleTelegramCall(acc, u)
 			case *client.UpdateUser:
-				g.contacts.Update(u.User)
+				acc.contacts.Update(u.User)
 			case *client.UpdateNewMessage:
-				g.handleTelegramMessage(u)
+				g.handleTelegramMessage(acc, u)
+			case *client.UpdateConnectionState:
+				acc.setConnectionState(u.State)
+				coreLog.Infof("telegram account %s connection state: %s", acc.Name(), u.State.ConnectionStateType())
+			case *client.UpdateAuthorizationState:
+				g.handleAuthorizationState(ctx, acc, u)
 			}
 		case ev := <-g.events:
 			coreLog.Infof("received gateway event: %#v", ev)
@@ -141,25 +204,110 @@ func (g *Gateway) Start(ctx context.Context) error {
 			g.processInternalEvent(ie)
 		case <-ctx.Done():
 			g.mu.Lock()
+			calls := make([]*Context, 0, len(g.calls))
 			for _, c := range g.calls {
-				g.cleanUp(c)
+				calls = append(calls, c)
 			}
 			g.mu.Unlock()
+			for _, c := range calls {
+				g.cleanUp(c)
+			}
+			for _, acc := range g.accountList {
+				if err := acc.contacts.Flush(); err != nil {
+					coreLog.Warnf("save contacts of %s: %v", acc.Name(), err)
+				}
+			}
 			return nil
 		}
 	}
 }
 
-// refreshContactsLoop periodically reloads the contact cache.
+// forwardUpdates feeds TDLib updates of a single account into the gateway loop.
+func (g *Gateway) forwardUpdates(ctx context.Context, acc *Account, listener *client.Listener) {
+	for {
+		select {
+		case update, ok := <-listener.Updates:
+			if !ok {
+				return
+			}
+			select {
+			case g.updates <- accountUpdate{account: acc, update: update}:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleAuthorizationState tracks authorization changes and recreates the
+// TDLib client once a revoked or closed session reaches the Closed state.
+func (g *Gateway) handleAuthorizationState(ctx context.Context, acc *Account, u *client.UpdateAuthorizationState) {
+	acc.setAuthorizationState(u.AuthorizationState)
+	switch u.AuthorizationState.AuthorizationStateType() {
+	case client.TypeAuthorizationStateLoggingOut:
+		coreLog.Errorf("telegram account %s: session was revoked, calls are rejected until it is authorized again", acc.Name())
+	case client.TypeAuthorizationStateClosed:
+		if ctx.Err() != nil {
+			return
+		}
+		coreLog.Errorf("telegram account %s: client closed, recreating", acc.Name())
+		go g.recreateClient(ctx, acc)
+	default:
+		coreLog.Infof("telegram account %s authorization state: %s", acc.Name(), u.AuthorizationState.AuthorizationStateType())
+	}
+}
+
+// recreateClient starts a new TDLib client for acc and resumes processing
+// its updates. It does not prompt for input: a session that needs a new
+// login code or password fails until the gateway is restarted interactively.
+func (g *Gateway) recreateClient(ctx context.Context, acc *Account) {
+	cl, err := startAccount(acc.cfg, false)
+	if err != nil {
+		coreLog.Errorf("telegram account %s: recreate client failed: %v", acc.Name(), err)
+		return
+	}
+	acc.setClient(cl)
+	go g.forwardUpdates(ctx, acc, acc.listen())
+	if err := acc.contacts.Refresh(cl); err != nil {
+		coreLog.Warnf("contacts load for %s failed: %v", acc.Name(), err)
+	}
+}
+
+// Ready reports whether at least one Telegram account can place calls.
+func (g *Gateway) Ready() bool {
+	for _, acc := range g.accountList {
+		if acc.Ready() {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshContactsLoop periodically reloads the contact caches of all
+// accounts, writes changed caches to disk and expires negative lookups.
 func (g *Gateway) refreshContactsLoop(ctx context.Context) {
 	ticker := time.NewTicker(time.Hour)
 	defer ticker.Stop()
+	flush := time.NewTicker(contactFlushInterval)
+	defer flush.Stop()
 	for {
 		select {
+		case <-flush.C:
+			for _, acc := range g.accountList {
+				acc.contacts.PruneNegative()
+				if err := acc.contacts.Flush(); err != nil {
+					coreLog.Warnf("save contacts of %s: %v", acc.Name(), err)
+				}
+			}
 		case <-ticker.C:
-			if err := g.contacts.Refresh(g.tgClient); err != nil {
-				coreLog.Warnf("contact refresh failed: %v", err)
+			for _, acc := range g.accountList {
+				if err := acc.contacts.Refresh(acc.Client()); err != nil {
+					coreLog.Warnf("contact refresh for %s failed: %v", acc.Name(), err)
+				}
 			}
+			g.cleanupImported(g.cleanupPolicy, g.retention)
 		case <-ctx.Done():
 			return
 		}
@@ -167,7 +315,7 @@ func (g *Gateway) refreshContactsLoop(ctx context.Context) {
 }
 
 // parseUserFromHeaders checks custom SIP headers for Telegram user info.
-func (g *Gateway) parseUserFromHeaders(req sip.Request) (int64, bool, error) {
+func (g *Gateway) parseUserFromHeaders(acc *Account, req sip.Request) (int64, bool, error) {
 	if hdrs := req.GetHeaders("X-TG-ID"); len(hdrs) > 0 {
 		if id, err := strconv.ParseInt(hdrs[0].Value(), 10, 64); err == nil {
 			return id, true, nil
@@ -176,79 +324,263 @@ func (g *Gateway) parseUserFromHeaders(req sip.Request) (int64, bool, error) {
 		}
 	}
 	if hdrs := req.GetHeaders("X-TG-Username"); len(hdrs) > 0 {
-		return g.resolveUser("tg#" + hdrs[0].Value())
+		return g.resolveUser(acc, "tg#"+hdrs[0].Value(), false)
 	}
 	if hdrs := req.GetHeaders("X-TG-Phone"); len(hdrs) > 0 {
-		phone := hdrs[0].Value()
-		if !strings.HasPrefix(phone, "+") {
-			phone = "+" + phone
+		phone, ok := g.phones.Normalize(hdrs[0].Value())
+		if !ok {
+			coreLog.Warnf("invalid X-TG-Phone %q", hdrs[0].Value())
+			return 0, false, nil
 		}
-		return g.resolveUser(phone)
+		return g.resolveUser(acc, phone, true)
 	}
 	return 0, false, nil
 }
 
 // resolveUser resolves extension patterns like tg#username, +phone or numeric ID.
-func (g *Gateway) resolveUser(ext string) (int64, bool, error) {
+// Phonebook aliases are replaced by their target first. phone marks an
+// extension dialed as a telephone number, which is never taken for an ID.
+func (g *Gateway) resolveUser(acc *Account, ext string, phone bool) (int64, bool, error) {
 	if ext == "" {
 		return 0, false, nil
 	}
+	if target, ok := g.phonebook.Lookup(acc.Name(), ext); ok {
+		coreLog.Debugf("phonebook: %s -> %s", ext, target)
+		ext, phone = target, false
+	}
 	switch {
 	case strings.HasPrefix(ext, "tg#"):
 		name := ext[3:]
-		if id, ok := g.contacts.Resolve(strings.ToLower(name)); ok {
-			return id, true, nil
+		id, ok, err := acc.contacts.ResolveUsername(acc.Client(), name)
+		if err != nil || ok {
+			return id, ok, err
+		}
+		// Contacts without a public username can still match by name.
+		return acc.contacts.SearchAndAdd(acc.Client(), name)
+	case phone || g.phones.IsPhone(ext):
+		phone, valid := g.phones.Normalize(ext)
+		if !valid {
+			coreLog.Warnf("invalid phone number %s", ext)
+			return 0, false, nil
 		}
-		return g.contacts.SearchAndAdd(g.tgClient, name)
-	case strings.HasPrefix(ext, "+"):
-		phone := ext[1:]
-		if id, ok := g.contacts.Resolve(phone); ok {
+		phone = phone[1:]
+		if id, ok := acc.contacts.Resolve(phone); ok {
 			return id, true, nil
 		}
-		return g.contacts.SearchAndAdd(g.tgClient, phone)
+		return acc.contacts.SearchAndAdd(acc.Client(), phone)
 	default:
 		if id, err := strconv.ParseInt(ext, 10, 64); err == nil {
 			return id, true, nil
 		}
-		if id, ok := g.contacts.Resolve(ext); ok {
+		if id, ok := acc.contacts.Resolve(ext); ok {
 			return id, true, nil
 		}
-		return g.contacts.SearchAndAdd(g.tgClient, ext)
+		return acc.contacts.SearchAndAdd(acc.Client(), ext)
 	}
 }
 
 // handleTelegramCall processes incoming Telegram call updates and dials SIP.
-func (g *Gateway) handleTelegramCall(u *client.UpdateCall) {
+func (g *Gateway) handleTelegramCall(acc *Account, u *client.UpdateCall) {
+	switch state := u.Call.State.(type) {
+	case *client.CallStateReady:
+		g.startTelegramMedia(acc, u.Call, state)
+		return
+	case *client.CallStateDiscarded, *client.CallStateError:
+		g.endTelegramCall(acc, u.Call)
+		return
+	}
 	if u.Call.IsOutgoing {
 		return
 	}
 	if _, ok := u.Call.State.(*client.CallStatePending); !ok {
 		return
 	}
-	if err := acceptTelegramCall(g.tgClient, int64(u.Call.Id)); err != nil {
+	callID := telegramCallKey(acc, int64(u.Call.Id))
+	media, fresh, err := g.rtpPorts.Allocate(callID)
+	if err != nil {
+		coreLog.Warnf("rejecting telegram call %d: %v", u.Call.Id, err)
+		if err := discardTelegramCall(acc.Client(), int64(u.Call.Id)); err != nil {
+			coreLog.Warnf("discard telegram call failed: %v", err)
+		}
+		return
+	}
+	if !fresh {
+		// A repeated pending update of a call being set up.
+		return
+	}
+	if err := acceptTelegramCall(acc.Client(), int64(u.Call.Id)); err != nil {
 		coreLog.Warnf("acceptCall failed: %v", err)
+		g.rtpPorts.Release(callID)
 		return
 	}
-	user, err := g.tgClient.GetUser(&client.GetUserRequest{UserId: u.Call.UserId})
+	user, err := acc.Client().GetUser(&client.GetUserRequest{UserId: u.Call.UserId})
 	if err != nil {
 		coreLog.Warnf("getUser failed: %v", err)
+		g.rtpPorts.Release(callID)
+		return
+	}
+	headers := buildUserHeaders(acc, g.phones, int64(u.Call.Id), user)
+	route := g.route(acc, user)
+	for k, v := range route.headers {
+		headers[k] = v
+	}
+	policy := route.srtp
+	if policy == "" {
+		policy = g.srtpPolicy
+	}
+	dialCtx, cancel := context.WithCancel(context.Background())
+	ctx := &Context{ID: callID, Account: acc, TGCallID: int64(u.Call.Id), UserID: user.Id, State: StateOutgoing, CancelDial: cancel, Media: media, SRTPPolicy: policy}
+	offer, err := g.sdpOffer(ctx, routePeer(route))
+	if err != nil {
+		coreLog.Warnf("SDP offer for telegram call %d: %v", u.Call.Id, err)
+		cancel()
+		g.rtpPorts.Release(callID)
 		return
 	}
-	headers := buildUserHeaders(int64(u.Call.Id), user)
-	callID := fmt.Sprintf("%d", u.Call.Id)
-	ctx := &Context{ID: callID, TGCallID: int64(u.Call.Id), UserID: user.Id, State: StateOutgoing}
 	g.mu.Lock()
 	g.calls[callID] = ctx
 	g.mu.Unlock()
 	g.events <- CallStateEvent{CallID: callID, State: "outgoing"}
 	g.internalEvents <- internalEvent{ctxID: callID, typ: evOutgoing}
-	if err := g.sipClient.Dial(context.Background(), "tg", g.callback, headers); err != nil {
+	go g.forkTelegramCall(dialCtx, ctx, route, headers, offer.String())
+}
+
+// startTelegramMedia configures the voice connection of a tracked call once
+// Telegram reports its servers and encryption key.
+func (g *Gateway) startTelegramMedia(acc *Account, call *client.Call, ready *client.CallStateReady) {
+	g.mu.Lock()
+	ctx := g.telegramCallLocked(acc, int64(call.Id))
+	g.mu.Unlock()
+	if ctx == nil || ctx.Controller != nil {
+		return
+	}
+	ctrl, err := configureTelegramMedia(acc.cfg, ready, call.IsOutgoing)
+	if err != nil {
+		coreLog.Warnf("telegram call %d media: %v", call.Id, err)
+		return
+	}
+	coreLog.Infof("telegram call %d ready with %d reflectors", call.Id, len(callEndpoints(ready.Servers)))
+	ctrl.SetStateCallback(func(s tgvoip.State) { g.telegramMediaState(ctx.ID, s) })
+	// Telegram hears nothing until the SIP audio is bridged.
+	ctrl.SetMicMute(true)
+	ctrl.Start()
+	ctrl.Connect()
+	g.mu.Lock()
+	closed := ctx.closed
+	if !closed {
+		ctx.Controller = tgvoipMedia{ctrl}
+	}
+	g.mu.Unlock()
+	if closed {
+		// The call ended while the controller was set up.
+		tgvoipMedia{ctrl}.Stop()
+		return
+	}
+	if ctx.FromSIP && !g.answerSIP(ctx) {
+		return
+	}
+	g.startBridge(ctx)
+}
+
+// answerSIP sends the 200 OK of a SIP->Telegram call, whose callee has
+// picked up. A call that cannot be answered is cleaned up.
+func (g *Gateway) answerSIP(ctx *Context) bool {
+	g.mu.Lock()
+	closed := ctx.closed
+	if !closed {
+		ctx.Answered = true
+	}
+	g.mu.Unlock()
+	if closed {
+		return false
+	}
+	if err := g.sipClient.Answer(context.Background(), ctx.SIPCallID); err != nil {
+		coreLog.Warnf("answer SIP call %s: %v", ctx.SIPCallID, err)
+		g.internalEvents <- internalEvent{ctxID: ctx.ID, typ: evCleanup}
+		return false
+	}
+	return true
+}
+
+// endTelegramCall cleans up the tracked call of a Telegram call that ended,
+// hanging up or rejecting its SIP leg.
+func (g *Gateway) endTelegramCall(acc *Account, call *client.Call) {
+	g.mu.Lock()
+	ctx := g.telegramCallLocked(acc, int64(call.Id))
+	if ctx != nil {
+		// Telegram has ended the call already, it is not discarded again.
+		ctx.TGCallID = 0
+	}
+	g.mu.Unlock()
+	if ctx == nil {
+		return
+	}
+	coreLog.Infof("telegram call %d ended (%s)", call.Id, call.State.CallStateType())
+	g.events <- CallStateEvent{CallID: ctx.ID, State: "ended"}
+	g.internalEvents <- internalEvent{ctxID: ctx.ID, typ: evCleanup}
+}
+
+// telegramCallLocked returns the context of Telegram call callID of acc in
+// either direction, nil if it is not tracked; caller must hold g.mu.
+func (g *Gateway) telegramCallLocked(acc *Account, callID int64) *Context {
+	for _, c := range g.calls {
+		if c.Account == acc && c.TGCallID == callID {
+			return c
+		}
+	}
+	return nil
+}
+
+// telegramMediaState turns connection states of the tgvoip controller of
+// call callID into internal events. It runs on a libtgvoip thread, which
+// must not wait for the gateway loop.
+func (g *Gateway) telegramMediaState(callID string, s tgvoip.State) {
+	coreLog.Debugf("call %s tgvoip state %v", callID, s)
+	var typ internalEventType
+	switch s {
+	case tgvoip.StateEstablished:
+		typ = evMediaEstablished
+	case tgvoip.StateFailed:
+		typ = evMediaFailed
+	case tgvoip.StateReconnecting:
+		coreLog.Infof("call %s tgvoip reconnecting", callID)
+		return
+	default:
+		return
+	}
+	go func() { g.internalEvents <- internalEvent{ctxID: callID, typ: typ} }()
+}
+
+// forkTelegramCall rings the SIP targets of a Telegram call and records the
+// answered SIP call. The Telegram call is dropped if nobody answers or the
+// answer SDP is not acceptable.
+func (g *Gateway) forkTelegramCall(dialCtx context.Context, ctx *Context, route *dialRoute, headers map[string]string, sdp string) {
+	sipCallID, err := g.sipClient.Fork(dialCtx, route, headers, sdp)
+	if err != nil {
 		coreLog.Warnf("SIP dial failed: %v", err)
+		g.internalEvents <- internalEvent{ctxID: ctx.ID, typ: evCleanup}
+		return
+	}
+	g.mu.Lock()
+	canceled := dialCtx.Err() != nil || ctx.closed
+	if !canceled {
+		ctx.SIPCallID = sipCallID
+	}
+	g.mu.Unlock()
+	if canceled {
+		// The Telegram side hung up while the SIP target answered.
+		_ = g.sipClient.Hangup(context.Background(), sipCallID)
+		return
+	}
+	if err := g.applyAnswer(ctx, g.sipClient.RemoteSDP(sipCallID)); err != nil {
+		coreLog.Warnf("SIP call %s answer rejected: %v", sipCallID, err)
+		_ = g.sipClient.Hangup(context.Background(), sipCallID)
+		g.internalEvents <- internalEvent{ctxID: ctx.ID, typ: evCleanup}
 	}
 }
 
 // handleTelegramMessage processes incoming Telegram text messages for DTMF digits.
-func (g *Gateway) handleTelegramMessage(u *client.UpdateNewMessage) {
+func (g *Gateway) handleTelegramMessage(acc *Account, u *client.UpdateNewMessage) {
 	msg := u.Message
 	content, ok := msg.Content.(*client.MessageText)
 	if !ok || content.Text == nil {
@@ -268,7 +600,7 @@ func (g *Gateway) handleTelegramMessage(u *client.UpdateNewMessage) {
 	var ctx *Context
 	g.mu.Lock()
 	for _, c := range g.calls {
-		if c.UserID == sender.UserId && c.State == StateWaitDTMF {
+		if c.Account == acc && c.UserID == sender.UserId && c.State == StateWaitDTMF {
 			ctx = c
 			break
 		}
@@ -296,6 +628,17 @@ func (g *Gateway) processInternalEvent(ev internalEvent) {
 		ctx.State = StateWaitMedia
 	case evWaitDTMF:
 		ctx.State = StateWaitDTMF
+	case evMediaEstablished:
+		ctx.State = StateMediaActive
+		if m, ok := ctx.Controller.(tgvoipMedia); ok {
+			coreLog.Infof("call %s tgvoip established via relay %d", ctx.ID, m.PreferredRelayID())
+		}
+	case evMediaFailed:
+		if m, ok := ctx.Controller.(tgvoipMedia); ok {
+			coreLog.Warnf("call %s tgvoip failed: %v", ctx.ID, m.LastError())
+			coreLog.Debugf("call %s tgvoip debug:\n%s", ctx.ID, m.DebugString())
+		}
+		fallthrough
 	case evCleanup:
 		ctx.State = StateCleanup
 		g.cleanUp(ctx)
@@ -305,25 +648,69 @@ func (g *Gateway) processInternalEvent(ev internalEvent) {
 	}
 }
 
-// cleanUp stops controllers and hangs up on both sides.
+// cleanUp stops controllers and hangs up on both sides. It runs once per
+// call.
 func (g *Gateway) cleanUp(ctx *Context) {
-	if ctx.Controller != nil {
-		ctx.Controller.Stop()
+	// Media started from now on is refused, see startBridge.
+	g.mu.Lock()
+	if ctx.closed {
+		g.mu.Unlock()
+		return
+	}
+	ctx.closed = true
+	ctrl, ringback, bridge, sipCallID, answered := ctx.Controller, ctx.Ringback, ctx.Bridge, ctx.SIPCallID, ctx.Answered
+	tgCallID := ctx.TGCallID
+	g.mu.Unlock()
+
+	if ctx.CancelDial != nil {
+		ctx.CancelDial()
+	}
+	if m, ok := ctrl.(tgvoipMedia); ok {
+		m.logStats(ctx.ID)
+	}
+	if ctrl != nil {
+		ctrl.Stop()
 	}
-	if ctx.SIPCallID != "" {
-		_ = g.sipClient.Hangup(context.Background(), ctx.SIPCallID)
+	if ringback != nil {
+		ringback.Stop()
 	}
-	if ctx.TGCallID != 0 {
-		if err := discardTelegramCall(g.tgClient, ctx.TGCallID); err != nil {
+	if bridge != nil {
+		bridge.Close()
+	}
+	if ctx.Media != nil {
+		g.rtpPorts.Release(ctx.ID)
+	}
+	switch {
+	case sipCallID == "":
+	case ctx.FromSIP && !answered:
+		// The caller has no dialog to hang up yet.
+		_ = g.sipClient.Reject(sipCallID, statusTemporarilyUnavailable, "Temporarily Unavailable")
+	default:
+		_ = g.sipClient.Hangup(context.Background(), sipCallID)
+	}
+	if tgCallID != 0 {
+		if err := discardTelegramCall(ctx.Account.Client(), tgCallID); err != nil {
 			coreLog.Warnf("discard telegram call failed: %v", err)
 		}
 	}
+	if ctx.FromSIP && g.cleanupPolicy == importedCleanupCall && ctx.Account.imported.Has(ctx.UserID) {
+		if err := ctx.Account.removeImported([]int64{ctx.UserID}); err != nil {
+			coreLog.Warnf("remove imported contact %d: %v", ctx.UserID, err)
+		}
+	}
+}
+
+// telegramCallKey builds the call map key of a Telegram call. Call IDs are
+// only unique within a single TDLib client, so the account name is included.
+func telegramCallKey(acc *Account, callID int64) string {
+	return fmt.Sprintf("%s:%d", acc.Name(), callID)
 }
 
 // buildUserHeaders builds SIP headers with Telegram user info.
-func buildUserHeaders(callID int64, u *client.User) map[string]string {
+func buildUserHeaders(acc *Account, phones *PhoneRules, callID int64, u *client.User) map[string]string {
 	headers := map[string]string{
 		"X-GW-Context": fmt.Sprintf("%d", callID),
+		"X-TG-Account": acc.Name(),
 		"X-TG-ID":      fmt.Sprintf("%d", u.Id),
 	}
 	if u.FirstName != "" {
@@ -335,7 +722,13 @@ func buildUserHeaders(callID int64, u *client.User) map[string]string {
 	if uname := getUsername(u); uname != "" {
 		headers["X-TG-Username"] = uname
 	}
-	if phone := formatE164(u.PhoneNumber); phone != "" {
+	// TDLib reports international numbers without "+", which must not go
+	// through the national dialing rules.
+	phone := formatE164(u.PhoneNumber)
+	if norm, ok := phones.Normalize(phone); ok {
+		phone = norm
+	}
+	if phone != "" {
 		headers["X-TG-Phone"] = phone
 	}
 	return headers
@@ -351,41 +744,77 @@ func (g *Gateway) handleInvite(req sip.Request, tx sip.ServerTransaction) {
 	fromHdr, _ := req.From()
 	toHdr, _ := req.To()
 	coreLog.Infof("received SIP INVITE: %s -> %s", fromHdr, toHdr)
+	if toHdr != nil && addrTag(&sip.Address{Params: toHdr.Params}) != "" {
+		g.handleReinvite(req, tx, callID)
+		return
+	}
 
-	now := time.Now()
-	if !g.blockUntil.IsZero() {
-		if now.After(g.blockUntil) {
-			g.blockUntil = time.Time{}
-		} else {
-			wait := int(g.blockUntil.Sub(now).Seconds())
-			coreLog.Warnf("dropping call due to temp TG block for %d seconds", wait)
-			if tx != nil {
-				g.sipServer.RespondOnRequest(req, statusServiceUnavailable,
-					fmt.Sprintf("FLOOD_WAIT %d", wait), "", nil)
-			}
-			return
+	target, phone := dialTarget(req)
+	acc, ext, ok := g.selectAccount(req, target)
+	if !ok {
+		coreLog.Warnf("no telegram account for %s", ext)
+		if tx != nil {
+			g.sipServer.RespondOnRequest(req, statusNotFound, "Not Found", "", nil)
 		}
+		return
 	}
 
-	ext := ""
-	if toHdr != nil && toHdr.Address != nil {
-		if u := toHdr.Address.User(); u != nil {
-			ext = u.String()
+	if !acc.Ready() {
+		conn, auth := acc.ConnectionState()
+		coreLog.Warnf("rejecting call, telegram account %s is not ready (%s, %s)", acc.Name(), conn, auth)
+		if tx != nil {
+			retry := &sip.GenericHeader{HeaderName: "Retry-After", Contents: strconv.Itoa(offlineRetryAfter)}
+			g.sipServer.RespondOnRequest(req, statusServiceUnavailable, "Telegram Offline", "", []sip.Header{retry})
 		}
+		return
 	}
 
-	userID, ok, err := g.parseUserFromHeaders(req)
+	media, fresh, err := g.rtpPorts.Allocate(callID)
 	if err != nil {
-		if wait, peer, matched := parseFloodError(err); matched {
-			if peer {
-				wait = g.peerFlood
-			}
-			wait += g.extraWait
-			g.blockUntil = time.Now().Add(wait)
-			if tx != nil {
-				g.sipServer.RespondOnRequest(req, statusServiceUnavailable,
-					fmt.Sprintf("FLOOD_WAIT %d", int(wait.Seconds())), "", nil)
+		if tx != nil {
+			retry := &sip.GenericHeader{HeaderName: "Retry-After", Contents: strconv.Itoa(noMediaRetryAfter)}
+			g.sipServer.RespondOnRequest(req, statusServiceUnavailable, "No Media Ports", "", []sip.Header{retry})
+		}
+		return
+	}
+	if !fresh {
+		// Another INVITE of this Call-ID is being set up and owns the
+		// ports (RFC 3261 8.2.2.2).
+		if tx != nil {
+			g.sipServer.RespondOnRequest(req, statusLoopDetected, "Loop Detected", "", nil)
+		}
+		return
+	}
+	ctx := &Context{ID: callID, Account: acc, SIPCallID: callID, FromSIP: true, State: StateIncoming, Media: media, SRTPPolicy: g.srtpPolicy}
+	// The ports belong to the call context once it is tracked.
+	tracked := false
+	defer func() {
+		if !tracked {
+			if ctx.Ringback != nil {
+				ctx.Ringback.Stop()
 			}
+			g.rtpPorts.Release(callID)
+		}
+	}()
+
+	localSDP, err := g.negotiateInvite(ctx, req)
+	if err != nil {
+		coreLog.Warnf("rejecting call %s: %v", callID, err)
+		if tx != nil {
+			g.sipServer.RespondOnRequest(req, statusNotAcceptableHere, "Not Acceptable Here", "", nil)
+		}
+		return
+	}
+
+	// Resolving the callee is pointless while calls are blocked anyway.
+	if wait := acc.flood.Remaining(floodCreateCall); wait > 0 && !g.queue.accepts(wait) {
+		g.rejectFlood(req, tx, acc, &FloodWaitError{Method: floodCreateCall, Wait: wait})
+		return
+	}
+
+	userID, ok, err := g.parseUserFromHeaders(acc, req)
+	if err != nil {
+		if g.rejectFlood(req, tx, acc, err) {
 			return
 		}
 		coreLog.Warnf("parse headers failed: %v", err)
@@ -395,18 +824,9 @@ func (g *Gateway) handleInvite(req sip.Request, tx sip.ServerTransaction) {
 		return
 	}
 	if !ok {
-		userID, ok, err = g.resolveUser(ext)
+		userID, ok, err = g.resolveUser(acc, ext, phone)
 		if err != nil {
-			if wait, peer, matched := parseFloodError(err); matched {
-				if peer {
-					wait = g.peerFlood
-				}
-				wait += g.extraWait
-				g.blockUntil = time.Now().Add(wait)
-				if tx != nil {
-					g.sipServer.RespondOnRequest(req, statusServiceUnavailable,
-						fmt.Sprintf("FLOOD_WAIT %d", int(wait.Seconds())), "", nil)
-				}
+			if g.rejectFlood(req, tx, acc, err) {
 				return
 			}
 			coreLog.Warnf("resolve user failed: %v", err)
@@ -424,40 +844,144 @@ func (g *Gateway) handleInvite(req sip.Request, tx sip.ServerTransaction) {
 		return
 	}
 
-	if err := createTelegramCall(g.tgClient, userID); err != nil {
-		if wait, peer, matched := parseFloodError(err); matched {
-			if peer {
-				wait = g.peerFlood
-			}
-			wait += g.extraWait
-			g.blockUntil = time.Now().Add(wait)
-			if tx != nil {
-				g.sipServer.RespondOnRequest(req, statusServiceUnavailable,
-					fmt.Sprintf("FLOOD_WAIT %d", int(wait.Seconds())), "", nil)
-			}
+	tgCallID, err := g.placeTelegramCall(acc, userID)
+	var fw *FloodWaitError
+	if errors.As(err, &fw) && g.queue.enter(fw.Wait) {
+		tgCallID, err = g.waitFloodQueue(req, tx, ctx, localSDP.String(), userID, fw)
+		g.queue.leave()
+		if errors.Is(err, errCallCanceled) {
+			return
+		}
+	}
+	if err != nil {
+		if g.rejectFlood(req, tx, acc, err) {
 			return
 		}
 		coreLog.Warnf("createCall failed: %v", err)
-	} else {
-		g.blockUntil = time.Time{}
+		if tx != nil {
+			g.sipServer.RespondOnRequest(req, statusInternalServerError, "Internal error", "", nil)
+		}
+		return
 	}
 
-	ctx := &Context{ID: callID, SIPCallID: callID, UserID: userID, State: StateIncoming}
+	ctx.UserID = userID
+	ctx.TGCallID = tgCallID
+
+	// The INVITE is answered with 200 OK when the Telegram call is ready,
+	// see answerSIP.
+	g.sipClient.TrackInvite(req, tx)
+	g.sipClient.SetLocalSDP(callID, localSDP.String())
+	if ctx.EarlyTag != "" {
+		g.sipClient.SetLocalTag(callID, ctx.EarlyTag)
+	}
 
 	g.mu.Lock()
 	g.calls[callID] = ctx
 	g.mu.Unlock()
+	tracked = true
 
 	g.events <- CallStateEvent{CallID: callID, State: "incoming"}
 	g.internalEvents <- internalEvent{ctxID: callID, typ: evIncoming}
 
-	g.sipClient.TrackInvite(req, tx)
-
 	if tx != nil {
 		g.sipServer.RespondOnRequest(req, statusTrying, "Trying", "", nil)
+		go g.watchCancel(tx, callID)
 	}
 }
 
+// watchCancel ends a SIP->Telegram call whose caller cancels the INVITE
+// before it is answered. It returns when the INVITE transaction ends.
+func (g *Gateway) watchCancel(tx sip.ServerTransaction, callID string) {
+	cancel, ok := <-tx.Cancels()
+	if !ok {
+		return
+	}
+	_ = g.sipServer.Send(sip.NewResponseFromRequest("", cancel, statusOK, "OK", ""))
+	g.mu.Lock()
+	ctx := g.calls[callID]
+	answered := ctx != nil && ctx.Answered
+	g.mu.Unlock()
+	if ctx == nil || answered {
+		// The 200 OK crossed the CANCEL, the caller sends BYE instead.
+		return
+	}
+	coreLog.Infof("SIP call %s canceled by caller", callID)
+	_ = g.sipClient.Reject(callID, statusRequestTerminated, "Request Terminated")
+	g.events <- CallStateEvent{CallID: callID, State: "ended"}
+	g.internalEvents <- internalEvent{ctxID: callID, typ: evCleanup}
+}
+
+// handleReinvite answers an INVITE within the dialog of an established call.
+// The session is kept: the answer repeats the local SDP, and only a new
+// remote address in the offer is taken over. INVITEs outside any dialog
+// get 481.
+func (g *Gateway) handleReinvite(req sip.Request, tx sip.ServerTransaction, callID string) {
+	var peer *rtpLatch
+	g.mu.Lock()
+	for _, c := range g.calls {
+		if c.SIPCallID == callID {
+			peer = c.RTPPeer
+			break
+		}
+	}
+	g.mu.Unlock()
+	if peer != nil && req.Body() != "" {
+		// A hold offer with a null address keeps the current one.
+		if remote, err := offerAddress(req.Body()); err != nil {
+			coreLog.Warnf("re-INVITE of call %s: %v", callID, err)
+		} else if !remote.IP.IsUnspecified() && remote.Port != 0 && !udpAddrEqual(remote, peer.Remote()) {
+			coreLog.Infof("call %s media moved to %s", callID, remote)
+			peer.Signal(remote)
+		}
+	}
+	if err := g.sipClient.AnswerReinvite(req); err != nil {
+		coreLog.Warnf("re-INVITE of call %s: %v", callID, err)
+		if tx != nil && errors.Is(err, errNoDialog) {
+			g.sipServer.RespondOnRequest(req, statusCallDoesNotExist, "Call/Transaction Does Not Exist", "", nil)
+		}
+	}
+}
+
+// negotiateInvite returns the SDP sent with the 200 OK to req. An offer in
+// req is answered; without one the gateway offers and expects the answer in
+// the ACK.
+func (g *Gateway) negotiateInvite(ctx *Context, req sip.Request) (*sessionDescription, error) {
+	peer := req.Source()
+	if req.Body() == "" {
+		return g.sdpOffer(ctx, peer)
+	}
+	offer, err := parseSDP(req.Body())
+	if err != nil {
+		return nil, err
+	}
+	return g.sdpAnswer(ctx, offer, peer)
+}
+
+// placeTelegramCall creates a Telegram call to userID unless flood control
+// blocks it and returns the ID of the call.
+func (g *Gateway) placeTelegramCall(acc *Account, userID int64) (int64, error) {
+	if err := acc.flood.Allow(floodCreateCall); err != nil {
+		return 0, err
+	}
+	id, err := createTelegramCall(acc.Client(), userID)
+	return id, acc.flood.Record(floodCreateCall, err)
+}
+
+// rejectFlood answers 503 FLOOD_WAIT if err is a *FloodWaitError and
+// reports whether it did so.
+func (g *Gateway) rejectFlood(req sip.Request, tx sip.ServerTransaction, acc *Account, err error) bool {
+	var fw *FloodWaitError
+	if !errors.As(err, &fw) {
+		return false
+	}
+	coreLog.Warnf("dropping call due to temp TG block of %s on %s for %d seconds", acc.Name(), fw.Method, fw.Seconds())
+	if tx != nil {
+		g.sipServer.RespondOnRequest(req, statusServiceUnavailable,
+			fmt.Sprintf("FLOOD_WAIT %d", fw.Seconds()), "", nil)
+	}
+	return true
+}
+
 // handleAck emits an answered state for an existing call.
 func (g *Gateway) handleAck(req sip.Request, tx sip.ServerTransaction) {
 	cid, _ := req.CallID()
@@ -466,6 +990,22 @@ func (g *Gateway) handleAck(req sip.Request, tx sip.ServerTransaction) {
 		callID = cid.String()
 	}
 	coreLog.Infof("received SIP ACK: %s", callID)
+	if !g.sipClient.IsInitialAck(req) {
+		return
+	}
+	g.mu.Lock()
+	ctx := g.calls[callID]
+	pending := ctx != nil && ctx.RTPPeer == nil
+	g.mu.Unlock()
+	if pending {
+		// The INVITE had no offer, the ACK carries the answer to ours.
+		if err := g.applyAnswer(ctx, req.Body()); err != nil {
+			coreLog.Warnf("SIP call %s answer rejected: %v", callID, err)
+			_ = g.sipClient.Hangup(context.Background(), callID)
+			g.internalEvents <- internalEvent{ctxID: callID, typ: evCleanup}
+			return
+		}
+	}
 	g.events <- CallStateEvent{CallID: callID, State: "answered"}
 	g.internalEvents <- internalEvent{ctxID: callID, typ: evWaitMedia}
 }
@@ -501,10 +1041,16 @@ func (g *Gateway) handleInfo(req sip.Request, tx sip.ServerTransaction) {
 	}
 }
 
+// handleOptions answers keepalives and capability queries.
+func (g *Gateway) handleOptions(req sip.Request, tx sip.ServerTransaction) {
+	if tx != nil {
+		g.sipServer.RespondOnRequest(req, statusOK, "OK", "", nil)
+	}
+}
+
 // startGateway initializes and starts the gateway component.
-func startGateway(ctx context.Context, cfg *Settings) error {
+func startGateway(ctx context.Context, cfg *Settings, accounts []*Account) error {
 	coreLog.Info("starting gateway")
-	callback := cfg.CallbackURI()
-	gw := NewGateway(sipServer, tgClient, callback, cfg.ExtraWaitTime(), cfg.PeerFloodTime())
+	gw := NewGateway(sipServer, accounts, cfg)
 	return gw.Start(ctx)
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	client "github.com/zelenin/go-tdlib/client"
+)
+
+// Cleanup policies for contacts imported to dial phone numbers.
+const (
+	importedCleanupNever     = "never"
+	importedCleanupCall      = "call"
+	importedCleanupRetention = "retention"
+)
+
+// importedContact is a contact added by ImportContacts for phone dialing.
+type importedContact struct {
+	UserID   int64     `json:"user_id"`
+	Phone    string    `json:"phone"`
+	Imported time.Time `json:"imported"`
+}
+
+// ImportedContacts records contacts the gateway imported into the account's
+// address book so that they can be removed again. It is persisted to disk
+// and safe for concurrent use.
+type ImportedContacts struct {
+	mu       sync.Mutex
+	path     string
+	contacts map[int64]*importedContact
+}
+
+// NewImportedContacts creates an ImportedContacts persisted to path and
+// loads previously recorded contacts.
+func NewImportedContacts(path string) *ImportedContacts {
+	c := &ImportedContacts{path: path, contacts: make(map[int64]*importedContact)}
+	if err := c.load(); err != nil {
+		coreLog.Warnf("load imported contacts %s: %v", path, err)
+	}
+	return c
+}
+
+// Add records a contact imported for phone.
+func (c *ImportedContacts) Add(userID int64, phone string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.contacts[userID]; ok {
+		return
+	}
+	c.contacts[userID] = &importedContact{UserID: userID, Phone: phone, Imported: time.Now()}
+	c.saveLocked()
+}
+
+// Has reports whether userID was imported by the gateway.
+func (c *ImportedContacts) Has(userID int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.contacts[userID]
+	return ok
+}
+
+// List returns recorded contacts ordered by import time.
+func (c *ImportedContacts) List() []importedContact {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]importedContact, 0, len(c.contacts))
+	for _, ic := range c.contacts {
+		list = append(list, *ic)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Imported.Before(list[j].Imported) })
+	return list
+}
+
+// OlderThan returns user IDs imported more than age ago.
+func (c *ImportedContacts) OlderThan(age time.Duration) []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []int64
+	for id, ic := range c.contacts {
+		if time.Since(ic.Imported) > age {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Remove deletes ids from the account's address book and forgets them.
+func (c *ImportedContacts) Remove(cl *client.Client, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := cl.RemoveContacts(&client.RemoveContactsRequest{UserIds: ids}); err != nil {
+		return fmt.Errorf("remove contacts: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		delete(c.contacts, id)
+	}
+	c.saveLocked()
+	return nil
+}
+
+func (c *ImportedContacts) load() error {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*importedContact
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ic := range list {
+		c.contacts[ic.UserID] = ic
+	}
+	return nil
+}
+
+// saveLocked writes recorded contacts to disk; caller must hold c.mu.
+func (c *ImportedContacts) saveLocked() {
+	list := make([]*importedContact, 0, len(c.contacts))
+	for _, ic := range c.contacts {
+		list = append(list, ic)
+	}
+	data, err := json.Marshal(list)
+	if err == nil {
+		err = writeFileAtomic(c.path, data)
+	}
+	if err != nil {
+		coreLog.Warnf("save imported contacts %s: %v", c.path, err)
+	}
+}
+
+// cleanupImported removes contacts imported longer than retention ago from
+// every account using the retention policy.
+func (g *Gateway) cleanupImported(policy string, retention time.Duration) {
+	if policy != importedCleanupRetention {
+		return
+	}
+	for _, acc := range g.accountList {
+		ids := acc.imported.OlderThan(retention)
+		if len(ids) == 0 {
+			continue
+		}
+		if err := acc.removeImported(ids); err != nil {
+			coreLog.Warnf("cleanup imported contacts of %s: %v", acc.Name(), err)
+			continue
+		}
+		coreLog.Infof("removed %d imported contacts of %s", len(ids), acc.Name())
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net"
+	"strings"
 )
 
 // detectHostIP returns the first global unicast IPv4 address of the host.
@@ -14,9 +15,28 @@ import (
 // "sendto: invalid argument".  We now iterate over the network interfaces,
 // selecting the first address that is up, not loopback and globally routable.
 func detectHostIP() (string, error) {
+	ip := detectHostAddr(false)
+	if ip == nil {
+		return "", fmt.Errorf("no non-loopback IPv4 address found")
+	}
+	return ip.String(), nil
+}
+
+// detectHostIPv6 returns the first global unicast IPv6 address of the host.
+func detectHostIPv6() (string, error) {
+	ip := detectHostAddr(true)
+	if ip == nil {
+		return "", fmt.Errorf("no global IPv6 address found")
+	}
+	return ip.String(), nil
+}
+
+// detectHostAddr returns the first global unicast address of the requested
+// family on an interface that is up and not loopback, or nil.
+func detectHostAddr(ipv6 bool) net.IP {
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return "", err
+		return nil
 	}
 	for _, iface := range ifaces {
 		if iface.Flags&net.FlagUp == 0 {
@@ -40,15 +60,41 @@ func detectHostIP() (string, error) {
 			if ip == nil {
 				continue
 			}
-			ip4 := ip.To4()
-			if ip4 == nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			if (len(ip) == net.IPv6len) != ipv6 {
 				continue
 			}
-			if !ip4.IsGlobalUnicast() {
+			if !ip.IsGlobalUnicast() {
 				continue
 			}
-			return ip4.String(), nil
+			return ip
+		}
+	}
+	return nil
+}
+
+// isIPv6 reports whether host is an IPv6 literal, with or without brackets.
+func isIPv6(host string) bool {
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.To4() == nil
+}
+
+// isLocalIP reports whether ip is assigned to one of the host interfaces.
+func isLocalIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(parsed) {
+			return true
 		}
 	}
-	return "", fmt.Errorf("no non-loopback IPv4 address found")
+	return false
 }
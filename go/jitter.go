@@ -0,0 +1,251 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// jitterOptions bound the playout delay of the jitter buffer. ComfortNoise
+// fills gaps in the audio sent to Telegram with noise instead of silence.
+type jitterOptions struct {
+	MinDelay     time.Duration
+	MaxDelay     time.Duration
+	ComfortNoise bool
+}
+
+// jitterStatus is the result of jitterBuffer.Pop.
+type jitterStatus int
+
+const (
+	jitterPlay     jitterStatus = iota // the next packet is returned
+	jitterLost                         // the next packet is missing
+	jitterWait                         // buffering, nothing to play yet
+	jitterUnderrun                     // the buffer ran dry while playing
+	jitterStretch                      // play a made-up frame to grow the delay
+)
+
+// jitterStretchInterval is the least number of packets played between two
+// stretches, so the delay grows without audible gaps.
+const jitterStretchInterval = 5
+
+// jitterPacket is a buffered RTP payload.
+type jitterPacket struct {
+	seq     uint16
+	ts      uint32
+	payload []byte
+}
+
+// jitterStats are the counters of a jitter buffer. Jitter and Depth are
+// milliseconds.
+type jitterStats struct {
+	Received  int64
+	Lost      int64
+	Late      int64
+	Duplicate int64
+	Dropped   int64 // discarded to shrink an overfull buffer
+	Underruns int64
+	Concealed int64 // frames made up by PLC or FEC
+	Jitter    float64
+	Depth     float64
+	Target    float64
+}
+
+// jitterBuffer reorders RTP packets of one stream and releases them at a
+// playout delay adapted to the measured interarrival jitter (RFC 3550
+// A.8). Packets arriving after their playout time are dropped. When the
+// buffer runs dry it buffers again up to the target delay. It is safe for
+// concurrent use by one receiving and one playing goroutine.
+type jitterBuffer struct {
+	clockRate int
+	minDelay  uint32 // in timestamp units
+	maxDelay  uint32
+
+	mu        sync.Mutex
+	packets   []jitterPacket // ordered by sequence number
+	free      [][]byte       // payload buffers for reuse
+	next      uint16         // sequence number played next
+	started   bool
+	buffering bool
+	played    int    // packets since the last stretch
+	frame     uint32 // timestamp units per packet
+	transit   int64
+	jitter    float64 // timestamp units
+	epoch     time.Time
+	stats     jitterStats
+}
+
+// jitterDefaultFrame is assumed per packet until two consecutive packets
+// show the real packet time.
+const jitterDefaultFrame = 20 * time.Millisecond
+
+func newJitterBuffer(clockRate int, opts jitterOptions) *jitterBuffer {
+	units := func(d time.Duration) uint32 { return uint32(d * time.Duration(clockRate) / time.Second) }
+	return &jitterBuffer{
+		clockRate: clockRate,
+		minDelay:  units(opts.MinDelay),
+		maxDelay:  units(opts.MaxDelay),
+		frame:     units(jitterDefaultFrame),
+		buffering: true,
+		epoch:     time.Now(),
+	}
+}
+
+// seqBefore reports whether a precedes b in sequence number space.
+func seqBefore(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// Push adds a packet that arrived at the given time. payload is copied.
+func (j *jitterBuffer) Push(h rtpHeader, payload []byte, arrival time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stats.Received++
+
+	// Interarrival jitter, RFC 3550 6.4.1.
+	transit := int64(arrival.Sub(j.epoch)*time.Duration(j.clockRate)/time.Second) - int64(h.Timestamp)
+	if j.stats.Received > 1 {
+		d := transit - j.transit
+		if d < 0 {
+			d = -d
+		}
+		j.jitter += (float64(d) - j.jitter) / 16
+	}
+	j.transit = transit
+
+	if j.started && !j.buffering && seqBefore(h.Seq, j.next) {
+		j.stats.Late++
+		return
+	}
+	i := len(j.packets)
+	for i > 0 && seqBefore(h.Seq, j.packets[i-1].seq) {
+		i--
+	}
+	if i > 0 && j.packets[i-1].seq == h.Seq {
+		j.stats.Duplicate++
+		return
+	}
+	if i > 0 && j.packets[i-1].seq == h.Seq-1 {
+		if d := h.Timestamp - j.packets[i-1].ts; d > 0 && d <= j.maxDelay {
+			j.frame = d
+		}
+	}
+	p := jitterPacket{seq: h.Seq, ts: h.Timestamp, payload: append(j.buffer(), payload...)}
+	j.packets = append(j.packets, jitterPacket{})
+	copy(j.packets[i+1:], j.packets[i:])
+	j.packets[i] = p
+	if !j.started {
+		j.next, j.started = j.packets[0].seq, true
+	}
+	for len(j.packets) > 1 && j.depth() > j.maxDelay {
+		j.drop()
+	}
+}
+
+func (j *jitterBuffer) buffer() []byte {
+	if n := len(j.free); n > 0 {
+		b := j.free[n-1]
+		j.free = j.free[:n-1]
+		return b[:0]
+	}
+	return nil
+}
+
+// Release returns the payload of a played packet for reuse.
+func (j *jitterBuffer) Release(p jitterPacket) {
+	j.mu.Lock()
+	j.free = append(j.free, p.payload)
+	j.mu.Unlock()
+}
+
+// depth returns the buffered audio in timestamp units.
+func (j *jitterBuffer) depth() uint32 {
+	if len(j.packets) == 0 {
+		return 0
+	}
+	return j.packets[len(j.packets)-1].ts - j.packets[0].ts + j.frame
+}
+
+// target returns the playout delay for the current jitter: one packet plus
+// four times the jitter, within the configured bounds.
+func (j *jitterBuffer) target() uint32 {
+	t := j.frame + uint32(4*j.jitter)
+	return min(max(t, j.minDelay), j.maxDelay)
+}
+
+// drop discards the oldest packet.
+func (j *jitterBuffer) drop() {
+	j.free = append(j.free, j.packets[0].payload)
+	j.next = j.packets[0].seq + 1
+	j.packets = j.packets[:copy(j.packets, j.packets[1:])]
+	j.stats.Dropped++
+}
+
+// Pop returns the packet due for playout. With jitterLost, the packet
+// following the missing one is appended to fec if it is buffered, so its
+// FEC data can be used. Played packets must be released.
+func (j *jitterBuffer) Pop(fec []byte) (p jitterPacket, next []byte, status jitterStatus) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.packets) == 0 {
+		if j.buffering {
+			return p, nil, jitterWait
+		}
+		j.buffering = true
+		j.stats.Underruns++
+		return p, nil, jitterUnderrun
+	}
+	target := j.target()
+	if j.buffering {
+		if j.depth() < target {
+			return p, nil, jitterWait
+		}
+		// Packets missing before the first buffered one were covered while
+		// buffering.
+		if gap := int16(j.packets[0].seq - j.next); gap > 0 {
+			j.stats.Lost += int64(gap)
+		}
+		j.buffering = false
+		j.next = j.packets[0].seq
+	}
+	// Grow towards the target when jitter went up.
+	if j.depth()+j.frame < target && j.played >= jitterStretchInterval {
+		j.played = 0
+		return p, nil, jitterStretch
+	}
+	j.played++
+	// Shrink slowly towards the target when jitter went down.
+	if j.depth() > 2*target+j.frame && len(j.packets) > 1 {
+		j.drop()
+	}
+	head := j.packets[0]
+	if head.seq != j.next {
+		j.next++
+		j.stats.Lost++
+		if head.seq == j.next {
+			next = append(fec[:0], head.payload...)
+		}
+		return p, next, jitterLost
+	}
+	j.packets = j.packets[:copy(j.packets, j.packets[1:])]
+	j.next++
+	return head, nil, jitterPlay
+}
+
+// Concealed counts a frame made up by PLC or FEC.
+func (j *jitterBuffer) Concealed() {
+	j.mu.Lock()
+	j.stats.Concealed++
+	j.mu.Unlock()
+}
+
+// Stats returns the current counters.
+func (j *jitterBuffer) Stats() jitterStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := j.stats
+	ms := func(units float64) float64 { return units * 1000 / float64(j.clockRate) }
+	s.Jitter = ms(j.jitter)
+	s.Depth = ms(float64(j.depth()))
+	s.Target = ms(float64(j.target()))
+	return s
+}
@@ -3,76 +3,165 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
 	gosip "github.com/ghettovoice/gosip"
 	gosiplog "github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/transport"
 	client "github.com/zelenin/go-tdlib/client"
 	"gopkg.in/ini.v1"
 )
 
 var sipServer gosip.Server
 
+// sipBindHost is the local address of the SIP listener, also used for media
+// sockets.
+var sipBindHost string
+
+// sipAdvertised is the public SIP address used in Contact headers and SDP.
+var sipAdvertised = &advertisedAddress{}
+
 func startSIP(ctx context.Context, cfg *Settings) error {
 	coreLog.Info("starting SIP server")
 
 	port := cfg.SIPPort()
 	portRange := cfg.SIPPortRange()
-	host := cfg.PublicAddress()
-	if host == "" {
-		if ip, err := detectHostIP(); err != nil {
-			coreLog.Warnf("auto detect address: %v", err)
-		} else {
-			host = ip
-			coreLog.Infof("auto detected address %s", host)
+
+	// The server binds a local interface address and advertises the
+	// public address, which differs from it behind NAT.
+	bindHost := ""
+	if pub := cfg.PublicAddress(); pub != "" && isLocalIP(pub) {
+		bindHost = pub
+	} else if ip, err := detectHostIP(); err != nil {
+		coreLog.Warnf("auto detect address: %v", err)
+	} else {
+		bindHost = ip
+		coreLog.Infof("auto detected address %s", bindHost)
+	}
+	useSTUN := cfg.PublicAddress() == "" && cfg.StunServer() != ""
+
+	// Dual-stack: a wildcard IPv6 socket also accepts IPv4 peers. gosip keys
+	// UDP listeners by port, so separate IPv4 and IPv6 sockets cannot share
+	// one.
+	listenHost := bindHost
+	public6 := cfg.PublicAddress6()
+	if cfg.IPv6() {
+		if public6 == "" {
+			if ip, err := detectHostIPv6(); err == nil {
+				public6 = ip
+			}
+		}
+		if public6 != "" && bindHost != cfg.PublicAddress() {
+			listenHost = "::"
 		}
 	}
+	// IPv6 is only advertised if the SIP listener and the RTP sockets,
+	// which bind the same host, accept IPv6 peers. An empty host binds all
+	// interfaces of both families.
+	if public6 != "" && listenHost != "" && !isIPv6(listenHost) {
+		coreLog.Warnf("not advertising %s, the SIP listener on %s is IPv4 only", public6, listenHost)
+		public6 = ""
+	}
 
 	logger := gosiplog.NewLogrusLogger(pjsipLog, "SIP", nil)
-
-	sipServer = gosip.NewServer(gosip.ServerConfig{Host: host, UserAgent: "tg2sip"}, nil, nil, logger)
+	// gosip parses sip: and sips: URIs only.
+	transport.SetProtocolFactory(telProtocolFactory(transport.GetProtocolFactory()))
+	newServer := func(host string) gosip.Server {
+		return gosip.NewServer(gosip.ServerConfig{Host: host, UserAgent: "tg2sip"}, nil, nil, logger)
+	}
 
 	var listenErr error
 	for i := 0; i <= portRange; i++ {
 		// Explicitly include host in listen address to avoid binding to
-		// the default loopback address when a public address is
-		// detected. When host is empty, fall back to all interfaces.
-		addr := fmt.Sprintf(":%d", port+i)
-		if host != "" {
-			addr = fmt.Sprintf("%s:%d", host, port+i)
+		// the default loopback address. When host is empty, fall back to
+		// all interfaces.
+		addr := net.JoinHostPort(listenHost, strconv.Itoa(port+i))
+		public, publicPort := cfg.PublicAddress(), port+i
+		if useSTUN {
+			stunAddr := net.JoinHostPort(bindHost, strconv.Itoa(port+i))
+			mapped, nat, err := discoverPublicAddress(stunAddr, cfg.StunServer())
+			if err != nil {
+				coreLog.Warnf("STUN discovery via %s for %s failed: %v", cfg.StunServer(), stunAddr, err)
+			} else {
+				public, publicPort = mapped.IP.String(), mapped.Port
+				coreLog.Infof("STUN mapped %s to %s, %s", stunAddr, mapped, nat)
+			}
+		}
+		if public == "" {
+			public = bindHost
 		}
-		listenErr = sipServer.Listen("udp", addr)
+
+		srv := newRehostableServer(public, newServer)
+		listenErr = srv.Listen("udp", addr)
 		if listenErr == nil {
-			coreLog.Infof("SIP server listening on %s/udp", addr)
+			sipServer = srv
+			sipBindHost = listenHost
+			sipAdvertised.set(public, publicPort)
+			if public6 != "" {
+				sipAdvertised.setIPv6(public6, port+i)
+			}
+			coreLog.Infof("SIP server listening on %s/udp, advertising %s", addr, sipAdvertised.HostPort())
+			if public6 != "" {
+				coreLog.Infof("advertising %s to IPv6 peers", sipAdvertised.HostPortFor(public6))
+			}
 			go func() {
 				<-ctx.Done()
 				sipServer.Shutdown()
 			}()
+			if useSTUN && cfg.StunInterval() > 0 {
+				go watchPublicAddress(ctx, cfg.StunServer(), cfg.StunInterval(), sipAdvertised, srv)
+			}
 			return nil
 		}
+		srv.Shutdown()
 		coreLog.Warnf("failed to listen on %s: %v", addr, listenErr)
 	}
 	return fmt.Errorf("sip listen: %w", listenErr)
 }
 
-var tgClient *client.Client
+// startTG starts a TDLib client for every configured Telegram account.
+func startTG(ctx context.Context, cfg *Settings) ([]*Account, error) {
+	var accounts []*Account
+	for _, accCfg := range cfg.Accounts() {
+		cl, err := startAccount(accCfg, true)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %w", accCfg.Name(), err)
+		}
+		flood := NewFloodControl(filepath.Join(accountDataDir(accCfg), "flood.json"),
+			cfg.ExtraWaitTime(), cfg.PeerFloodTime(), cfg.CallRate(), cfg.CallBurst())
+		acc := NewAccount(accCfg, cl, flood, cfg.NegativeCacheTTL())
+		go acc.closeOnDone(ctx)
+		accounts = append(accounts, acc)
+	}
+	return accounts, nil
+}
 
-func startTG(ctx context.Context, cfg *Settings) error {
-	coreLog.Info("starting Telegram client")
+// accountDataDir returns the folder holding TDLib and gateway state of an account.
+func accountDataDir(cfg *AccountSettings) string {
+	if dir := cfg.DatabaseFolder(); dir != "" {
+		return dir
+	}
+	return filepath.Join(".tdlib", cfg.Name())
+}
+
+// startAccount creates and authorizes the TDLib client of a single account.
+// Without interactive, a login code, password or phone number that is not
+// in the settings fails the authorization instead of prompting on stdin.
+func startAccount(cfg *AccountSettings, interactive bool) (*client.Client, error) {
+	coreLog.Infof("starting Telegram client for account %s", cfg.Name())
 
 	apiID := cfg.APIID()
 	apiHash := cfg.APIHash()
 
-	dataDir := cfg.DatabaseFolder()
-	if dataDir == "" {
-		dataDir = filepath.Join(".tdlib")
-	}
+	dataDir := accountDataDir(cfg)
 	if err := os.MkdirAll(dataDir, 0700); err != nil {
-		return fmt.Errorf("create data dir: %w", err)
+		return nil, fmt.Errorf("create data dir: %w", err)
 	}
 
 	params := &client.SetTdlibParametersRequest{
@@ -97,22 +186,33 @@ func startTG(ctx context.Context, cfg *Settings) error {
 			switch state.AuthorizationStateType() {
 			case client.TypeAuthorizationStateWaitPhoneNumber:
 				phone := cfg.PhoneNumber()
-				if phone == "" {
-					fmt.Println("Enter phone number: ")
+				switch {
+				case phone != "":
+					fmt.Printf("Using phone number from settings for account %s\n", cfg.Name())
+				case interactive:
+					fmt.Printf("Enter phone number for account %s: \n", cfg.Name())
 					fmt.Scanln(&phone)
-				} else {
-					fmt.Println("Using phone number from settings")
+				default:
+					coreLog.Errorf("telegram account %s needs a phone number to log in", cfg.Name())
 				}
 				authorizer.PhoneNumber <- phone
 			case client.TypeAuthorizationStateWaitCode:
-				fmt.Println("Enter code: ")
 				var code string
-				fmt.Scanln(&code)
+				if interactive {
+					fmt.Printf("Enter code for account %s: \n", cfg.Name())
+					fmt.Scanln(&code)
+				} else {
+					coreLog.Errorf("telegram account %s needs a login code, restart the gateway to log in", cfg.Name())
+				}
 				authorizer.Code <- code
 			case client.TypeAuthorizationStateWaitPassword:
-				fmt.Println("Enter password: ")
 				var password string
-				fmt.Scanln(&password)
+				if interactive {
+					fmt.Printf("Enter password for account %s: \n", cfg.Name())
+					fmt.Scanln(&password)
+				} else {
+					coreLog.Errorf("telegram account %s needs its password, restart the gateway to log in", cfg.Name())
+				}
 				authorizer.Password <- password
 			case client.TypeAuthorizationStateReady:
 				return
@@ -120,10 +220,9 @@ func startTG(ctx context.Context, cfg *Settings) error {
 		}
 	}()
 
-	var err error
-	tgClient, err = client.NewClient(authorizer)
+	tgClient, err := client.NewClient(authorizer)
 	if err != nil {
-		return fmt.Errorf("tdlib client: %w", err)
+		return nil, fmt.Errorf("tdlib client: %w", err)
 	}
 
 	if cfg.ProxyEnabled() {
@@ -141,7 +240,7 @@ func startTG(ctx context.Context, cfg *Settings) error {
 				Type:   ptype,
 			})
 			if err != nil {
-				return fmt.Errorf("telegram.add_proxy: %w", err)
+				return nil, fmt.Errorf("telegram.add_proxy: %w", err)
 			}
 		} else {
 			coreLog.Warn("telegram proxy enabled but address or port missing")
@@ -150,20 +249,10 @@ func startTG(ctx context.Context, cfg *Settings) error {
 
 	me, err := tgClient.GetMe()
 	if err != nil {
-		return fmt.Errorf("get me: %w", err)
+		return nil, fmt.Errorf("get me: %w", err)
 	}
-	coreLog.Infof("telegram authorized as %s %s (@%s)", me.FirstName, me.LastName, getUsername(me))
-
-	go func() {
-		<-ctx.Done()
-		if tgClient != nil {
-			if _, err := tgClient.Close(); err != nil {
-				coreLog.Warnf("telegram client close: %v", err)
-			}
-		}
-	}()
-
-	return nil
+	coreLog.Infof("telegram account %s authorized as %s %s (@%s)", cfg.Name(), me.FirstName, me.LastName, getUsername(me))
+	return tgClient, nil
 }
 
 func main() {
@@ -188,13 +277,27 @@ func main() {
 	}
 	coreLog.Info("settings loaded", cfg.Section("").KeysHash())
 
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, settings, os.Args[1:]); err != nil {
+			fmt.Printf("%v\n", err)
+		}
+		closeLogging()
+		return
+	}
+
+	if addr := settings.MetricsListen(); addr != "" {
+		if err := startMetrics(ctx, addr); err != nil {
+			coreLog.Fatalf("failed to start metrics: %v", err)
+		}
+	}
 	if err := startSIP(ctx, settings); err != nil {
 		coreLog.Fatalf("failed to start SIP client: %v", err)
 	}
-	if err := startTG(ctx, settings); err != nil {
+	accounts, err := startTG(ctx, settings)
+	if err != nil {
 		coreLog.Fatalf("failed to start Telegram client: %v", err)
 	}
-	if err := startGateway(ctx, settings); err != nil {
+	if err := startGateway(ctx, settings, accounts); err != nil {
 		coreLog.Fatalf("failed to start gateway: %v", err)
 	}
 
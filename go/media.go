@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// mediaAddress returns the address advertised in SDP for the RTP socket of
+// a call with peer. Behind NAT the mapping of the RTP port is asked from
+// the STUN server since it may differ from the SIP port mapping.
+func (g *Gateway) mediaAddress(media *mediaPorts, peer string) (string, int) {
+	host, port := sipAdvertised.HostFor(peer), media.Port()
+	if g.stun != nil && !isIPv6(host) {
+		mapped, err := g.stun.MappedAddr(media.RTP)
+		if err != nil {
+			coreLog.Warnf("STUN mapping of RTP port %d failed: %v", port, err)
+			return host, port
+		}
+		return mapped.IP.String(), mapped.Port
+	}
+	return host, port
+}
+
+// sdpOffer builds the offer of a Telegram->SIP call and records the offered
+// keys in ctx.
+func (g *Gateway) sdpOffer(ctx *Context, peer string) (*sessionDescription, error) {
+	proto, crypto, err := offerCrypto(ctx.SRTPPolicy)
+	if err != nil {
+		return nil, err
+	}
+	host, port := g.mediaAddress(ctx.Media, peer)
+	sdp, audio := newSDP(host, port, proto)
+	for _, c := range g.codecs {
+		audio.AddCodec(c)
+	}
+	audio.Attributes = append(audio.Attributes, "ptime:"+strconv.Itoa(g.codecOpts.Ptime), "sendrecv")
+	addCrypto(audio, crypto)
+	ctx.OfferedCrypto = crypto
+	return sdp, nil
+}
+
+// sdpAnswer negotiates codec and SRTP for the offer of a SIP->Telegram call
+// and sets up the media state of ctx.
+func (g *Gateway) sdpAnswer(ctx *Context, offer *sessionDescription, peer string) (*sessionDescription, error) {
+	audio, err := offer.Audio()
+	if err != nil {
+		return nil, err
+	}
+	codec, ok := selectCodec(audio, g.codecs)
+	if !ok {
+		return nil, fmt.Errorf("no common codec in %s", strings.Join(audio.Formats, " "))
+	}
+	key, srtp, err := answerCrypto(audio, ctx.SRTPPolicy)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := offer.RemoteAddr(audio)
+	if err != nil {
+		return nil, err
+	}
+
+	// The answer carries our parameters of the codec, the peer's stay in
+	// codec for the encoder.
+	local := codec
+	local.Fmtp = ""
+	for _, c := range g.codecs {
+		if c.same(codec) {
+			local.Fmtp = c.Fmtp
+		}
+	}
+	ptime := g.packetTime(audio, codec)
+	host, port := g.mediaAddress(ctx.Media, peer)
+	answer, m := newSDP(host, port, audio.Proto)
+	m.AddCodec(local)
+	m.Attributes = append(m.Attributes, "ptime:"+strconv.Itoa(ptime), answerDirection(offer.Direction(audio)))
+	// The answer has a stream for every offered one, in the same order;
+	// all but the audio stream used are rejected.
+	answer.Media = answer.Media[:0]
+	for _, om := range offer.Media {
+		if om == audio {
+			answer.Media = append(answer.Media, m)
+		} else {
+			answer.Media = append(answer.Media, om.rejected())
+		}
+	}
+	if key != nil {
+		addCrypto(m, []*cryptoAttribute{key})
+	}
+	g.setRemoteMedia(ctx, codec, ptime, remote, srtp)
+	return answer, nil
+}
+
+// applyAnswer completes the offer of ctx with the answer body of the peer.
+func (g *Gateway) applyAnswer(ctx *Context, body string) error {
+	sdp, err := parseSDP(body)
+	if err != nil {
+		return err
+	}
+	audio, err := sdp.Audio()
+	if err != nil {
+		return err
+	}
+	codec, ok := selectCodec(audio, g.codecs)
+	if !ok {
+		return fmt.Errorf("no supported codec in answer %s", strings.Join(audio.Formats, " "))
+	}
+	srtp, err := acceptCrypto(ctx.OfferedCrypto, audio, ctx.SRTPPolicy)
+	if err != nil {
+		return err
+	}
+	remote, err := sdp.RemoteAddr(audio)
+	if err != nil {
+		return err
+	}
+	g.setRemoteMedia(ctx, codec, g.packetTime(audio, codec), remote, srtp)
+	return nil
+}
+
+// offerAddress returns the RTP address of the audio stream of an SDP body.
+func offerAddress(body string) (*net.UDPAddr, error) {
+	sdp, err := parseSDP(body)
+	if err != nil {
+		return nil, err
+	}
+	audio, err := sdp.Audio()
+	if err != nil {
+		return nil, err
+	}
+	return sdp.RemoteAddr(audio)
+}
+
+// packetTime returns the ms of audio per packet sent to the peer of m: its
+// a=ptime if usable, otherwise the configured ptime, within a=maxptime.
+func (g *Gateway) packetTime(m *mediaDescription, codec sdpCodec) int {
+	valid := func(p int) bool {
+		// Opus has no 30 ms frames (RFC 6716 2.1.4).
+		return p >= 10 && p <= 60 && p%10 == 0 && !(p == 30 && strings.EqualFold(codec.Name, "opus"))
+	}
+	ptime, maxPtime := m.Ptime()
+	if !valid(ptime) {
+		ptime = g.codecOpts.Ptime
+	}
+	if !valid(ptime) {
+		ptime = 20
+	}
+	for maxPtime > 0 && ptime > maxPtime && ptime > 10 {
+		ptime -= 10
+		if !valid(ptime) {
+			ptime -= 10
+		}
+	}
+	return ptime
+}
+
+// routePeer returns the host of the first target of route, which decides
+// the address family of the offer.
+func routePeer(route *dialRoute) string {
+	if len(route.targets) == 0 {
+		return ""
+	}
+	uri, err := parser.ParseUri(route.targets[0])
+	if err != nil {
+		return ""
+	}
+	return uri.Host()
+}
+
+// setRemoteMedia records the negotiated media of ctx. The signalled address
+// seeds the symmetric RTP latch.
+func (g *Gateway) setRemoteMedia(ctx *Context, codec sdpCodec, ptime int, remote *net.UDPAddr, srtp *srtpSession) {
+	g.mu.Lock()
+	ctx.Codec = codec
+	ctx.Ptime = ptime
+	ctx.SRTP = srtp
+	if ctx.RTPPeer == nil {
+		ctx.RTPPeer = newRTPLatch(remote, g.symmetricRTP)
+	} else {
+		ctx.RTPPeer.Signal(remote)
+	}
+	g.mu.Unlock()
+	transport := "RTP"
+	if srtp != nil {
+		transport = "SRTP"
+	}
+	coreLog.Infof("call %s media: %s/%dms to %s over %s", ctx.ID, codec.rtpmap(), ptime, remote, transport)
+	g.startBridge(ctx)
+}
+
+// startBridge connects the Telegram and SIP media of ctx once the voice
+// controller and the negotiated RTP stream both exist. Closed calls and
+// SIP->Telegram calls not answered yet get no bridge.
+func (g *Gateway) startBridge(ctx *Context) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	media, ok := ctx.Controller.(tgvoipMedia)
+	if !ok || ctx.closed || ctx.FromSIP && !ctx.Answered || ctx.RTPPeer == nil || ctx.Media == nil || ctx.Bridge != nil {
+		return
+	}
+	if ctx.Ringback != nil {
+		ctx.Ringback.Stop()
+		ctx.Ringback = nil
+	}
+	bridge, err := newRTPBridge(ctx, g.codecOpts, g.jitterOpts)
+	if err != nil {
+		coreLog.Warnf("call %s media bridge: %v", ctx.ID, err)
+		return
+	}
+	ctx.Bridge = bridge
+	bridge.Start(media.Controller)
+	media.SetMicMute(false)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+)
+
+// metrics holds gateway counters and gauges. They are published with expvar
+// as "tg2sip" and served at /debug/vars when [metrics] listen is set.
+var metrics = expvar.NewMap("tg2sip")
+
+// startMetrics serves the expvar variables on addr until ctx is canceled.
+func startMetrics(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			coreLog.Warnf("metrics server: %v", err)
+		}
+	}()
+	coreLog.Infof("metrics served on http://%s/debug/vars", ln.Addr())
+	return nil
+}
+
+func expvarInt(v int64) *expvar.Int {
+	i := new(expvar.Int)
+	i.Set(v)
+	return i
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// keepaliveTimeout bounds a single OPTIONS keepalive transaction.
+const keepaliveTimeout = 5 * time.Second
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which
+// net.IP.IsPrivate does not cover.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isNATAddress reports whether ip cannot be reached from outside its own
+// network.
+func isNATAddress(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || sharedAddressSpace.Contains(ip)
+}
+
+// natTarget returns the remote target for requests to a peer that sent
+// contact from source ("ip:port"). A Contact with a private address that
+// differs from the observed source is replaced by the source, since the
+// peer is behind NAT and only the mapped address is reachable.
+func natTarget(contact sip.Uri, source string) (sip.Uri, bool) {
+	host, portStr, err := net.SplitHostPort(source)
+	if err != nil {
+		return contact, false
+	}
+	ip := net.ParseIP(strings.Trim(contact.Host(), "[]"))
+	if ip == nil || !isNATAddress(ip) {
+		return contact, false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return contact, false
+	}
+	contactPort := int(sip.DefaultPort("udp"))
+	if contact.Port() != nil {
+		contactPort = int(*contact.Port())
+	}
+	if ip.Equal(net.ParseIP(host)) && contactPort == port {
+		return contact, false
+	}
+	fixed := contact.Clone()
+	fixed.SetHost(host)
+	p := sip.Port(port)
+	fixed.SetPort(&p)
+	return fixed, true
+}
+
+// addRport asks the next hop to send responses back to the source port of
+// the request (RFC 3581), which keeps them on the NAT binding it used.
+func addRport(req sip.Request) {
+	if hop, ok := req.ViaHop(); ok {
+		if hop.Params == nil {
+			hop.Params = sip.NewParams()
+		}
+		if !hop.Params.Has("rport") {
+			hop.Params.Add("rport", nil)
+		}
+	}
+}
+
+// rtpLatch tracks where RTP of a call is sent. With symmetric RTP the
+// address from SDP is only a hint: the source of the first packet received
+// is latched and used instead, so media reaches peers behind NAT. It is safe
+// for concurrent use.
+type rtpLatch struct {
+	symmetric bool
+
+	mu        sync.Mutex
+	signalled *net.UDPAddr
+	latched   *net.UDPAddr
+}
+
+func newRTPLatch(signalled *net.UDPAddr, symmetric bool) *rtpLatch {
+	return &rtpLatch{symmetric: symmetric, signalled: signalled}
+}
+
+// Received records the source of an incoming packet and reports whether
+// the packet should be accepted. Once latched, packets from other sources
+// are dropped until the signalled address changes.
+func (l *rtpLatch) Received(src *net.UDPAddr) bool {
+	if !l.symmetric {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.latched == nil {
+		l.latched = src
+		if l.signalled != nil && !udpAddrEqual(l.signalled, src) {
+			coreLog.Infof("symmetric RTP: latched to %s instead of signalled %s", src, l.signalled)
+		}
+		return true
+	}
+	return udpAddrEqual(l.latched, src)
+}
+
+// Remote returns the address RTP is sent to.
+func (l *rtpLatch) Remote() *net.UDPAddr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.latched != nil {
+		return l.latched
+	}
+	return l.signalled
+}
+
+// Signal updates the address from SDP, e.g. after a re-INVITE, and latches
+// again on the next packet.
+func (l *rtpLatch) Signal(addr *net.UDPAddr) {
+	l.mu.Lock()
+	l.signalled = addr
+	l.latched = nil
+	l.mu.Unlock()
+}
+
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// Ping sends an OPTIONS request to target and waits for the final response.
+// Any response proves the flow and its NAT binding alive.
+func (c *SIPClient) Ping(ctx context.Context, target string) (sip.Response, error) {
+	toURI, err := parser.ParseUri(target)
+	if err != nil {
+		return nil, fmt.Errorf("parse keepalive target: %w", err)
+	}
+	fromURI, err := parser.ParseUri("sip:" + defaultFromUser + "@" + toURI.Host())
+	if err != nil {
+		return nil, fmt.Errorf("parse from uri: %w", err)
+	}
+
+	var next *sipTarget
+	peer := toURI.Host()
+	if c.resolver != nil && c.proxy == nil {
+		targets, err := c.resolver.Resolve(ctx, toURI)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", toURI, err)
+		}
+		next = &targets[0]
+		peer = next.Addr
+	}
+
+	cid := sip.CallID(util.RandString(32))
+	req, err := sip.NewRequestBuilder().
+		SetMethod(sip.OPTIONS).
+		SetRecipient(toURI).
+		SetFrom(&sip.Address{Uri: fromURI, Params: sip.NewParams().Add("tag", sip.String{Str: util.RandString(8)})}).
+		SetTo(&sip.Address{Uri: toURI}).
+		SetContact(c.contactAddress(fromURI, peer)).
+		SetCallID(&cid).
+		SetSeqNo(1).
+		Build()
+	if err != nil {
+		return nil, fmt.Errorf("build OPTIONS: %w", err)
+	}
+	c.prepare(req)
+	if next != nil {
+		req.SetDestination(next.Addr)
+		req.SetTransport(next.Transport)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, keepaliveTimeout)
+	defer cancel()
+	res, err := c.srv.RequestWithContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	c.checkViaMapping(res)
+	return res, nil
+}
+
+// checkViaMapping compares the received/rport parameters the next hop put
+// into our Via with the advertised address and warns if they differ, which
+// means Contact and SDP point at an address the peer cannot reach.
+func (c *SIPClient) checkViaMapping(res sip.Response) {
+	hop, ok := res.ViaHop()
+	if !ok || hop.Params == nil || c.local == nil || c.local.Host() == "" {
+		return
+	}
+	received, ok := hop.Params.Get("received")
+	if !ok || received == nil || received.String() == "" {
+		return
+	}
+	mapped := received.String()
+	if rport, ok := hop.Params.Get("rport"); ok && rport != nil && rport.String() != "" {
+		mapped = net.JoinHostPort(mapped, rport.String())
+	}
+	c.mu.Lock()
+	changed := mapped != c.viaMapping
+	c.viaMapping = mapped
+	c.mu.Unlock()
+	if changed && received.String() != c.local.HostFor(received.String()) {
+		coreLog.Warnf("SIP peer sees us at %s but %s is advertised, set public_address or stun_server", mapped, c.local.HostPortFor(received.String()))
+	}
+}
+
+// keepAlive pings targets every interval to keep NAT bindings towards them
+// open and logs when a target stops or starts answering.
+func (c *SIPClient) keepAlive(ctx context.Context, targets []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	down := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, t := range targets {
+			_, err := c.Ping(ctx, t)
+			switch {
+			case err != nil && !down[t]:
+				coreLog.Warnf("SIP keepalive to %s failed: %v", t, err)
+				down[t] = true
+			case err == nil && down[t]:
+				coreLog.Infof("SIP keepalive to %s answered again", t)
+				down[t] = false
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+//go:build tgvoip
+
+package opus
+
+/*
+#cgo LDFLAGS: -lopus
+#include <opus/opus.h>
+
+// opus_*_ctl are variadic and cannot be called from Go directly.
+static int opus_enc_set(OpusEncoder* e, int bitrate, int fec, int loss, int dtx, int bandwidth) {
+    int err;
+    if(bitrate>0 && (err=opus_encoder_ctl(e, OPUS_SET_BITRATE(bitrate)))!=OPUS_OK) return err;
+    if((err=opus_encoder_ctl(e, OPUS_SET_INBAND_FEC(fec)))!=OPUS_OK) return err;
+    if((err=opus_encoder_ctl(e, OPUS_SET_PACKET_LOSS_PERC(loss)))!=OPUS_OK) return err;
+    if((err=opus_encoder_ctl(e, OPUS_SET_DTX(dtx)))!=OPUS_OK) return err;
+    if(bandwidth>0 && (err=opus_encoder_ctl(e, OPUS_SET_MAX_BANDWIDTH(bandwidth)))!=OPUS_OK) return err;
+    return OPUS_OK;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+var bandwidths = map[int]C.int{
+	BandwidthNarrow:    C.OPUS_BANDWIDTH_NARROWBAND,
+	BandwidthMedium:    C.OPUS_BANDWIDTH_MEDIUMBAND,
+	BandwidthWide:      C.OPUS_BANDWIDTH_WIDEBAND,
+	BandwidthSuperWide: C.OPUS_BANDWIDTH_SUPERWIDEBAND,
+	BandwidthFull:      C.OPUS_BANDWIDTH_FULLBAND,
+}
+
+func opusError(code C.int) error {
+	return fmt.Errorf("opus: %s", C.GoString(C.opus_strerror(code)))
+}
+
+type encoder struct {
+	ptr      *C.OpusEncoder
+	channels int
+}
+
+func newEncoder(channels int, opts EncoderOptions) (Encoder, error) {
+	var code C.int
+	ptr := C.opus_encoder_create(SampleRate, C.int(channels), C.OPUS_APPLICATION_VOIP, &code)
+	if code != C.OPUS_OK {
+		return nil, opusError(code)
+	}
+	fec, dtx := 0, 0
+	if opts.FEC {
+		fec = 1
+	}
+	if opts.DTX {
+		dtx = 1
+	}
+	code = C.opus_enc_set(ptr, C.int(opts.Bitrate), C.int(fec), C.int(opts.PacketLoss), C.int(dtx), bandwidths[opts.MaxBandwidth])
+	if code != C.OPUS_OK {
+		C.opus_encoder_destroy(ptr)
+		return nil, opusError(code)
+	}
+	return &encoder{ptr: ptr, channels: channels}, nil
+}
+
+func (e *encoder) Encode(pcm []int16, dst []byte) (int, error) {
+	if len(pcm) < e.channels || len(dst) == 0 {
+		return 0, errors.New("opus: empty buffer")
+	}
+	n := C.opus_encode(e.ptr, (*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)/e.channels),
+		(*C.uchar)(unsafe.Pointer(&dst[0])), C.opus_int32(len(dst)))
+	if n < 0 {
+		return 0, opusError(C.int(n))
+	}
+	return int(n), nil
+}
+
+func (e *encoder) Close() {
+	C.opus_encoder_destroy(e.ptr)
+}
+
+type decoder struct {
+	ptr      *C.OpusDecoder
+	channels int
+}
+
+func newDecoder(channels int) (Decoder, error) {
+	var code C.int
+	ptr := C.opus_decoder_create(SampleRate, C.int(channels), &code)
+	if code != C.OPUS_OK {
+		return nil, opusError(code)
+	}
+	return &decoder{ptr: ptr, channels: channels}, nil
+}
+
+func (d *decoder) decode(packet []byte, pcm []int16, fec C.int) (int, error) {
+	if len(pcm) < d.channels {
+		return 0, errors.New("opus: empty buffer")
+	}
+	var data *C.uchar
+	if len(packet) > 0 {
+		data = (*C.uchar)(unsafe.Pointer(&packet[0]))
+	}
+	n := C.opus_decode(d.ptr, data, C.opus_int32(len(packet)),
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)/d.channels), fec)
+	if n < 0 {
+		return 0, opusError(n)
+	}
+	return int(n), nil
+}
+
+func (d *decoder) Decode(packet []byte, pcm []int16) (int, error) { return d.decode(packet, pcm, 0) }
+
+func (d *decoder) DecodeFEC(packet []byte, pcm []int16) (int, error) {
+	return d.decode(packet, pcm, 1)
+}
+
+func (d *decoder) Close() {
+	C.opus_decoder_destroy(d.ptr)
+}
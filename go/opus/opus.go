@@ -0,0 +1,60 @@
+package opus
+
+import "errors"
+
+// ErrUnavailable is returned when the gateway is built without libopus.
+var ErrUnavailable = errors.New("opus: built without libopus (tgvoip build tag)")
+
+// SampleRate is the rate Opus streams are coded at on RTP (RFC 7587).
+const SampleRate = 48000
+
+// MaxPacket is the largest Opus packet of a single frame.
+const MaxPacket = 1275
+
+// Bandwidths limit the audio bandwidth of the encoder.
+const (
+	BandwidthNarrow    = 4000
+	BandwidthMedium    = 6000
+	BandwidthWide      = 8000
+	BandwidthSuperWide = 12000
+	BandwidthFull      = 20000
+)
+
+// EncoderOptions configures an Encoder.
+type EncoderOptions struct {
+	Bitrate      int  // bits per second, 0 for the libopus default
+	FEC          bool // in-band forward error correction
+	PacketLoss   int  // expected loss in percent, tunes FEC
+	DTX          bool // discontinuous transmission during silence
+	MaxBandwidth int  // one of the Bandwidth constants, 0 for full band
+}
+
+// Encoder encodes 48 kHz PCM frames of 2.5 to 60 ms.
+type Encoder interface {
+	// Encode encodes one interleaved frame into dst and returns the
+	// packet length. Packets of at most two bytes need not be sent when
+	// DTX is enabled.
+	Encode(pcm []int16, dst []byte) (int, error)
+	Close()
+}
+
+// Decoder decodes Opus packets to 48 kHz PCM.
+type Decoder interface {
+	// Decode decodes packet into pcm and returns the samples per channel.
+	// A nil packet conceals a lost frame of len(pcm) samples.
+	Decode(packet []byte, pcm []int16) (int, error)
+	// DecodeFEC recovers the frame lost before packet from its in-band
+	// FEC data, concealing it if there is none.
+	DecodeFEC(packet []byte, pcm []int16) (int, error)
+	Close()
+}
+
+// NewEncoder creates an encoder of channels interleaved channels.
+func NewEncoder(channels int, opts EncoderOptions) (Encoder, error) {
+	return newEncoder(channels, opts)
+}
+
+// NewDecoder creates a decoder producing channels interleaved channels.
+func NewDecoder(channels int) (Decoder, error) {
+	return newDecoder(channels)
+}
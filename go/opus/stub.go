@@ -0,0 +1,10 @@
+//go:build !tgvoip
+
+package opus
+
+// Without the tgvoip build tag libopus is not linked and Opus is not
+// available.
+
+func newEncoder(channels int, opts EncoderOptions) (Encoder, error) { return nil, ErrUnavailable }
+
+func newDecoder(channels int) (Decoder, error) { return nil, ErrUnavailable }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"strings"
+)
+
+// PhoneRules normalizes dialed phone numbers to E.164 using a default
+// country code and the trunk and international prefixes of the local dial
+// plan, e.g. 89161234567 or 0079161234567 become +79161234567.
+type PhoneRules struct {
+	countryCode string
+	trunkPrefix string
+	intlPrefix  string
+	validate    bool
+}
+
+// NewPhoneRules creates PhoneRules. Empty prefixes disable the matching
+// rewrite; validate enables checking numbers against known country codes.
+func NewPhoneRules(countryCode, trunkPrefix, intlPrefix string, validate bool) *PhoneRules {
+	return &PhoneRules{
+		countryCode: strings.TrimPrefix(countryCode, "+"),
+		trunkPrefix: trunkPrefix,
+		intlPrefix:  intlPrefix,
+		validate:    validate,
+	}
+}
+
+// phoneSeparators are stripped from dialed numbers.
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+
+// IsPhone reports whether a dialed extension is a phone number: it starts
+// with "+", or with the international or trunk prefix and is a valid E.164
+// number once normalized. The check keeps Telegram IDs that happen to start
+// with a prefix digit from being dialed as phone numbers.
+func (r *PhoneRules) IsPhone(ext string) bool {
+	ext = phoneSeparators.Replace(ext)
+	if strings.HasPrefix(ext, "+") {
+		return isDigits(ext[1:])
+	}
+	if !isDigits(ext) {
+		return false
+	}
+	prefixed := r.intlPrefix != "" && strings.HasPrefix(ext, r.intlPrefix) ||
+		r.countryCode != "" && r.trunkPrefix != "" && strings.HasPrefix(ext, r.trunkPrefix)
+	if !prefixed {
+		return false
+	}
+	phone, _ := r.Normalize(ext)
+	return phone != "" && validE164(phone[1:])
+}
+
+// Normalize converts a phone number to E.164 form with a leading "+". Bare
+// digits are taken as an international number, or as a national one if
+// only that is valid. The second result is false for numbers failing
+// validation.
+func (r *PhoneRules) Normalize(number string) (string, bool) {
+	number = phoneSeparators.Replace(strings.TrimSpace(number))
+	var digits string
+	switch {
+	case number == "":
+		return "", false
+	case strings.HasPrefix(number, "+"):
+		digits = number[1:]
+	case r.intlPrefix != "" && strings.HasPrefix(number, r.intlPrefix):
+		digits = number[len(r.intlPrefix):]
+	case r.countryCode != "" && r.trunkPrefix != "" && strings.HasPrefix(number, r.trunkPrefix):
+		digits = r.countryCode + number[len(r.trunkPrefix):]
+	case r.countryCode != "" && !validE164(number) && validE164(r.countryCode+number):
+		digits = r.countryCode + number
+	default:
+		digits = number
+	}
+	if !isDigits(digits) {
+		return "", false
+	}
+	if r.validate && !validE164(digits) {
+		return "+" + digits, false
+	}
+	return "+" + digits, true
+}
+
+func isDigits(s string) bool {
+	return s != "" && digitsOnly.MatchString(s)
+}
+
+// validE164 checks digits (without "+") for an assigned country calling code
+// and a plausible national number length.
+func validE164(digits string) bool {
+	if len(digits) < 7 || len(digits) > 15 || digits[0] == '0' {
+		return false
+	}
+	for n := 1; n <= 3; n++ {
+		cc := digits[:n]
+		if !countryCodes[cc] {
+			continue
+		}
+		nsn := len(digits) - n
+		if l, ok := nsnLengths[cc]; ok {
+			return nsn >= l[0] && nsn <= l[1]
+		}
+		return nsn >= 4
+	}
+	return false
+}
+
+// nsnLengths lists national significant number lengths of countries where
+// they are well defined.
+var nsnLengths = map[string][2]int{
+	"1":   {10, 10},
+	"7":   {10, 10},
+	"20":  {8, 10},
+	"27":  {9, 9},
+	"30":  {10, 10},
+	"31":  {9, 9},
+	"32":  {8, 9},
+	"33":  {9, 9},
+	"34":  {9, 9},
+	"36":  {8, 9},
+	"39":  {6, 11},
+	"40":  {9, 9},
+	"41":  {9, 9},
+	"43":  {4, 13},
+	"44":  {9, 10},
+	"45":  {8, 8},
+	"46":  {7, 13},
+	"47":  {8, 8},
+	"48":  {9, 9},
+	"49":  {6, 13},
+	"52":  {10, 10},
+	"55":  {10, 11},
+	"61":  {9, 9},
+	"62":  {8, 12},
+	"81":  {9, 10},
+	"82":  {8, 10},
+	"86":  {5, 12},
+	"90":  {10, 10},
+	"91":  {10, 10},
+	"98":  {10, 10},
+	"351": {9, 9},
+	"353": {7, 9},
+	"358": {5, 12},
+	"370": {8, 8},
+	"371": {8, 8},
+	"372": {7, 8},
+	"373": {8, 8},
+	"374": {8, 8},
+	"375": {9, 9},
+	"380": {9, 9},
+	"420": {9, 9},
+	"421": {9, 9},
+	"971": {8, 9},
+	"972": {8, 9},
+	"992": {9, 9},
+	"993": {8, 8},
+	"994": {9, 9},
+	"995": {9, 9},
+	"996": {9, 9},
+	"998": {9, 9},
+}
+
+// countryCodes is the set of assigned ITU-T E.164 country calling codes.
+var countryCodes = func() map[string]bool {
+	codes := strings.Fields(`
+		1 7 20 27 30 31 32 33 34 36 39 40 41 43 44 45 46 47 48 49 51 52 53 54 55
+		56 57 58 60 61 62 63 64 65 66 81 82 84 86 90 91 92 93 94 95 98
+		211 212 213 216 218 220 221 222 223 224 225 226 227 228 229 230 231 232
+		233 234 235 236 237 238 239 240 241 242 243 244 245 246 247 248 249 250
+		251 252 253 254 255 256 257 258 260 261 262 263 264 265 266 267 268 269
+		290 291 297 298 299 350 351 352 353 354 355 356 357 358 359 370 371 372
+		373 374 375 376 377 378 379 380 381 382 383 385 386 387 389 420 421 423
+		500 501 502 503 504 505 506 507 508 509 590 591 592 593 594 595 596 597
+		598 599 670 672 673 674 675 676 677 678 679 680 681 682 683 685 686 687
+		688 689 690 691 692 800 808 850 852 853 855 856 870 878 880 881 882 883
+		886 888 960 961 962 963 964 965 966 967 968 970 971 972 973 974 975 976
+		977 979 992 993 994 995 996 998`)
+	m := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		m[c] = true
+	}
+	return m
+}()
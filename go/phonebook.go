@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// phonebookCheckInterval is how often the phonebook file is checked for
+// changes.
+const phonebookCheckInterval = 30 * time.Second
+
+// Phonebook maps speed-dial extensions and aliases to dial targets such as
+// tg#username, +phone or a Telegram ID. Entries may be bound to a single
+// account. It is safe for concurrent use.
+type Phonebook struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]string // "account\x00extension" -> target
+	modTime time.Time
+}
+
+// NewPhonebook loads the phonebook at path. An empty path yields an empty
+// phonebook.
+func NewPhonebook(path string) *Phonebook {
+	p := &Phonebook{path: path, entries: make(map[string]string)}
+	if path == "" {
+		return p
+	}
+	if err := p.Reload(); err != nil {
+		coreLog.Warnf("load phonebook %s: %v", path, err)
+	}
+	return p
+}
+
+func phonebookKey(account, ext string) string {
+	return account + "\x00" + strings.ToLower(ext)
+}
+
+// Lookup returns the target for ext on account. Entries bound to the
+// account take precedence over global ones.
+func (p *Phonebook) Lookup(account, ext string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if t, ok := p.entries[phonebookKey(account, ext)]; ok {
+		return t, true
+	}
+	t, ok := p.entries[phonebookKey("", ext)]
+	return t, ok
+}
+
+// Reload reads the phonebook file and replaces all entries. The old entries
+// are kept if the file cannot be parsed.
+func (p *Phonebook) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	entries := make(map[string]string)
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(rec) < 2 || len(rec) > 3 {
+			line, _ := r.FieldPos(0)
+			return fmt.Errorf("line %d: want extension,target[,account]", line)
+		}
+		ext, target := strings.TrimSpace(rec[0]), strings.TrimSpace(rec[1])
+		account := ""
+		if len(rec) == 3 {
+			account = strings.TrimSpace(rec[2])
+		}
+		if ext == "" || target == "" {
+			continue
+		}
+		if strings.HasPrefix(target, "@") {
+			target = "tg#" + target[1:]
+		}
+		entries[phonebookKey(account, ext)] = target
+	}
+
+	p.mu.Lock()
+	p.entries = entries
+	p.modTime = st.ModTime()
+	p.mu.Unlock()
+	coreLog.Infof("loaded %d phonebook entries from %s", len(entries), p.path)
+	return nil
+}
+
+// Watch reloads the phonebook on SIGHUP and whenever the file modification
+// time changes until ctx is done.
+func (p *Phonebook) Watch(ctx context.Context) {
+	if p.path == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(phonebookCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			st, err := os.Stat(p.path)
+			if err != nil {
+				continue
+			}
+			p.mu.RLock()
+			unchanged := st.ModTime().Equal(p.modTime)
+			p.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+		if err := p.Reload(); err != nil {
+			coreLog.Warnf("reload phonebook %s: %v", p.path, err)
+		}
+	}
+}
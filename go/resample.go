@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// resampler converts PCM between 48 kHz, the rate of tgvoip, and a codec
+// rate that divides it. It is a polyphase FIR with a Kaiser windowed sinc
+// low-pass (about 70 dB stopband) that keeps its history across frames, so
+// consecutive frames join without clicks. A resampler is not safe for
+// concurrent use.
+type resampler struct {
+	ratio int
+	up    bool
+	taps  []float32
+	hist  []float32 // down: unconsumed input, up: last inputs, newest first
+}
+
+// resamplerTapsPerPhase sets the filter length relative to the ratio. The
+// transition band is roughly 700 Hz wide for 8 kHz and 1.4 kHz for 16 kHz.
+const resamplerTapsPerPhase = 48
+
+// newResampler returns a resampler from rate from to rate to, nil if they
+// are equal. One of them must be a multiple of the other.
+func newResampler(from, to int) (*resampler, error) {
+	switch {
+	case from == to:
+		return nil, nil
+	case from > to && from%to == 0:
+		r := &resampler{ratio: from / to}
+		r.taps = lowpass(r.ratio*resamplerTapsPerPhase, 0.5/float64(r.ratio)*0.91)
+		r.hist = make([]float32, len(r.taps)-1)
+		return r, nil
+	case to > from && to%from == 0:
+		r := &resampler{ratio: to / from, up: true}
+		r.taps = lowpass(r.ratio*resamplerTapsPerPhase, 0.5/float64(r.ratio)*0.91)
+		for i := range r.taps {
+			r.taps[i] *= float32(r.ratio)
+		}
+		r.hist = make([]float32, resamplerTapsPerPhase)
+		return r, nil
+	}
+	return nil, fmt.Errorf("cannot resample %d Hz to %d Hz", from, to)
+}
+
+// lowpass designs an n tap low-pass filter with cutoff fc relative to the
+// sampling rate and unity DC gain.
+func lowpass(n int, fc float64) []float32 {
+	const beta = 7.0
+	taps := make([]float64, n)
+	sum := 0.0
+	mid := float64(n-1) / 2
+	for i := range taps {
+		t := float64(i) - mid
+		sinc := 2 * fc
+		if t != 0 {
+			sinc = math.Sin(2*math.Pi*fc*t) / (math.Pi * t)
+		}
+		x := t / mid
+		taps[i] = sinc * besselI0(beta*math.Sqrt(1-x*x)) / besselI0(beta)
+		sum += taps[i]
+	}
+	out := make([]float32, n)
+	for i, v := range taps {
+		out[i] = float32(v / sum)
+	}
+	return out
+}
+
+// besselI0 is the modified Bessel function of the first kind of order zero.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+	}
+	return sum
+}
+
+// Process appends the resampled src to dst. When downsampling, input that
+// does not fill an output sample is kept for the next call.
+func (r *resampler) Process(dst, src []int16) []int16 {
+	if r.up {
+		return r.interpolate(dst, src)
+	}
+	for _, s := range src {
+		r.hist = append(r.hist, float32(s))
+	}
+	n := len(r.taps)
+	i := 0
+	for ; i+n <= len(r.hist); i += r.ratio {
+		var acc float32
+		for j, t := range r.taps {
+			acc += t * r.hist[i+j]
+		}
+		dst = append(dst, clampSample(acc))
+	}
+	r.hist = r.hist[:copy(r.hist, r.hist[i:])]
+	return dst
+}
+
+func (r *resampler) interpolate(dst, src []int16) []int16 {
+	k := len(r.hist)
+	for _, s := range src {
+		copy(r.hist[1:], r.hist[:k-1])
+		r.hist[0] = float32(s)
+		for p := range r.ratio {
+			var acc float32
+			for i, h := range r.hist {
+				acc += r.taps[p+i*r.ratio] * h
+			}
+			dst = append(dst, clampSample(acc))
+		}
+	}
+	return dst
+}
+
+func clampSample(v float32) int16 {
+	switch {
+	case v >= math.MaxInt16:
+		return math.MaxInt16
+	case v <= math.MinInt16:
+		return math.MinInt16
+	}
+	return int16(math.Round(float64(v)))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// dnsNegativeTTL is how long failed lookups are cached.
+const dnsNegativeTTL = 60 * time.Second
+
+// sipTarget is a resolved next hop of a SIP request.
+type sipTarget struct {
+	Transport string // "udp" or "tcp"
+	Addr      string // ip:port
+}
+
+// naptrServices maps supported NAPTR services to transports. TLS is not
+// offered because the gateway has no TLS transport configured.
+var naptrServices = map[string]string{
+	"SIP+D2U": "udp",
+	"SIP+D2T": "tcp",
+}
+
+// SIPResolver locates SIP servers as described in RFC 3263: NAPTR, then SRV,
+// then A/AAAA records, ordered by priority and weight. Answers are cached
+// for their TTL. It is safe for concurrent use.
+type SIPResolver struct {
+	dns dnsClient
+
+	mu    sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	records []dnsRecord
+	err     error
+	expires time.Time
+}
+
+// NewSIPResolver creates a resolver using dns for lookups.
+func NewSIPResolver(dns dnsClient) *SIPResolver {
+	return &SIPResolver{dns: dns, cache: make(map[string]dnsCacheEntry)}
+}
+
+// query returns cached records of name and qtype or asks the DNS client.
+func (r *SIPResolver) query(ctx context.Context, name string, qtype uint16) ([]dnsRecord, error) {
+	key := strconv.Itoa(int(qtype)) + " " + strings.ToLower(strings.TrimSuffix(name, "."))
+	now := time.Now()
+	r.mu.Lock()
+	if e, ok := r.cache[key]; ok && now.Before(e.expires) {
+		r.mu.Unlock()
+		return e.records, e.err
+	}
+	r.mu.Unlock()
+
+	records, err := r.dns.Query(ctx, name, qtype)
+	ttl := dnsNegativeTTL
+	switch {
+	case err == nil:
+		ttl = records[0].TTL
+		for _, rr := range records[1:] {
+			if rr.TTL < ttl {
+				ttl = rr.TTL
+			}
+		}
+	case !errors.Is(err, errDNSNotFound):
+		// Do not cache timeouts and server failures.
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[key] = dnsCacheEntry{records: records, err: err, expires: now.Add(ttl)}
+	r.mu.Unlock()
+	return records, err
+}
+
+// Resolve returns the targets for uri in the order they should be tried.
+func (r *SIPResolver) Resolve(ctx context.Context, uri sip.Uri) ([]sipTarget, error) {
+	host := strings.Trim(uri.Host(), "[]")
+	transport := ""
+	if params := uri.UriParams(); params != nil {
+		if v, ok := params.Get("transport"); ok && v != nil {
+			transport = strings.ToLower(v.String())
+		}
+	}
+	if uri.IsEncrypted() || transport == "tls" {
+		return nil, fmt.Errorf("resolve %s: TLS transport is not supported", uri)
+	}
+	if transport != "" && transport != "udp" && transport != "tcp" {
+		return nil, fmt.Errorf("resolve %s: unsupported transport %s", uri, transport)
+	}
+
+	// A numeric host or an explicit port skip NAPTR and SRV (RFC 3263 4.2).
+	if ip := net.ParseIP(host); ip != nil || uri.Port() != nil {
+		if transport == "" {
+			transport = "udp"
+		}
+		port := 5060
+		if uri.Port() != nil {
+			port = int(*uri.Port())
+		}
+		return r.hostTargets(ctx, host, port, transport)
+	}
+
+	var srvs []srvName
+	if transport == "" {
+		srvs = r.naptr(ctx, host)
+	}
+	if len(srvs) == 0 {
+		for _, tp := range []string{"udp", "tcp"} {
+			if transport == "" || transport == tp {
+				srvs = append(srvs, srvName{name: "_sip._" + tp + "." + host, transport: tp})
+			}
+		}
+	}
+
+	var targets []sipTarget
+	for _, s := range srvs {
+		records, err := r.query(ctx, s.name, dnsTypeSRV)
+		if err != nil {
+			continue
+		}
+		for _, rr := range orderSRV(records) {
+			if rr.Target == "" || rr.Target == "." {
+				// The service is decidedly not available.
+				continue
+			}
+			t, err := r.hostTargets(ctx, rr.Target, int(rr.Port), s.transport)
+			if err != nil {
+				coreLog.Debugf("resolve SRV target %s: %v", rr.Target, err)
+				continue
+			}
+			targets = append(targets, t...)
+		}
+		if len(targets) > 0 {
+			return targets, nil
+		}
+	}
+
+	if transport == "" {
+		transport = "udp"
+	}
+	return r.hostTargets(ctx, host, 5060, transport)
+}
+
+type srvName struct {
+	name      string
+	transport string
+}
+
+// naptr returns SRV names of supported services in NAPTR order.
+func (r *SIPResolver) naptr(ctx context.Context, host string) []srvName {
+	records, err := r.query(ctx, host, dnsTypeNAPTR)
+	if err != nil {
+		return nil
+	}
+	sorted := append([]dnsRecord(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Order != sorted[j].Order {
+			return sorted[i].Order < sorted[j].Order
+		}
+		return sorted[i].Preference < sorted[j].Preference
+	})
+	var names []srvName
+	for _, rr := range sorted {
+		tp, ok := naptrServices[strings.ToUpper(rr.Service)]
+		if !ok || !strings.EqualFold(rr.Flags, "s") || rr.Replacement == "" {
+			continue
+		}
+		names = append(names, srvName{name: rr.Replacement, transport: tp})
+	}
+	return names
+}
+
+// hostTargets resolves host to addresses, IPv4 first.
+func (r *SIPResolver) hostTargets(ctx context.Context, host string, port int, transport string) ([]sipTarget, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []sipTarget{{Transport: transport, Addr: net.JoinHostPort(ip.String(), strconv.Itoa(port))}}, nil
+	}
+	var targets []sipTarget
+	var lastErr error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		records, err := r.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range records {
+			targets = append(targets, sipTarget{Transport: transport, Addr: net.JoinHostPort(rr.IP.String(), strconv.Itoa(port))})
+		}
+	}
+	if len(targets) == 0 {
+		// Fall back to the system resolver for names from /etc/hosts.
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", host, lastErr)
+		}
+		for _, a := range addrs {
+			targets = append(targets, sipTarget{Transport: transport, Addr: net.JoinHostPort(a.IP.String(), strconv.Itoa(port))})
+		}
+	}
+	return targets, nil
+}
+
+// orderSRV sorts SRV records by priority and orders records of equal
+// priority by the weighted random selection of RFC 2782.
+func orderSRV(records []dnsRecord) []dnsRecord {
+	sorted := append([]dnsRecord(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+
+	ordered := make([]dnsRecord, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		group := sorted[start:end]
+		for len(group) > 0 {
+			total := 0
+			for _, rr := range group {
+				total += int(rr.Weight)
+			}
+			pick := 0
+			if total > 0 {
+				n := rand.Intn(total + 1)
+				for sum := 0; pick < len(group); pick++ {
+					sum += int(group[pick].Weight)
+					if sum >= n {
+						break
+					}
+				}
+				if pick == len(group) {
+					pick = len(group) - 1
+				}
+			}
+			ordered = append(ordered, group[pick])
+			group = append(group[:pick:pick], group[pick+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// fakeDNS answers queries from a fixed table and counts them. Names missing
+// from the table do not exist.
+type fakeDNS struct {
+	answers map[string]fakeAnswer
+	queries map[string]int
+}
+
+type fakeAnswer struct {
+	records []dnsRecord
+	err     error
+}
+
+func newFakeDNS(answers map[string]fakeAnswer) *fakeDNS {
+	return &fakeDNS{answers: answers, queries: make(map[string]int)}
+}
+
+func fakeKey(name string, qtype uint16) string {
+	return strconv.Itoa(int(qtype)) + " " + name
+}
+
+func (d *fakeDNS) Query(_ context.Context, name string, qtype uint16) ([]dnsRecord, error) {
+	key := fakeKey(name, qtype)
+	d.queries[key]++
+	a, ok := d.answers[key]
+	if !ok {
+		return nil, errDNSNotFound
+	}
+	return a.records, a.err
+}
+
+func aRecord(ip string) dnsRecord {
+	return dnsRecord{Type: dnsTypeA, TTL: time.Minute, IP: net.ParseIP(ip)}
+}
+
+func aaaaRecord(ip string) dnsRecord {
+	return dnsRecord{Type: dnsTypeAAAA, TTL: time.Minute, IP: net.ParseIP(ip)}
+}
+
+func srvRecord(priority, weight, port uint16, target string) dnsRecord {
+	return dnsRecord{Type: dnsTypeSRV, TTL: time.Minute, Priority: priority, Weight: weight, Port: port, Target: target}
+}
+
+func naptrRecord(order, pref uint16, service, replacement string) dnsRecord {
+	return dnsRecord{Type: dnsTypeNAPTR, TTL: time.Minute, Order: order, Preference: pref, Flags: "s", Service: service, Replacement: replacement}
+}
+
+func TestSIPResolverResolve(t *testing.T) {
+	answers := map[string]fakeAnswer{
+		fakeKey("example.com", dnsTypeNAPTR): {records: []dnsRecord{
+			naptrRecord(20, 10, "SIP+D2U", "_sip._udp.example.com"),
+			naptrRecord(5, 10, "SIPS+D2T", "_sips._tcp.example.com"),
+			naptrRecord(10, 10, "SIP+D2T", "_sip._tcp.example.com"),
+		}},
+		fakeKey("_sip._tcp.example.com", dnsTypeSRV): {records: []dnsRecord{
+			srvRecord(20, 0, 5080, "pbx2.example.com"),
+			srvRecord(10, 0, 5070, "pbx1.example.com"),
+		}},
+		fakeKey("_sip._udp.example.com", dnsTypeSRV): {records: []dnsRecord{
+			srvRecord(10, 0, 5060, "pbx3.example.com"),
+		}},
+		fakeKey("_sip._udp.example.net", dnsTypeSRV): {records: []dnsRecord{
+			srvRecord(10, 0, 5062, "pbx1.example.com"),
+		}},
+		fakeKey("_sip._tcp.example.net", dnsTypeSRV): {records: []dnsRecord{
+			srvRecord(10, 0, 5063, "pbx2.example.com"),
+		}},
+		fakeKey("pbx1.example.com", dnsTypeA):    {records: []dnsRecord{aRecord("192.0.2.1")}},
+		fakeKey("pbx1.example.com", dnsTypeAAAA): {records: []dnsRecord{aaaaRecord("2001:db8::1")}},
+		fakeKey("pbx2.example.com", dnsTypeA):    {records: []dnsRecord{aRecord("192.0.2.2")}},
+		fakeKey("pbx3.example.com", dnsTypeA):    {records: []dnsRecord{aRecord("192.0.2.3")}},
+		fakeKey("example.com", dnsTypeA):         {records: []dnsRecord{aRecord("192.0.2.10")}},
+		fakeKey("example.org", dnsTypeA):         {records: []dnsRecord{aRecord("192.0.2.20")}},
+	}
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    []sipTarget
+		wantErr bool
+	}{
+		{
+			name: "NAPTR then SRV then A and AAAA",
+			uri:  "sip:example.com",
+			want: []sipTarget{
+				{Transport: "tcp", Addr: "192.0.2.1:5070"},
+				{Transport: "tcp", Addr: "[2001:db8::1]:5070"},
+				{Transport: "tcp", Addr: "192.0.2.2:5080"},
+			},
+		},
+		{
+			name: "SRV without NAPTR",
+			uri:  "sip:example.net",
+			want: []sipTarget{{Transport: "udp", Addr: "192.0.2.1:5062"}, {Transport: "udp", Addr: "[2001:db8::1]:5062"}},
+		},
+		{
+			name: "transport parameter skips NAPTR",
+			uri:  "sip:example.net;transport=tcp",
+			want: []sipTarget{{Transport: "tcp", Addr: "192.0.2.2:5063"}},
+		},
+		{
+			name: "A record without SRV",
+			uri:  "sip:example.org",
+			want: []sipTarget{{Transport: "udp", Addr: "192.0.2.20:5060"}},
+		},
+		{
+			name: "explicit port skips NAPTR and SRV",
+			uri:  "sip:example.com:5090",
+			want: []sipTarget{{Transport: "udp", Addr: "192.0.2.10:5090"}},
+		},
+		{
+			name: "numeric host",
+			uri:  "sip:192.0.2.5",
+			want: []sipTarget{{Transport: "udp", Addr: "192.0.2.5:5060"}},
+		},
+		{
+			name:    "TLS is not supported",
+			uri:     "sips:example.com",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewSIPResolver(newFakeDNS(answers))
+			got, err := r.Resolve(context.Background(), mustParseURI(t, tt.uri))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Resolve(%s) = %v, want error", tt.uri, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve(%s): %v", tt.uri, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve(%s) = %v, want %v", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderSRV(t *testing.T) {
+	records := []dnsRecord{
+		srvRecord(20, 0, 1, "backup"),
+		srvRecord(10, 60, 2, "a"),
+		srvRecord(10, 30, 3, "b"),
+		srvRecord(10, 10, 4, "c"),
+	}
+	const runs = 10000
+	first := make(map[string]int)
+	for i := 0; i < runs; i++ {
+		ordered := orderSRV(records)
+		if len(ordered) != len(records) {
+			t.Fatalf("orderSRV returned %d records, want %d", len(ordered), len(records))
+		}
+		if last := ordered[len(ordered)-1].Target; last != "backup" {
+			t.Fatalf("lowest priority record is %s, want backup last", last)
+		}
+		seen := make(map[string]bool)
+		for _, rr := range ordered {
+			if seen[rr.Target] {
+				t.Fatalf("orderSRV repeated %s: %v", rr.Target, ordered)
+			}
+			seen[rr.Target] = true
+		}
+		first[ordered[0].Target]++
+	}
+	// Weights 60/30/10 out of 100, one draw in 101 falls on the first
+	// record for the inclusive zero of RFC 2782.
+	for target, want := range map[string]float64{"a": 0.6, "b": 0.3, "c": 0.1} {
+		got := float64(first[target]) / runs
+		if got < want-0.03 || got > want+0.03 {
+			t.Errorf("%s picked first in %.3f of runs, want about %.2f", target, got, want)
+		}
+	}
+}
+
+func TestSIPResolverCache(t *testing.T) {
+	timeout := &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+	tests := []struct {
+		name   string
+		answer fakeAnswer
+		wait   time.Duration
+		want   int // queries sent for two lookups
+	}{
+		{
+			name:   "answer cached for its TTL",
+			answer: fakeAnswer{records: []dnsRecord{{Type: dnsTypeA, TTL: time.Minute, IP: net.ParseIP("192.0.2.1")}}},
+			want:   1,
+		},
+		{
+			name:   "answer expires after its TTL",
+			answer: fakeAnswer{records: []dnsRecord{{Type: dnsTypeA, TTL: 10 * time.Millisecond, IP: net.ParseIP("192.0.2.1")}}},
+			wait:   20 * time.Millisecond,
+			want:   2,
+		},
+		{
+			name:   "missing name cached",
+			answer: fakeAnswer{err: errDNSNotFound},
+			want:   1,
+		},
+		{
+			name:   "timeout not cached",
+			answer: fakeAnswer{err: timeout},
+			want:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dns := newFakeDNS(map[string]fakeAnswer{fakeKey("pbx.example.com", dnsTypeA): tt.answer})
+			r := NewSIPResolver(dns)
+			for i := 0; i < 2; i++ {
+				if i > 0 {
+					time.Sleep(tt.wait)
+				}
+				_, err := r.query(context.Background(), "pbx.example.com", dnsTypeA)
+				if !errors.Is(err, tt.answer.err) {
+					t.Fatalf("query error = %v, want %v", err, tt.answer.err)
+				}
+			}
+			if got := dns.queries[fakeKey("pbx.example.com", dnsTypeA)]; got != tt.want {
+				t.Errorf("sent %d queries, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialResultFailover(t *testing.T) {
+	tests := []struct {
+		name   string
+		result DialResult
+		want   bool
+	}{
+		{"transaction timeout", DialResult{Err: errors.New("transaction timed out")}, true},
+		{"503", DialResult{Response: testResponse(503)}, true},
+		{"486", DialResult{Response: testResponse(486)}, false},
+		{"603", DialResult{Response: testResponse(603)}, false},
+		{"200", DialResult{Response: testResponse(200)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.result.failover(); got != tt.want {
+				t.Errorf("failover() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustParseURI(t *testing.T, s string) sip.Uri {
+	t.Helper()
+	uri, err := parser.ParseUri(s)
+	if err != nil {
+		t.Fatalf("parse %s: %v", s, err)
+	}
+	return uri
+}
+
+func testResponse(code int) sip.Response {
+	return sip.NewResponse("", "SIP/2.0", sip.StatusCode(code), "", nil, "", nil)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"tg2sip/tgvoip"
+)
+
+// The ringback tone played as early media: 425 Hz, one second on and four
+// seconds off (ITU-T E.180), at about -12 dBFS.
+const (
+	ringbackFreq   = 425
+	ringbackOn     = time.Second
+	ringbackPeriod = 5 * time.Second
+	ringbackLevel  = 8000
+)
+
+// ringback plays the ringback tone to the SIP peer of a call through the
+// negotiated codec until it is stopped.
+type ringback struct {
+	bridge *rtpBridge
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// startRingback starts the tone on the RTP stream of ctx, which must have
+// negotiated its media.
+func startRingback(ctx *Context, opts codecOptions) (*ringback, error) {
+	b, err := newRTPBridge(ctx, opts, jitterOptions{})
+	if err != nil {
+		return nil, err
+	}
+	r := &ringback{bridge: b, done: make(chan struct{})}
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+func (r *ringback) run() {
+	defer r.wg.Done()
+	frame := make([]int16, tgvoip.FrameSize)
+	ticker := time.NewTicker(time.Duration(tgvoip.FrameSize) * time.Second / tgvoipRate)
+	defer ticker.Stop()
+	on := int(ringbackOn * tgvoipRate / time.Second)
+	period := int(ringbackPeriod * tgvoipRate / time.Second)
+	n := 0 // samples into the cadence
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		for i := range frame {
+			frame[i] = 0
+			if n < on {
+				frame[i] = int16(ringbackLevel * math.Sin(2*math.Pi*ringbackFreq*float64(n)/tgvoipRate))
+			}
+			n = (n + 1) % period
+		}
+		r.bridge.send(frame)
+	}
+}
+
+// Stop ends the tone and releases the codec. The RTP stream may be used by
+// the call bridge afterwards.
+func (r *ringback) Stop() {
+	close(r.done)
+	r.wg.Wait()
+	r.bridge.codec.CloseEncoder()
+	r.bridge.codec.CloseDecoder()
+}
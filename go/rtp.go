@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"tg2sip/tgvoip"
+)
+
+const (
+	rtpVersion = 2
+	// rtpMaxPacket bounds received datagrams; audio packets are far smaller.
+	rtpMaxPacket = 1500
+)
+
+// rtpHeader is the fixed part of an RTP header (RFC 3550 5.1).
+type rtpHeader struct {
+	Marker    bool
+	Type      uint8
+	Seq       uint16
+	Timestamp uint32
+	SSRC      uint32
+}
+
+// appendRTP appends a packet with header h and payload to dst.
+func appendRTP(dst []byte, h rtpHeader, payload []byte) []byte {
+	b1 := h.Type & 0x7f
+	if h.Marker {
+		b1 |= 0x80
+	}
+	dst = append(dst, rtpVersion<<6, b1)
+	dst = binary.BigEndian.AppendUint16(dst, h.Seq)
+	dst = binary.BigEndian.AppendUint32(dst, h.Timestamp)
+	dst = binary.BigEndian.AppendUint32(dst, h.SSRC)
+	return append(dst, payload...)
+}
+
+// parseRTP returns the header and payload of pkt. CSRCs and header
+// extensions are skipped and padding is removed.
+func parseRTP(pkt []byte) (rtpHeader, []byte, error) {
+	n, err := rtpHeaderLen(pkt)
+	if err != nil {
+		return rtpHeader{}, nil, err
+	}
+	if pkt[0]>>6 != rtpVersion {
+		return rtpHeader{}, nil, errors.New("not an RTP packet")
+	}
+	h := rtpHeader{
+		Marker:    pkt[1]&0x80 != 0,
+		Type:      pkt[1] & 0x7f,
+		Seq:       binary.BigEndian.Uint16(pkt[2:]),
+		Timestamp: binary.BigEndian.Uint32(pkt[4:]),
+		SSRC:      binary.BigEndian.Uint32(pkt[8:]),
+	}
+	payload := pkt[n:]
+	if pkt[0]&0x20 != 0 && len(payload) > 0 {
+		pad := int(payload[len(payload)-1])
+		if pad > len(payload) {
+			return rtpHeader{}, nil, errors.New("invalid RTP padding")
+		}
+		payload = payload[:len(payload)-pad]
+	}
+	return h, payload, nil
+}
+
+// activeBridges maps call IDs to the bridges of calls in progress, for the
+// rtp_calls metric.
+var activeBridges sync.Map
+
+func init() {
+	metrics.Set("rtp_calls", expvar.Func(func() any {
+		calls := make(map[string]jitterStats)
+		activeBridges.Range(func(k, v any) bool {
+			calls[k.(string)] = v.(*rtpBridge).jitter.Stats()
+			return true
+		})
+		return calls
+	}))
+}
+
+// rtpBridge carries the audio of a call between its tgvoip controller and
+// the RTP socket of the SIP leg. tgvoip exchanges 48 kHz frames with the
+// bridge through lock-free rings, so its audio thread never waits for
+// coding or the socket. Played frames are reframed to the negotiated packet
+// time and sent as RTP packets of the negotiated codec. Received packets
+// pass a jitter buffer and are decoded a few frames ahead of tgvoip, so
+// losses are concealed at playout time.
+type rtpBridge struct {
+	callID string
+	conn   *net.UDPConn
+	peer   *rtpLatch
+	srtp   *srtpSession
+	codec  *audioCodec
+	pt     uint8
+	rings  *tgvoip.AudioRings
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// Sending state, used from the sending goroutine only.
+	frame   int     // samples per packet at 48 kHz
+	pending []int16 // samples short of a packet
+	seq     uint16
+	ts      uint32
+	ssrc    uint32
+	marker  bool
+	payload []byte
+	packet  []byte
+
+	jitter *jitterBuffer
+
+	// Playout state, used from the playout goroutine only.
+	out []int16 // decoded audio not yet queued for tgvoip
+	fec []byte
+}
+
+const (
+	// rtpRingFrames is the capacity of the rings in each direction.
+	rtpRingFrames = 4
+	// rtpPlayoutFrames is the number of decoded frames kept queued for
+	// tgvoip, 40 ms ahead of its audio thread.
+	rtpPlayoutFrames = 2
+)
+
+// newRTPBridge creates the bridge of ctx. The RTP socket, negotiated codec,
+// packet time and remote address must be known.
+func newRTPBridge(ctx *Context, opts codecOptions, jopts jitterOptions) (*rtpBridge, error) {
+	codec, err := newAudioCodec(ctx.Codec, opts)
+	if err != nil {
+		return nil, err
+	}
+	var rnd [8]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return nil, err
+	}
+	frame := ctx.Ptime * tgvoipRate / 1000
+	return &rtpBridge{
+		callID:  ctx.ID,
+		conn:    ctx.Media.RTP,
+		peer:    ctx.RTPPeer,
+		srtp:    ctx.SRTP,
+		codec:   codec,
+		pt:      uint8(ctx.Codec.PT),
+		rings:   tgvoip.NewAudioRings(rtpRingFrames, jopts.ComfortNoise),
+		done:    make(chan struct{}),
+		frame:   frame,
+		pending: make([]int16, 0, frame+tgvoip.FrameSize),
+		out:     make([]int16, 0, frame+2*tgvoip.FrameSize),
+		jitter:  newJitterBuffer(ctx.Codec.Rate, jopts),
+		seq:     binary.BigEndian.Uint16(rnd[0:]),
+		ts:      binary.BigEndian.Uint32(rnd[2:]),
+		ssrc:    binary.BigEndian.Uint32(rnd[4:]),
+		marker:  true,
+	}, nil
+}
+
+// Start connects the bridge to ctrl and runs it until Close. RTP is
+// received until the socket is closed.
+func (b *rtpBridge) Start(ctrl tgvoip.Controller) {
+	activeBridges.Store(b.callID, b)
+	tgvoip.ConnectSIPMedia(ctrl, b.rings)
+	b.wg.Add(2)
+	go b.sendLoop()
+	go b.playoutLoop()
+	go b.receive()
+}
+
+// Close stops the bridge, releases the codec and records the statistics.
+// tgvoip must not use the rings any more.
+func (b *rtpBridge) Close() {
+	close(b.done)
+	b.wg.Wait()
+	activeBridges.Delete(b.callID)
+	b.codec.CloseEncoder()
+	b.codec.CloseDecoder()
+	s := b.jitter.Stats()
+	underflows, overflows := b.rings.Input.Underflows(), b.rings.Output.Overflows()
+	coreLog.Infof("call %s RTP: %d received, %d lost, %d late, %d dropped, %d concealed, %d underruns, jitter %.1f ms, ring %d underflows, %d overflows",
+		b.callID, s.Received, s.Lost, s.Late, s.Dropped, s.Concealed, s.Underruns, s.Jitter, underflows, overflows)
+	for name, v := range map[string]int64{
+		"rtp_received": s.Received, "rtp_lost": s.Lost, "rtp_late": s.Late,
+		"rtp_dropped": s.Dropped, "rtp_concealed": s.Concealed, "rtp_underruns": s.Underruns,
+		"rtp_ring_underflows": underflows, "rtp_ring_overflows": overflows,
+	} {
+		metrics.Add(name, v)
+	}
+}
+
+// sendLoop sends the frames tgvoip played until the bridge is closed.
+func (b *rtpBridge) sendLoop() {
+	defer b.wg.Done()
+	out := b.rings.Output
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-out.Ready():
+		}
+		for out.Len() > 0 {
+			b.send(out.Peek())
+			out.Release()
+		}
+	}
+}
+
+// playoutLoop keeps rtpPlayoutFrames frames of received audio queued for
+// tgvoip until the bridge is closed. The input callback signals the ring
+// whenever it takes a frame or finds none.
+func (b *rtpBridge) playoutLoop() {
+	defer b.wg.Done()
+	in := b.rings.Input
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-in.Ready():
+		}
+		for in.Len() < rtpPlayoutFrames {
+			f := in.Reserve()
+			if f == nil || !b.fill(f) {
+				break
+			}
+			in.Commit()
+		}
+	}
+}
+
+// send queues a frame played by tgvoip and sends every complete packet to
+// the SIP peer.
+func (b *rtpBridge) send(pcm []int16) {
+	if len(b.pending) == 0 && len(pcm) == b.frame {
+		b.sendPacket(pcm)
+		return
+	}
+	b.pending = append(b.pending, pcm...)
+	n := 0
+	for ; n+b.frame <= len(b.pending); n += b.frame {
+		b.sendPacket(b.pending[n : n+b.frame])
+	}
+	b.pending = b.pending[:copy(b.pending, b.pending[n:])]
+}
+
+// sendPacket encodes one packet time of audio. Empty payloads (Opus DTX)
+// are not sent; the next packet starts a talkspurt.
+func (b *rtpBridge) sendPacket(pcm []int16) {
+	b.payload = b.codec.Encode(b.payload[:0], pcm)
+	ts := b.ts
+	b.ts += b.codec.Timestamp(len(pcm))
+	if len(b.payload) == 0 {
+		b.marker = true
+		return
+	}
+	h := rtpHeader{Marker: b.marker, Type: b.pt, Seq: b.seq, Timestamp: ts, SSRC: b.ssrc}
+	b.packet = appendRTP(b.packet[:0], h, b.payload)
+	b.seq++
+	b.marker = false
+	pkt := b.packet
+	if b.srtp != nil {
+		var err error
+		if pkt, err = b.srtp.Protect(pkt); err != nil {
+			coreLog.Debugf("call %s SRTP protect: %v", b.callID, err)
+			return
+		}
+	}
+	if _, err := b.conn.WriteToUDP(pkt, b.peer.Remote()); err != nil {
+		coreLog.Debugf("call %s RTP send: %v", b.callID, err)
+	}
+}
+
+// fill plays out received audio into pcm and reports whether a whole frame
+// was available. Lost packets are concealed; while the jitter buffer fills
+// up nothing is queued and tgvoip gets silence or comfort noise.
+func (b *rtpBridge) fill(pcm []int16) bool {
+	for len(b.out) < len(pcm) && b.playout() {
+	}
+	if len(b.out) < len(pcm) {
+		return false
+	}
+	n := copy(pcm, b.out)
+	b.out = b.out[:copy(b.out, b.out[n:])]
+	return true
+}
+
+// playout decodes or conceals the next packet into b.out and reports
+// whether there was one.
+func (b *rtpBridge) playout() bool {
+	p, next, status := b.jitter.Pop(b.fec)
+	switch status {
+	case jitterPlay:
+		b.out = b.codec.Decode(b.out, p.payload)
+		b.jitter.Release(p)
+	case jitterLost, jitterUnderrun, jitterStretch:
+		b.fec = next
+		b.out = b.codec.Conceal(b.out, next, b.frame)
+		b.jitter.Concealed()
+	default:
+		return false
+	}
+	return true
+}
+
+// receive reads RTP of the SIP peer until the socket is closed.
+func (b *rtpBridge) receive() {
+	buf := make([]byte, rtpMaxPacket)
+	for {
+		n, src, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				coreLog.Warnf("call %s RTP receive: %v", b.callID, err)
+			}
+			return
+		}
+		pkt := buf[:n]
+		if b.srtp != nil {
+			if pkt, err = b.srtp.Unprotect(pkt); err != nil {
+				coreLog.Debugf("call %s SRTP unprotect: %v", b.callID, err)
+				continue
+			}
+		}
+		h, payload, err := parseRTP(pkt)
+		if err != nil || h.Type != b.pt || !b.peer.Received(src) {
+			continue
+		}
+		b.jitter.Push(h, payload, time.Now())
+	}
+}
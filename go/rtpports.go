@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// rtpUsageWarn is the share of port pairs in use above which the allocator
+// warns that the range is running out.
+const rtpUsageWarn = 0.8
+
+var errRTPPortsExhausted = errors.New("RTP port range exhausted")
+
+// mediaPorts are the RTP and RTCP sockets of a call. RTP uses an even port
+// and RTCP the odd port above it (RFC 3550 11).
+type mediaPorts struct {
+	RTP  *net.UDPConn
+	RTCP *net.UDPConn
+}
+
+// Port returns the RTP port.
+func (m *mediaPorts) Port() int {
+	return m.RTP.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (m *mediaPorts) Close() {
+	m.RTP.Close()
+	m.RTCP.Close()
+}
+
+// RTPPortAllocator hands out RTP/RTCP port pairs from a fixed range so that
+// firewall rules can cover media. Ports taken by other processes are
+// skipped. It is safe for concurrent use.
+type RTPPortAllocator struct {
+	host  string
+	first int // even port of the first pair
+	pairs int
+
+	mu     sync.Mutex
+	next   int // pair tried first by the next allocation
+	busy   map[int]bool
+	calls  map[string]*mediaPorts
+	warned bool
+}
+
+// NewRTPPortAllocator creates an allocator binding host for ports start to
+// end inclusive. An odd start is rounded up.
+func NewRTPPortAllocator(host string, start, end int) *RTPPortAllocator {
+	first := start + start%2
+	a := &RTPPortAllocator{
+		host:  host,
+		first: first,
+		pairs: (end - first + 1) / 2,
+		busy:  make(map[int]bool),
+		calls: make(map[string]*mediaPorts),
+	}
+	metrics.Set("rtp_pairs_total", expvarInt(int64(a.pairs)))
+	metrics.Set("rtp_pairs_used", expvarInt(0))
+	return a
+}
+
+// Allocate opens an RTP/RTCP socket pair for callID. Calling it again for
+// the same call returns the same sockets; the second result is only true
+// for the call that opened them, which is the one to release them.
+func (a *RTPPortAllocator) Allocate(callID string) (*mediaPorts, bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if m, ok := a.calls[callID]; ok {
+		return m, false, nil
+	}
+	for i := 0; i < a.pairs; i++ {
+		idx := (a.next + i) % a.pairs
+		if a.busy[idx] {
+			continue
+		}
+		m, err := a.listen(a.first + 2*idx)
+		if err != nil {
+			coreLog.Debugf("RTP port %d unavailable: %v", a.first+2*idx, err)
+			continue
+		}
+		a.busy[idx] = true
+		a.calls[callID] = m
+		a.next = idx + 1
+		a.report()
+		coreLog.Debugf("RTP ports %d/%d allocated to %s, %d of %d pairs in use",
+			m.Port(), m.Port()+1, callID, len(a.calls), a.pairs)
+		return m, true, nil
+	}
+	metrics.Add("rtp_exhausted", 1)
+	coreLog.Warnf("no free RTP ports for %s, %d of %d pairs in use", callID, len(a.calls), a.pairs)
+	return nil, false, errRTPPortsExhausted
+}
+
+func (a *RTPPortAllocator) listen(port int) (*mediaPorts, error) {
+	rtp, err := net.ListenPacket("udp", net.JoinHostPort(a.host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	rtcp, err := net.ListenPacket("udp", net.JoinHostPort(a.host, strconv.Itoa(port+1)))
+	if err != nil {
+		rtp.Close()
+		return nil, err
+	}
+	return &mediaPorts{RTP: rtp.(*net.UDPConn), RTCP: rtcp.(*net.UDPConn)}, nil
+}
+
+// Release closes the sockets of callID and returns its ports to the range.
+func (a *RTPPortAllocator) Release(callID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m, ok := a.calls[callID]
+	if !ok {
+		return
+	}
+	port := m.Port()
+	m.Close()
+	delete(a.calls, callID)
+	delete(a.busy, (port-a.first)/2)
+	a.report()
+	coreLog.Debugf("RTP ports %d/%d released by %s, %d of %d pairs in use",
+		port, port+1, callID, len(a.calls), a.pairs)
+}
+
+// Usage returns the number of pairs in use and in the range.
+func (a *RTPPortAllocator) Usage() (used, total int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.calls), a.pairs
+}
+
+// report publishes the usage and warns once when it crosses rtpUsageWarn.
+func (a *RTPPortAllocator) report() {
+	metrics.Set("rtp_pairs_used", expvarInt(int64(len(a.calls))))
+	high := float64(len(a.calls)) >= rtpUsageWarn*float64(a.pairs)
+	if high && !a.warned {
+		coreLog.Warnf("RTP port usage high: %d of %d pairs in use", len(a.calls), a.pairs)
+	}
+	a.warned = high
+}
+
+// String describes the port range for logs.
+func (a *RTPPortAllocator) String() string {
+	return fmt.Sprintf("%d-%d", a.first, a.first+2*a.pairs-1)
+}
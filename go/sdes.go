@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RTP transport profiles (RFC 3551, RFC 3711).
+const (
+	profileAVP  = "RTP/AVP"
+	profileSAVP = "RTP/SAVP"
+)
+
+var (
+	// errSRTPRequired means the peer offered or answered plain RTP on a
+	// trunk with the mandatory policy.
+	errSRTPRequired = errors.New("SRTP is mandatory but the peer does not offer it")
+	// errSRTPRefused means the peer insists on SRTP on a trunk where it
+	// is off.
+	errSRTPRefused = errors.New("peer requires SRTP which is disabled")
+)
+
+// offerSuites are offered in this order.
+var offerSuites = []string{suiteAES80, suiteAES32}
+
+// offerCrypto returns the profile and crypto attributes of an offer. With
+// the optional policy SDES keys are offered on RTP/AVP, so that peers
+// without SRTP support still accept the call (best-effort SRTP).
+func offerCrypto(policy string) (string, []*cryptoAttribute, error) {
+	if policy == srtpOff || policy == "" {
+		return profileAVP, nil, nil
+	}
+	var attrs []*cryptoAttribute
+	for i, suite := range offerSuites {
+		a, err := newCryptoAttribute(i+1, suite)
+		if err != nil {
+			return "", nil, err
+		}
+		attrs = append(attrs, a)
+	}
+	if policy == srtpMandatory {
+		return profileSAVP, attrs, nil
+	}
+	return profileAVP, attrs, nil
+}
+
+// addCrypto appends a=crypto attributes to m.
+func addCrypto(m *mediaDescription, attrs []*cryptoAttribute) {
+	for _, a := range attrs {
+		m.Attributes = append(m.Attributes, "crypto:"+a.String())
+	}
+}
+
+// mediaCrypto returns the parseable crypto attributes of m in order.
+func mediaCrypto(m *mediaDescription) []*cryptoAttribute {
+	var attrs []*cryptoAttribute
+	for _, v := range m.Attrs("crypto") {
+		a, err := parseCryptoAttribute(v)
+		if err != nil {
+			coreLog.Debugf("ignoring SDP crypto %q: %v", v, err)
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+// answerCrypto picks the crypto of an answer to offer under policy. It
+// returns the local attribute to put into the answer and the SRTP session,
+// both nil for plain RTP.
+func answerCrypto(offer *mediaDescription, policy string) (*cryptoAttribute, *srtpSession, error) {
+	offered := mediaCrypto(offer)
+	secure := offer.Proto == profileSAVP
+	if policy == srtpOff || policy == "" {
+		if secure {
+			return nil, nil, errSRTPRefused
+		}
+		return nil, nil, nil
+	}
+	for _, remote := range offered {
+		if !remote.supported() {
+			continue
+		}
+		local, err := newCryptoAttribute(remote.Tag, remote.Suite)
+		if err != nil {
+			return nil, nil, err
+		}
+		sess, err := newSRTPSession(local, remote)
+		if err != nil {
+			return nil, nil, err
+		}
+		return local, sess, nil
+	}
+	if secure || policy == srtpMandatory {
+		if len(offered) > 0 {
+			return nil, nil, fmt.Errorf("no supported crypto suite offered")
+		}
+		return nil, nil, errSRTPRequired
+	}
+	return nil, nil, nil
+}
+
+// acceptCrypto completes the negotiation of our offer with answer. It
+// returns the SRTP session, nil for plain RTP.
+func acceptCrypto(offered []*cryptoAttribute, answer *mediaDescription, policy string) (*srtpSession, error) {
+	answered := mediaCrypto(answer)
+	if len(offered) == 0 {
+		return nil, nil
+	}
+	for _, remote := range answered {
+		for _, local := range offered {
+			if local.Tag == remote.Tag && local.Suite == remote.Suite {
+				return newSRTPSession(local, remote)
+			}
+		}
+	}
+	if policy == srtpMandatory {
+		return nil, errSRTPRequired
+	}
+	return nil, nil
+}
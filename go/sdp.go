@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// sessionDescription is the part of an SDP body (RFC 4566) the gateway uses:
+// the session-level connection and the media sections.
+type sessionDescription struct {
+	Origin     string // o= value
+	Connection string // session-level c= value, empty if only media-level
+	Attributes []string
+	Media      []*mediaDescription
+}
+
+// mediaDescription is an m= section.
+type mediaDescription struct {
+	Type       string
+	Port       int
+	Proto      string
+	Formats    []string
+	Connection string   // media-level c= value
+	Attributes []string // a= values in order
+}
+
+var errNoAudio = errors.New("SDP has no active audio stream")
+
+// parseSDP parses an SDP body. Lines the gateway does not use are skipped.
+func parseSDP(body string) (*sessionDescription, error) {
+	s := &sessionDescription{}
+	var media *mediaDescription
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		v := line[2:]
+		switch line[0] {
+		case 'o':
+			s.Origin = v
+		case 'c':
+			if media != nil {
+				media.Connection = v
+			} else {
+				s.Connection = v
+			}
+		case 'a':
+			if media != nil {
+				media.Attributes = append(media.Attributes, v)
+			} else {
+				s.Attributes = append(s.Attributes, v)
+			}
+		case 'm':
+			fields := strings.Fields(v)
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("invalid SDP media %q", v)
+			}
+			port, _, _ := strings.Cut(fields[1], "/")
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SDP media port %q", fields[1])
+			}
+			media = &mediaDescription{Type: fields[0], Port: p, Proto: fields[2], Formats: fields[3:]}
+			s.Media = append(s.Media, media)
+		}
+	}
+	if len(s.Media) == 0 {
+		return nil, errors.New("SDP without media")
+	}
+	return s, nil
+}
+
+// String encodes the description with CRLF line endings.
+func (s *sessionDescription) String() string {
+	var b strings.Builder
+	b.WriteString("v=0\r\n")
+	b.WriteString("o=" + s.Origin + "\r\n")
+	b.WriteString("s=tg2sip\r\n")
+	if s.Connection != "" {
+		b.WriteString("c=" + s.Connection + "\r\n")
+	}
+	b.WriteString("t=0 0\r\n")
+	for _, a := range s.Attributes {
+		b.WriteString("a=" + a + "\r\n")
+	}
+	for _, m := range s.Media {
+		fmt.Fprintf(&b, "m=%s %d %s %s\r\n", m.Type, m.Port, m.Proto, strings.Join(m.Formats, " "))
+		if m.Connection != "" {
+			b.WriteString("c=" + m.Connection + "\r\n")
+		}
+		for _, a := range m.Attributes {
+			b.WriteString("a=" + a + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+// newSDP creates a description with a single audio stream at host:port.
+func newSDP(host string, port int, proto string) (*sessionDescription, *mediaDescription) {
+	m := &mediaDescription{Type: "audio", Port: port, Proto: proto}
+	s := &sessionDescription{
+		Origin:     fmt.Sprintf("tg2sip %d 1 %s", rand.Int63n(1<<62), sdpConnection(host)),
+		Connection: sdpConnection(host),
+		Media:      []*mediaDescription{m},
+	}
+	return s, m
+}
+
+// Audio returns the first audio stream that is not disabled.
+func (s *sessionDescription) Audio() (*mediaDescription, error) {
+	for _, m := range s.Media {
+		if m.Type == "audio" && m.Port != 0 {
+			return m, nil
+		}
+	}
+	return nil, errNoAudio
+}
+
+// RemoteAddr returns the address media of m is sent to.
+func (s *sessionDescription) RemoteAddr(m *mediaDescription) (*net.UDPAddr, error) {
+	conn := m.Connection
+	if conn == "" {
+		conn = s.Connection
+	}
+	ip, err := parseSDPConnection(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: m.Port}, nil
+}
+
+// Direction returns the direction attribute of m, taken from the session
+// level if m has none, sendrecv by default (RFC 4566 6).
+func (s *sessionDescription) Direction(m *mediaDescription) string {
+	for _, attrs := range [][]string{m.Attributes, s.Attributes} {
+		for _, a := range attrs {
+			switch a {
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+				return a
+			}
+		}
+	}
+	return "sendrecv"
+}
+
+// answerDirection returns the direction answering an offered one
+// (RFC 3264 6.1).
+func answerDirection(offered string) string {
+	switch offered {
+	case "sendonly":
+		return "recvonly"
+	case "recvonly":
+		return "sendonly"
+	case "inactive":
+		return "inactive"
+	}
+	return "sendrecv"
+}
+
+// rejected returns the answer to a media stream that is not accepted: the
+// same stream with port 0 (RFC 3264 6).
+func (m *mediaDescription) rejected() *mediaDescription {
+	return &mediaDescription{Type: m.Type, Proto: m.Proto, Formats: m.Formats[:1]}
+}
+
+// Attrs returns the values of the a=<name>:<value> attributes of m.
+func (m *mediaDescription) Attrs(name string) []string {
+	var values []string
+	for _, a := range m.Attributes {
+		if k, v, _ := strings.Cut(a, ":"); k == name {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// sdpCodec is an RTP payload format.
+type sdpCodec struct {
+	PT       int
+	Name     string
+	Rate     int
+	Channels int
+	Fmtp     string // a=fmtp parameters, e.g. "useinbandfec=1"
+}
+
+// rtpmap returns the a=rtpmap value of c.
+func (c sdpCodec) rtpmap() string {
+	v := fmt.Sprintf("%d %s/%d", c.PT, c.Name, c.Rate)
+	if c.Channels > 1 {
+		v += "/" + strconv.Itoa(c.Channels)
+	}
+	return v
+}
+
+// same reports whether c and o are the same format, ignoring the payload
+// type.
+func (c sdpCodec) same(o sdpCodec) bool {
+	return strings.EqualFold(c.Name, o.Name) && c.Rate == o.Rate && max(c.Channels, 1) == max(o.Channels, 1)
+}
+
+// staticPayloadTypes are the static audio payload types of RFC 3551 the
+// gateway may see without a=rtpmap.
+var staticPayloadTypes = map[int]sdpCodec{
+	0: {PT: 0, Name: "PCMU", Rate: 8000},
+	8: {PT: 8, Name: "PCMA", Rate: 8000},
+	9: {PT: 9, Name: "G722", Rate: 8000},
+}
+
+// Codecs returns the formats of m in preference order.
+func (m *mediaDescription) Codecs() []sdpCodec {
+	fmtp := make(map[int]string)
+	for _, v := range m.Attrs("fmtp") {
+		pt, params, _ := strings.Cut(v, " ")
+		if n, err := strconv.Atoi(pt); err == nil {
+			fmtp[n] = strings.TrimSpace(params)
+		}
+	}
+	maps := make(map[int]sdpCodec)
+	for _, v := range m.Attrs("rtpmap") {
+		pt, enc, _ := strings.Cut(v, " ")
+		n, err := strconv.Atoi(pt)
+		if err != nil {
+			continue
+		}
+		parts := strings.Split(enc, "/")
+		c := sdpCodec{PT: n, Name: parts[0]}
+		if len(parts) > 1 {
+			c.Rate, _ = strconv.Atoi(parts[1])
+		}
+		if len(parts) > 2 {
+			c.Channels, _ = strconv.Atoi(parts[2])
+		}
+		maps[n] = c
+	}
+	var codecs []sdpCodec
+	for _, f := range m.Formats {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			continue
+		}
+		c, ok := maps[n]
+		if !ok {
+			if c, ok = staticPayloadTypes[n]; !ok {
+				continue
+			}
+		}
+		c.Fmtp = fmtp[n]
+		codecs = append(codecs, c)
+	}
+	return codecs
+}
+
+// AddCodec appends c to the formats of m.
+func (m *mediaDescription) AddCodec(c sdpCodec) {
+	m.Formats = append(m.Formats, strconv.Itoa(c.PT))
+	m.Attributes = append(m.Attributes, "rtpmap:"+c.rtpmap())
+	if c.Fmtp != "" {
+		m.Attributes = append(m.Attributes, fmt.Sprintf("fmtp:%d %s", c.PT, c.Fmtp))
+	}
+}
+
+// Ptime returns the a=ptime and a=maxptime values of m in milliseconds, 0
+// if absent.
+func (m *mediaDescription) Ptime() (ptime, maxPtime int) {
+	if v := m.Attrs("ptime"); len(v) > 0 {
+		ptime, _ = strconv.Atoi(strings.TrimSpace(v[0]))
+	}
+	if v := m.Attrs("maxptime"); len(v) > 0 {
+		maxPtime, _ = strconv.Atoi(strings.TrimSpace(v[0]))
+	}
+	return ptime, maxPtime
+}
+
+// fmtpParams splits format parameters like "minptime=10;useinbandfec=1".
+// Names are lower case.
+func fmtpParams(fmtp string) map[string]string {
+	params := make(map[string]string)
+	for _, p := range strings.Split(fmtp, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if k != "" {
+			params[strings.ToLower(k)] = strings.TrimSpace(v)
+		}
+	}
+	return params
+}
+
+// selectCodec picks the codec of offer that comes first in the local
+// preference order. The offer's payload type is kept.
+func selectCodec(offer *mediaDescription, local []sdpCodec) (sdpCodec, bool) {
+	offered := offer.Codecs()
+	for _, l := range local {
+		for _, c := range offered {
+			if c.same(l) {
+				return c, true
+			}
+		}
+	}
+	return sdpCodec{}, false
+}
+
+// sdpConnection returns the network type, address type and address of SDP
+// o= and c= lines for host, e.g. "IN IP6 2001:db8::1" (RFC 4566 5.7).
+func sdpConnection(host string) string {
+	host = strings.Trim(host, "[]")
+	if isIPv6(host) {
+		return "IN IP6 " + host
+	}
+	return "IN IP4 " + host
+}
+
+// parseSDPConnection parses the value of a c= line. Multicast TTL and
+// address count suffixes are ignored.
+func parseSDPConnection(v string) (net.IP, error) {
+	fields := strings.Fields(v)
+	if len(fields) != 3 || fields[0] != "IN" {
+		return nil, fmt.Errorf("invalid SDP connection %q", v)
+	}
+	addr, _, _ := strings.Cut(fields[2], "/")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid SDP connection address %q", fields[2])
+	}
+	switch fields[1] {
+	case "IP4":
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("SDP connection %q is not IPv4", v)
+		}
+	case "IP6":
+		if ip.To4() != nil {
+			return nil, fmt.Errorf("SDP connection %q is not IPv6", v)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported SDP address type %q", fields[1])
+	}
+	return ip, nil
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
 	ini "gopkg.in/ini.v1"
+	"tg2sip/opus"
 )
 
 // Settings holds application configuration loaded from settings.ini.
@@ -12,12 +17,65 @@ type Settings struct {
 	sipPort        int
 	sipPortRange   int
 	publicAddress  string
+	publicAddress6 string
+	ipv6           bool
 	stunServer     string
+	stunInterval   int
 	idURI          string
 	callbackURI    string
 	rawPCM         bool
 	sipThreadCount int
+	forkMode       string
+	ringTimeouts   []time.Duration
+	dnsServer      string
+	outboundProxy  sip.Uri
+	fixContact     bool
+	symmetricRTP   bool
+	codecs         []string
+	ptime          int
+	opusBitrate    int
+	opusFEC        bool
+	opusDTX        bool
+	jitterMin      int
+	jitterMax      int
+	comfortNoise   bool
+	srtp           string
+	keepalive      int
+	keepaliveTo    []string
+	rtpPortStart   int
+	rtpPortEnd     int
+	metricsListen  string
 
+	accounts []*AccountSettings
+
+	extraWaitTime int
+	peerFloodTime int
+	callRate      float64
+	callBurst     int
+
+	negativeCacheTTL int
+
+	importedCleanup   string
+	importedRetention int
+
+	countryCode   string
+	trunkPrefix   string
+	intlPrefix    string
+	validatePhone bool
+	phonebook     string
+
+	floodQueue          bool
+	floodQueueThreshold int
+	floodQueueDepth     int
+	floodQueueMaxWait   int
+
+	dialPlan []*DialRule
+}
+
+// AccountSettings holds configuration of a single Telegram account loaded
+// from the [telegram] section or one of its [telegram.<name>] children.
+type AccountSettings struct {
+	name               string
 	apiID              int
 	apiHash            string
 	dbFolder           string
@@ -45,8 +103,9 @@ type Settings struct {
 	voipProxyUsername string
 	voipProxyPassword string
 
-	extraWaitTime int
-	peerFloodTime int
+	callbackURI string
+	sipPrefix   string
+	sipDomain   string
 }
 
 // LoadSettings reads configuration from ini file and validates required fields.
@@ -57,13 +116,140 @@ func LoadSettings(cfg *ini.File) (*Settings, error) {
 	s.sipPort = sec.Key("port").MustInt(5060)
 	s.sipPortRange = sec.Key("port_range").MustInt(0)
 	s.publicAddress = sec.Key("public_address").String()
+	s.publicAddress6 = strings.Trim(sec.Key("public_address6").String(), "[]")
+	s.ipv6 = sec.Key("ipv6").MustBool(true)
 	s.stunServer = sec.Key("stun_server").String()
+	s.stunInterval = sec.Key("stun_interval").MustInt(300)
 	s.idURI = sec.Key("id_uri").MustString("sip:localhost")
 	s.callbackURI = sec.Key("callback_uri").String()
 	s.rawPCM = sec.Key("raw_pcm").MustBool(true)
 	s.sipThreadCount = sec.Key("thread_count").MustInt(1)
+	s.forkMode = sec.Key("fork_mode").In(forkSequential, []string{forkSequential, forkParallel})
+	timeouts, err := parseRingTimeouts(sec.Key("ring_timeout").String())
+	if err != nil {
+		return nil, fmt.Errorf("sip ring_timeout: %w", err)
+	}
+	s.ringTimeouts = timeouts
+	s.dnsServer = sec.Key("dns_server").String()
+	if v := sec.Key("outbound_proxy").String(); v != "" {
+		proxy, err := parser.ParseUri(v)
+		if err != nil {
+			return nil, fmt.Errorf("sip outbound_proxy: %w", err)
+		}
+		s.outboundProxy = proxy
+	}
+	s.fixContact = sec.Key("fix_contact").MustBool(true)
+	s.symmetricRTP = sec.Key("symmetric_rtp").MustBool(true)
+	s.codecs = splitList(sec.Key("codecs").String())
+	for _, v := range s.codecs {
+		if _, ok := supportedCodecs[strings.ToUpper(v)]; !ok {
+			return nil, fmt.Errorf("sip codecs: unsupported codec %q", v)
+		}
+	}
+	for _, v := range s.Codecs() {
+		if strings.EqualFold(v, "OPUS") && !opusAvailable() {
+			return nil, fmt.Errorf("sip codecs: OPUS is not available, use raw_pcm=true or other codecs: %w", opus.ErrUnavailable)
+		}
+	}
+	s.ptime = sec.Key("ptime").MustInt(20)
+	if s.ptime < 10 || s.ptime > 60 || s.ptime%10 != 0 {
+		return nil, fmt.Errorf("sip ptime must be 10 to 60 ms in steps of 10")
+	}
+	s.opusBitrate = sec.Key("opus_bitrate").MustInt(32000)
+	if s.opusBitrate != 0 && (s.opusBitrate < 6000 || s.opusBitrate > 510000) {
+		return nil, fmt.Errorf("sip opus_bitrate must be 6000 to 510000 or 0")
+	}
+	s.opusFEC = sec.Key("opus_fec").MustBool(true)
+	s.opusDTX = sec.Key("opus_dtx").MustBool(false)
+	s.jitterMin = sec.Key("jitter_min_delay").MustInt(20)
+	s.jitterMax = sec.Key("jitter_max_delay").MustInt(200)
+	if s.jitterMin < 0 || s.jitterMax < s.jitterMin {
+		return nil, fmt.Errorf("sip jitter_max_delay must not be below jitter_min_delay")
+	}
+	s.comfortNoise = sec.Key("comfort_noise").MustBool(true)
+	s.srtp = sec.Key("srtp").In(srtpOff, []string{srtpOff, srtpOptional, srtpMandatory})
+	s.keepalive = sec.Key("keepalive_interval").MustInt(0)
+	s.keepaliveTo = splitList(sec.Key("keepalive_target").String())
+	for _, v := range s.keepaliveTo {
+		if _, err := parser.ParseUri(v); err != nil {
+			return nil, fmt.Errorf("sip keepalive_target %q: %w", v, err)
+		}
+	}
+
+	s.rtpPortStart = sec.Key("rtp_port_start").MustInt(10000)
+	s.rtpPortEnd = sec.Key("rtp_port_end").MustInt(20000)
+	if s.rtpPortStart <= 0 || s.rtpPortEnd > 65535 || s.rtpPortEnd < s.rtpPortStart+s.rtpPortStart%2+1 {
+		return nil, fmt.Errorf("sip rtp_port_start/rtp_port_end must hold at least one even/odd port pair")
+	}
 
-	sec = cfg.Section("telegram")
+	s.metricsListen = cfg.Section("metrics").Key("listen").String()
+
+	base := cfg.Section("telegram")
+	children := base.ChildSections()
+	if len(children) == 0 {
+		acc, err := loadAccountSettings(base, defaultAccountName, s.callbackURI)
+		if err != nil {
+			return nil, err
+		}
+		s.accounts = append(s.accounts, acc)
+	}
+	for _, sec := range children {
+		name := strings.TrimPrefix(sec.Name(), base.Name()+".")
+		ownFolder := hasOwnKey(sec, "database_folder")
+		acc, err := loadAccountSettings(sec, name, s.callbackURI)
+		if err != nil {
+			return nil, err
+		}
+		// Child sections inherit database_folder from [telegram]; give
+		// each account its own folder unless one is set explicitly.
+		if !ownFolder {
+			acc.dbFolder = filepath.Join(acc.dbFolder, name)
+		}
+		s.accounts = append(s.accounts, acc)
+	}
+
+	sec = cfg.Section("phone")
+	s.countryCode = sec.Key("default_country_code").String()
+	s.trunkPrefix = sec.Key("trunk_prefix").String()
+	s.intlPrefix = sec.Key("international_prefix").String()
+	s.validatePhone = sec.Key("validate").MustBool(false)
+	s.phonebook = sec.Key("phonebook").String()
+
+	sec = cfg.Section("other")
+	s.extraWaitTime = sec.Key("extra_wait_time").MustInt(30)
+	s.peerFloodTime = sec.Key("peer_flood_time").MustInt(86400)
+	s.callRate = sec.Key("call_rate").MustFloat64(0)
+	s.callBurst = sec.Key("call_burst").MustInt(5)
+	s.negativeCacheTTL = sec.Key("negative_cache_ttl").MustInt(300)
+	s.importedCleanup = sec.Key("imported_contacts_cleanup").In(importedCleanupNever,
+		[]string{importedCleanupNever, importedCleanupCall, importedCleanupRetention})
+	s.importedRetention = sec.Key("imported_contacts_retention").MustInt(86400)
+	s.floodQueue = sec.Key("flood_queue").MustBool(false)
+	s.floodQueueThreshold = sec.Key("flood_queue_threshold").MustInt(30)
+	s.floodQueueDepth = sec.Key("flood_queue_depth").MustInt(10)
+	s.floodQueueMaxWait = sec.Key("flood_queue_max_wait").MustInt(60)
+
+	// Dial plan rules are tried in the order of their sections.
+	plan := cfg.Section("dialplan")
+	for _, sec := range plan.ChildSections() {
+		rule, err := loadDialRule(sec, strings.TrimPrefix(sec.Name(), plan.Name()+"."))
+		if err != nil {
+			return nil, err
+		}
+		s.dialPlan = append(s.dialPlan, rule)
+	}
+
+	return s, nil
+}
+
+// defaultAccountName names the account configured by a plain [telegram]
+// section without children.
+const defaultAccountName = "default"
+
+// loadAccountSettings reads a single Telegram account section. Keys missing
+// in a [telegram.<name>] section are inherited from [telegram].
+func loadAccountSettings(sec *ini.Section, name, callbackURI string) (*AccountSettings, error) {
+	s := &AccountSettings{name: name}
 	s.apiID = sec.Key("api_id").MustInt(0)
 	s.apiHash = sec.Key("api_hash").String()
 	s.dbFolder = sec.Key("database_folder").MustString("/data")
@@ -91,17 +277,27 @@ func LoadSettings(cfg *ini.File) (*Settings, error) {
 	s.voipProxyUsername = sec.Key("voip_proxy_username").String()
 	s.voipProxyPassword = sec.Key("voip_proxy_password").String()
 
-	sec = cfg.Section("other")
-	s.extraWaitTime = sec.Key("extra_wait_time").MustInt(30)
-	s.peerFloodTime = sec.Key("peer_flood_time").MustInt(86400)
+	s.callbackURI = sec.Key("callback_uri").MustString(callbackURI)
+	s.sipPrefix = sec.Key("sip_prefix").String()
+	s.sipDomain = strings.ToLower(sec.Key("sip_domain").String())
 
 	if s.apiID == 0 || s.apiHash == "" {
-		return nil, fmt.Errorf("telegram api settings must be set")
+		return nil, fmt.Errorf("telegram api settings must be set for account %s", name)
 	}
-
 	return s, nil
 }
 
+// hasOwnKey reports whether key is set in sec itself rather than inherited
+// from a parent section.
+func hasOwnKey(sec *ini.Section, key string) bool {
+	for _, k := range sec.KeyStrings() {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Settings) SIPPort() int          { return s.sipPort }
 func (s *Settings) SIPPortRange() int     { return s.sipPortRange }
 func (s *Settings) PublicAddress() string { return s.publicAddress }
@@ -110,33 +306,82 @@ func (s *Settings) IDURI() string         { return s.idURI }
 func (s *Settings) CallbackURI() string   { return s.callbackURI }
 func (s *Settings) RawPCM() bool          { return s.rawPCM }
 func (s *Settings) SIPThreadCount() int   { return s.sipThreadCount }
+func (s *Settings) ForkMode() string      { return s.forkMode }
+func (s *Settings) DNSServer() string     { return s.dnsServer }
 
-func (s *Settings) APIID() int                 { return s.apiID }
-func (s *Settings) APIHash() string            { return s.apiHash }
-func (s *Settings) DatabaseFolder() string     { return s.dbFolder }
-func (s *Settings) SystemLanguageCode() string { return s.systemLanguageCode }
-func (s *Settings) DeviceModel() string        { return s.deviceModel }
-func (s *Settings) SystemVersion() string      { return s.systemVersion }
-func (s *Settings) ApplicationVersion() string { return s.applicationVersion }
-func (s *Settings) PhoneNumber() string        { return s.phoneNumber }
-
-func (s *Settings) UDPP2P() bool       { return s.udpP2P }
-func (s *Settings) UDPReflector() bool { return s.udpReflector }
-func (s *Settings) AECEnabled() bool   { return s.aecEnabled }
-func (s *Settings) NSEnabled() bool    { return s.nsEnabled }
-func (s *Settings) AGCEnabled() bool   { return s.agcEnabled }
-
-func (s *Settings) ProxyEnabled() bool    { return s.proxyEnabled }
-func (s *Settings) ProxyAddress() string  { return s.proxyAddress }
-func (s *Settings) ProxyPort() int        { return s.proxyPort }
-func (s *Settings) ProxyUsername() string { return s.proxyUsername }
-func (s *Settings) ProxyPassword() string { return s.proxyPassword }
-
-func (s *Settings) VoipProxyEnabled() bool    { return s.voipProxyEnabled }
-func (s *Settings) VoipProxyAddress() string  { return s.voipProxyAddress }
-func (s *Settings) VoipProxyPort() int        { return s.voipProxyPort }
-func (s *Settings) VoipProxyUsername() string { return s.voipProxyUsername }
-func (s *Settings) VoipProxyPassword() string { return s.voipProxyPassword }
+func (s *Settings) RingTimeouts() []time.Duration { return s.ringTimeouts }
+
+func (s *Settings) StunInterval() time.Duration {
+	return time.Duration(s.stunInterval) * time.Second
+}
+
+// OutboundProxy returns the proxy for all outgoing requests, nil if unset.
+func (s *Settings) OutboundProxy() sip.Uri { return s.outboundProxy }
+
+// IPv6 reports whether the SIP listener serves IPv6 peers as well.
+func (s *Settings) IPv6() bool             { return s.ipv6 }
+func (s *Settings) PublicAddress6() string { return s.publicAddress6 }
+
+func (s *Settings) RTPPortStart() int     { return s.rtpPortStart }
+func (s *Settings) RTPPortEnd() int       { return s.rtpPortEnd }
+func (s *Settings) MetricsListen() string { return s.metricsListen }
+
+func (s *Settings) FixContact() bool   { return s.fixContact }
+func (s *Settings) SymmetricRTP() bool { return s.symmetricRTP }
+
+// Codecs returns the SIP leg codec names in preference order.
+func (s *Settings) Codecs() []string {
+	if len(s.codecs) == 0 {
+		return defaultCodecs(s.rawPCM)
+	}
+	return s.codecs
+}
+
+// CodecOptions returns the packet time and Opus encoder settings.
+func (s *Settings) CodecOptions() codecOptions {
+	return codecOptions{Ptime: s.ptime, OpusBitrate: s.opusBitrate, OpusFEC: s.opusFEC, OpusDTX: s.opusDTX}
+}
+
+// JitterOptions returns the playout settings of SIP ingress audio.
+func (s *Settings) JitterOptions() jitterOptions {
+	return jitterOptions{
+		MinDelay:     time.Duration(s.jitterMin) * time.Millisecond,
+		MaxDelay:     time.Duration(s.jitterMax) * time.Millisecond,
+		ComfortNoise: s.comfortNoise,
+	}
+}
+
+// SRTP returns the default SRTP policy: off, optional or mandatory.
+func (s *Settings) SRTP() string { return s.srtp }
+
+// KeepaliveInterval returns the OPTIONS keepalive period, zero if disabled.
+func (s *Settings) KeepaliveInterval() time.Duration {
+	return time.Duration(s.keepalive) * time.Second
+}
+
+// KeepaliveTargets returns the configured keepalive targets. When none are
+// configured the outbound proxy, or else the callback targets, are pinged.
+func (s *Settings) KeepaliveTargets() []string {
+	if len(s.keepaliveTo) > 0 {
+		return s.keepaliveTo
+	}
+	if s.outboundProxy != nil {
+		return []string{s.outboundProxy.String()}
+	}
+	seen := make(map[string]bool)
+	var targets []string
+	for _, acc := range s.accounts {
+		for _, t := range splitList(acc.callbackURI) {
+			if !seen[t] {
+				seen[t] = true
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets
+}
+
+func (s *Settings) Accounts() []*AccountSettings { return s.accounts }
 
 func (s *Settings) ExtraWaitTime() time.Duration {
 	return time.Duration(s.extraWaitTime) * time.Second
@@ -145,3 +390,70 @@ func (s *Settings) ExtraWaitTime() time.Duration {
 func (s *Settings) PeerFloodTime() time.Duration {
 	return time.Duration(s.peerFloodTime) * time.Second
 }
+
+func (s *Settings) CallRate() float64 { return s.callRate }
+func (s *Settings) CallBurst() int    { return s.callBurst }
+
+func (s *Settings) NegativeCacheTTL() time.Duration {
+	return time.Duration(s.negativeCacheTTL) * time.Second
+}
+
+// DialPlan returns the Telegram->SIP routing rules in match order.
+func (s *Settings) DialPlan() []*DialRule { return s.dialPlan }
+
+// Phonebook returns the path of the speed-dial phonebook, empty if unset.
+func (s *Settings) Phonebook() string { return s.phonebook }
+
+// PhoneRules builds phone number normalization rules from the [phone] section.
+func (s *Settings) PhoneRules() *PhoneRules {
+	return NewPhoneRules(s.countryCode, s.trunkPrefix, s.intlPrefix, s.validatePhone)
+}
+
+func (s *Settings) ImportedCleanup() string { return s.importedCleanup }
+
+func (s *Settings) ImportedRetention() time.Duration {
+	return time.Duration(s.importedRetention) * time.Second
+}
+
+func (s *Settings) FloodQueue() bool     { return s.floodQueue }
+func (s *Settings) FloodQueueDepth() int { return s.floodQueueDepth }
+
+func (s *Settings) FloodQueueThreshold() time.Duration {
+	return time.Duration(s.floodQueueThreshold) * time.Second
+}
+
+func (s *Settings) FloodQueueMaxWait() time.Duration {
+	return time.Duration(s.floodQueueMaxWait) * time.Second
+}
+
+func (s *AccountSettings) Name() string               { return s.name }
+func (s *AccountSettings) APIID() int                 { return s.apiID }
+func (s *AccountSettings) APIHash() string            { return s.apiHash }
+func (s *AccountSettings) DatabaseFolder() string     { return s.dbFolder }
+func (s *AccountSettings) SystemLanguageCode() string { return s.systemLanguageCode }
+func (s *AccountSettings) DeviceModel() string        { return s.deviceModel }
+func (s *AccountSettings) SystemVersion() string      { return s.systemVersion }
+func (s *AccountSettings) ApplicationVersion() string { return s.applicationVersion }
+func (s *AccountSettings) PhoneNumber() string        { return s.phoneNumber }
+
+func (s *AccountSettings) UDPP2P() bool       { return s.udpP2P }
+func (s *AccountSettings) UDPReflector() bool { return s.udpReflector }
+func (s *AccountSettings) AECEnabled() bool   { return s.aecEnabled }
+func (s *AccountSettings) NSEnabled() bool    { return s.nsEnabled }
+func (s *AccountSettings) AGCEnabled() bool   { return s.agcEnabled }
+
+func (s *AccountSettings) ProxyEnabled() bool    { return s.proxyEnabled }
+func (s *AccountSettings) ProxyAddress() string  { return s.proxyAddress }
+func (s *AccountSettings) ProxyPort() int        { return s.proxyPort }
+func (s *AccountSettings) ProxyUsername() string { return s.proxyUsername }
+func (s *AccountSettings) ProxyPassword() string { return s.proxyPassword }
+
+func (s *AccountSettings) VoipProxyEnabled() bool    { return s.voipProxyEnabled }
+func (s *AccountSettings) VoipProxyAddress() string  { return s.voipProxyAddress }
+func (s *AccountSettings) VoipProxyPort() int        { return s.voipProxyPort }
+func (s *AccountSettings) VoipProxyUsername() string { return s.voipProxyUsername }
+func (s *AccountSettings) VoipProxyPassword() string { return s.voipProxyPassword }
+
+func (s *AccountSettings) CallbackURI() string { return s.callbackURI }
+func (s *AccountSettings) SIPPrefix() string   { return s.sipPrefix }
+func (s *AccountSettings) SIPDomain() string   { return s.sipDomain }
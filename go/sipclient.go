@@ -2,21 +2,32 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 
 	gosip "github.com/ghettovoice/gosip"
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/sip/parser"
 	"github.com/ghettovoice/gosip/util"
-	"tg2sip/tgvoip"
 )
 
 // SIPClient provides helper methods to interact with the SIP server.
 type SIPClient struct {
-	srv   gosip.Server
-	mu    sync.Mutex
-	calls map[string]*callSession
+	srv       gosip.Server
+	local     *advertisedAddress
+	resolver  *SIPResolver
+	proxy     sip.Uri
+	proxyAddr string
+	// fixContact rewrites private Contact addresses of peers behind NAT.
+	fixContact bool
+
+	mu         sync.Mutex
+	calls      map[string]*callSession
+	viaMapping string // last received/rport seen in a response Via
 }
 
 type callSession struct {
@@ -28,11 +39,220 @@ type callSession struct {
 	clientTx   sip.ClientTransaction
 	serverTx   sip.ServerTransaction
 	inviteReq  sip.Request
+	localSDP   string // our offer or the answer sent with 200 OK
+	localTag   string // To tag of an early dialog, reused by the 200 OK
+	remoteSDP  string // SDP of the peer's 2xx
+
+	// remoteTarget is the request-URI of in-dialog requests, taken from
+	// the peer's Contact.
+	remoteTarget sip.Uri
+}
+
+// NewSIPClient creates a new SIPClient advertising local in Contact headers.
+// Outbound calls are routed using resolver, or by the SIP stack if resolver
+// is nil. A non-nil proxy receives every request the client originates.
+// With fixContact, private Contact addresses of peers behind NAT are
+// replaced by the address their messages come from.
+func NewSIPClient(srv gosip.Server, local *advertisedAddress, resolver *SIPResolver, proxy sip.Uri, fixContact bool) *SIPClient {
+	c := &SIPClient{
+		srv:        srv,
+		local:      local,
+		resolver:   resolver,
+		proxy:      proxy,
+		fixContact: fixContact,
+		calls:      make(map[string]*callSession),
+	}
+	if proxy != nil {
+		port := sip.DefaultPort("udp")
+		if proxy.Port() != nil {
+			port = *proxy.Port()
+		}
+		c.proxyAddr = net.JoinHostPort(strings.Trim(proxy.Host(), "[]"), strconv.Itoa(int(port)))
+	}
+	return c
+}
+
+// contactAddress returns a Contact for the user of uri at the advertised SIP
+// address of the family of peer ("ip:port" or host), or uri itself while that
+// address is unknown.
+func (c *SIPClient) contactAddress(uri sip.Uri, peer string) *sip.Address {
+	if c.local == nil || c.local.Host() == "" {
+		return &sip.Address{Uri: uri.Clone()}
+	}
+	hostPort := c.local.HostPortFor(peer)
+	contact := "sip:" + hostPort
+	if u := uri.User(); u != nil && u.String() != "" {
+		contact = "sip:" + u.String() + "@" + hostPort
+	}
+	parsed, err := parser.ParseUri(contact)
+	if err != nil {
+		return &sip.Address{Uri: uri.Clone()}
+	}
+	return &sip.Address{Uri: parsed}
+}
+
+// prepare readies a request the client originates: it asks for rport and
+// routes the request through the outbound proxy.
+func (c *SIPClient) prepare(req sip.Request) {
+	addRport(req)
+	c.applyRoute(req)
+}
+
+// remoteTarget returns the Contact of msg, corrected for NAT if the message
+// came directly from the peer, or nil if msg has no Contact.
+func (c *SIPClient) remoteTarget(msg sip.Message) sip.Uri {
+	contact, ok := msg.Contact()
+	if !ok || contact.Address == nil {
+		return nil
+	}
+	target := contact.Address.Clone()
+	// Behind a proxy the source address is the proxy's, not the peer's.
+	if !c.fixContact || c.proxy != nil || len(msg.GetHeaders("Record-Route")) > 0 || viaHops(msg) > 1 {
+		return target
+	}
+	if fixed, ok := natTarget(target, msg.Source()); ok {
+		coreLog.Infof("SIP peer %s is behind NAT, sending requests to %s", contact.Address, fixed)
+		return fixed
+	}
+	return target
+}
+
+// viaHops counts the Via entries of msg.
+func viaHops(msg sip.Message) int {
+	n := 0
+	for _, h := range msg.GetHeaders("Via") {
+		if via, ok := h.(sip.ViaHeader); ok {
+			n += len(via)
+		}
+	}
+	return n
+}
+
+// addrTag returns the tag parameter of addr, empty if it has none.
+func addrTag(addr *sip.Address) string {
+	if addr == nil || addr.Params == nil {
+		return ""
+	}
+	if v, ok := addr.Params.Get("tag"); ok && v != nil {
+		return v.String()
+	}
+	return ""
+}
+
+// dialogLocked returns the call whose dialog req belongs to: Call-ID, To tag and
+// From tag match the call and its local and remote tags. Caller must hold
+// c.mu.
+func (c *SIPClient) dialogLocked(req sip.Request) (*callSession, bool) {
+	cid, ok := req.CallID()
+	if !ok {
+		return nil, false
+	}
+	sess, ok := c.calls[cid.String()]
+	if !ok {
+		return nil, false
+	}
+	fromHdr, _ := req.From()
+	toHdr, _ := req.To()
+	if fromHdr == nil || toHdr == nil {
+		return nil, false
+	}
+	local, remote := addrTag(sess.localAddr), addrTag(sess.remoteAddr)
+	if local == "" || local != addrTag(&sip.Address{Params: toHdr.Params}) || remote != addrTag(&sip.Address{Params: fromHdr.Params}) {
+		return nil, false
+	}
+	return sess, true
+}
+
+// AnswerReinvite accepts a re-INVITE of an established call with the local
+// SDP of the call, which keeps the session unchanged, and takes the Contact
+// of req as the new remote target. It fails if req is outside any dialog.
+func (c *SIPClient) AnswerReinvite(req sip.Request) error {
+	c.mu.Lock()
+	sess, ok := c.dialogLocked(req)
+	if ok {
+		if target := c.remoteTarget(req); target != nil {
+			sess.remoteTarget = target
+		}
+	}
+	var contact *sip.Address
+	localSDP := ""
+	if ok {
+		contact, localSDP = sess.contact, sess.localSDP
+	}
+	c.mu.Unlock()
+	if !ok {
+		return errNoDialog
+	}
+	res := sip.NewResponseFromRequest("", req, statusOK, "OK", "")
+	res.AppendHeader(contact.AsContactHeader())
+	if localSDP != "" {
+		ctype := sip.ContentType("application/sdp")
+		res.AppendHeader(&ctype)
+		res.SetBody(localSDP, true)
+	}
+	if _, err := c.srv.Respond(res); err != nil {
+		return fmt.Errorf("send 200 OK: %w", err)
+	}
+	return nil
 }
 
-// NewSIPClient creates a new SIPClient.
-func NewSIPClient(srv gosip.Server) *SIPClient {
-	return &SIPClient{srv: srv, calls: make(map[string]*callSession)}
+// IsInitialAck reports whether the ACK req acknowledges the INVITE that
+// set up its call rather than a re-INVITE. ACKs of untracked calls count
+// as initial.
+func (c *SIPClient) IsInitialAck(req sip.Request) bool {
+	cid, ok := req.CallID()
+	cseq, ok2 := req.CSeq()
+	if !ok || !ok2 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sess, ok := c.calls[cid.String()]
+	if !ok || sess.inviteReq == nil {
+		return true
+	}
+	initial, ok := sess.inviteReq.CSeq()
+	return !ok || initial.SeqNo == cseq.SeqNo
+}
+
+// target returns the request-URI for in-dialog requests of sess.
+func (sess *callSession) target() sip.Uri {
+	if sess.remoteTarget != nil {
+		return sess.remoteTarget
+	}
+	return sess.remoteAddr.Uri
+}
+
+// applyRoute sends req through the outbound proxy. A loose router (lr) is
+// added as the topmost Route; a strict router becomes the request-URI and
+// the original target moves to the last Route (RFC 3261 12.2.1.1).
+func (c *SIPClient) applyRoute(req sip.Request) {
+	if c.proxy == nil {
+		return
+	}
+	var routes []sip.Uri
+	for _, h := range req.GetHeaders("Route") {
+		if rh, ok := h.(*sip.RouteHeader); ok {
+			routes = append(routes, rh.Addresses...)
+		}
+	}
+	if isLooseRouter(c.proxy) {
+		routes = append([]sip.Uri{c.proxy.Clone()}, routes...)
+	} else {
+		routes = append(routes, req.Recipient())
+		req.SetRecipient(c.proxy.Clone())
+	}
+	req.RemoveHeader("Route")
+	req.AppendHeader(&sip.RouteHeader{Addresses: routes})
+	req.SetDestination(c.proxyAddr)
+}
+
+func isLooseRouter(uri sip.Uri) bool {
+	if uri.UriParams() == nil {
+		return false
+	}
+	_, ok := uri.UriParams().Get("lr")
+	return ok
 }
 
 // TrackInvite stores incoming INVITE transaction for later processing.
@@ -48,11 +268,12 @@ func (c *SIPClient) TrackInvite(req sip.Request, tx sip.ServerTransaction) {
 		callID:     callID,
 		localAddr:  sip.NewAddressFromToHeader(toHdr),
 		remoteAddr: sip.NewAddressFromFromHeader(fromHdr),
-		contact:    sip.NewAddressFromToHeader(toHdr),
+		contact:    c.contactAddress(toHdr.Address, req.Source()),
 		cseq:       1,
 		serverTx:   tx,
 		inviteReq:  req,
 	}
+	sess.remoteTarget = c.remoteTarget(req)
 	if fromHdr != nil && fromHdr.Params != nil {
 		if tag, ok := fromHdr.Params.Get("tag"); ok {
 			if sess.remoteAddr.Params == nil {
@@ -66,51 +287,98 @@ func (c *SIPClient) TrackInvite(req sip.Request, tx sip.ServerTransaction) {
 	c.mu.Unlock()
 }
 
-// Dial starts a new outbound call.
-func (c *SIPClient) Dial(ctx context.Context, from, to string, headers map[string]string) error {
+// callIDHeader returns the Call-ID header of a call keyed by callID, the
+// string form of that header.
+func callIDHeader(callID string) sip.CallID {
+	return sip.CallID(strings.TrimPrefix(callID, "Call-ID: "))
+}
+
+// errNoDialog is returned for in-dialog requests matching no call.
+var errNoDialog = errors.New("no matching dialog")
+
+// DialResult is the final outcome of an outbound INVITE. Response is nil if
+// the transaction failed without a final response.
+type DialResult struct {
+	CallID   string
+	Target   string
+	Response sip.Response
+	Err      error
+}
+
+// Answered reports whether the call was answered with a 2xx response.
+func (r DialResult) Answered() bool {
+	return r.Err == nil && r.Response != nil && r.Response.IsSuccess()
+}
+
+// failover reports whether the next server of the target should be tried:
+// the transaction failed, e.g. timed out, or the server answered 503.
+func (r DialResult) failover() bool {
+	return r.Err != nil || (r.Response != nil && r.Response.StatusCode() == statusServiceUnavailable)
+}
+
+// Dial starts a new outbound call and returns its Call-ID. The final result
+// is delivered on the returned channel; answered calls are acknowledged and
+// stay tracked until Hangup. Canceling ctx while the call rings sends CANCEL.
+// The target host is resolved per RFC 3263 and the next server is tried on
+// transaction timeout or 503. A non-empty sdp is sent as the offer.
+func (c *SIPClient) Dial(ctx context.Context, from, to string, headers map[string]string, sdp string) (string, <-chan DialResult, error) {
 	coreLog.Infof("SIP Dial from %s to %s headers=%v", from, to, headers)
 
 	toURI, err := parser.ParseUri(to)
 	if err != nil {
-		return fmt.Errorf("parse to uri: %w", err)
+		return "", nil, fmt.Errorf("parse to uri: %w", err)
 	}
 
 	host := toURI.Host()
 	fromURI, err := parser.ParseUri(fmt.Sprintf("sip:%s@%s", from, host))
 	if err != nil {
-		return fmt.Errorf("parse from uri: %w", err)
+		return "", nil, fmt.Errorf("parse from uri: %w", err)
 	}
 
 	tag := util.RandString(8)
 	fromAddr := &sip.Address{Uri: fromURI, Params: sip.NewParams().Add("tag", sip.String{Str: tag})}
 	toAddr := &sip.Address{Uri: toURI}
-	contactAddr := &sip.Address{Uri: fromURI.Clone()}
+	contactAddr := c.contactAddress(fromURI, host)
+	cid := sip.CallID(util.RandString(32))
+	callID := cid.String()
 
-	rb := sip.NewRequestBuilder().
-		SetMethod(sip.INVITE).
-		SetRecipient(toURI).
-		SetFrom(fromAddr).
-		SetTo(toAddr).
-		SetContact(contactAddr)
-
-	for k, v := range headers {
-		rb.AddHeader(&sip.GenericHeader{HeaderName: k, Contents: v})
+	build := func(cseq uint, contactAddr *sip.Address) (sip.Request, error) {
+		rb := sip.NewRequestBuilder().
+			SetMethod(sip.INVITE).
+			SetRecipient(toURI).
+			SetFrom(fromAddr).
+			SetTo(toAddr).
+			SetContact(contactAddr).
+			SetCallID(&cid).
+			SetSeqNo(cseq)
+		for k, v := range headers {
+			rb.AddHeader(&sip.GenericHeader{HeaderName: k, Contents: v})
+		}
+		if sdp != "" {
+			ctype := sip.ContentType("application/sdp")
+			rb.SetContentType(&ctype).SetBody(sdp)
+		}
+		req, err := rb.Build()
+		if err != nil {
+			return nil, err
+		}
+		c.prepare(req)
+		return req, nil
 	}
-
-	req, err := rb.Build()
-	if err != nil {
-		return fmt.Errorf("build invite: %w", err)
+	if _, err := build(1, contactAddr); err != nil {
+		return "", nil, fmt.Errorf("build invite: %w", err)
 	}
 
-	cid, _ := req.CallID()
-	callID := ""
-	if cid != nil {
-		callID = cid.String()
+	// The first hop is the outbound proxy if one is configured.
+	nextHop := toURI
+	if c.proxy != nil {
+		nextHop = c.proxy
 	}
-
-	tx, err := c.srv.Request(req)
-	if err != nil {
-		return fmt.Errorf("send invite: %w", err)
+	var targets []sipTarget
+	if c.resolver != nil {
+		if targets, err = c.resolver.Resolve(ctx, nextHop); err != nil {
+			return "", nil, fmt.Errorf("resolve %s: %w", nextHop, err)
+		}
 	}
 
 	c.mu.Lock()
@@ -120,64 +388,228 @@ func (c *SIPClient) Dial(ctx context.Context, from, to string, headers map[strin
 		remoteAddr: toAddr,
 		contact:    contactAddr,
 		cseq:       1,
-		clientTx:   tx,
+		localSDP:   sdp,
 	}
 	c.mu.Unlock()
 
+	results := make(chan DialResult, 1)
 	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				_ = tx.Cancel()
+		result := DialResult{CallID: callID, Target: to}
+		defer func() {
+			if !result.Answered() {
+				c.mu.Lock()
+				delete(c.calls, callID)
+				c.mu.Unlock()
+			}
+			results <- result
+		}()
+
+		for i := 0; ; i++ {
+			// The Contact follows the address family of the next hop.
+			attemptContact := contactAddr
+			if i < len(targets) {
+				attemptContact = c.contactAddress(fromURI, targets[i].Addr)
+			}
+			req, _ := build(uint(i+1), attemptContact)
+			if i < len(targets) {
+				req.SetDestination(targets[i].Addr)
+				req.SetTransport(targets[i].Transport)
+				coreLog.Debugf("SIP INVITE %s via %s/%s", callID, targets[i].Addr, targets[i].Transport)
+			}
+			c.mu.Lock()
+			if sess, ok := c.calls[callID]; ok {
+				sess.cseq = uint(i + 1)
+				sess.contact = attemptContact
+			}
+			c.mu.Unlock()
+
+			result.Response, result.Err = c.invite(ctx, callID, req)
+			if !result.failover() || ctx.Err() != nil || i+1 >= len(targets) {
 				return
-			case res := <-tx.Responses():
-				if res != nil {
-					coreLog.Infof("received SIP response: %d %s", res.StatusCode(), res.Reason())
-					if toHdr, ok := res.To(); ok {
-						if tag, ok := toHdr.Params.Get("tag"); ok {
-							c.mu.Lock()
-							if sess, ok := c.calls[callID]; ok {
-								if sess.remoteAddr.Params == nil {
-									sess.remoteAddr.Params = sip.NewParams()
-								}
-								sess.remoteAddr.Params = sess.remoteAddr.Params.Add("tag", tag)
-							}
-							c.mu.Unlock()
-						}
-					}
-					if !res.IsProvisional() {
-						return
-					}
+			}
+			coreLog.Warnf("SIP target %s failed (%s), trying %s", targets[i].Addr, describeDialResult(result), targets[i+1].Addr)
+		}
+	}()
+
+	return callID, results, nil
+}
+
+// invite sends a single INVITE transaction and waits for its final response.
+// 2xx responses are acknowledged.
+func (c *SIPClient) invite(ctx context.Context, callID string, req sip.Request) (sip.Response, error) {
+	tx, err := c.srv.Request(req)
+	if err != nil {
+		return nil, fmt.Errorf("send invite: %w", err)
+	}
+	c.mu.Lock()
+	if sess, ok := c.calls[callID]; ok {
+		sess.clientTx = tx
+	}
+	c.mu.Unlock()
+
+	done := ctx.Done()
+	for {
+		select {
+		case <-done:
+			// Keep waiting for the final response: the callee may still
+			// answer before the CANCEL arrives.
+			done = nil
+			if err := tx.Cancel(); err != nil {
+				coreLog.Warnf("SIP cancel %s: %v", callID, err)
+			}
+		case res, ok := <-tx.Responses():
+			if !ok {
+				return nil, fmt.Errorf("call %s terminated without final response", callID)
+			}
+			if res == nil {
+				continue
+			}
+			coreLog.Infof("received SIP response: %d %s", res.StatusCode(), res.Reason())
+			c.checkViaMapping(res)
+			target := c.updateRemote(callID, res)
+			if res.IsProvisional() {
+				continue
+			}
+			if res.IsSuccess() {
+				ack := sip.NewAckRequest("", req, res, "", nil)
+				// The ACK goes to the Contact of the 2xx, route it again.
+				if target != nil {
+					ack.SetRecipient(target)
 				}
-			case err := <-tx.Errors():
-				if err != nil {
-					coreLog.Warnf("SIP transaction error: %v", err)
+				ack.RemoveHeader("Route")
+				c.prepare(ack)
+				if err := c.srv.Send(ack); err != nil {
+					coreLog.Warnf("SIP ACK %s: %v", callID, err)
 				}
-				return
-			case <-tx.Done():
-				return
 			}
+			return res, nil
+		case err := <-tx.Errors():
+			if err == nil {
+				err = fmt.Errorf("call %s transaction failed", callID)
+			}
+			coreLog.Warnf("SIP transaction error: %v", err)
+			return nil, err
+		case <-tx.Done():
+			return nil, fmt.Errorf("call %s transaction terminated", callID)
 		}
-	}()
+	}
+}
 
-	return nil
+// updateRemote stores the To tag and the remote target of a response for
+// in-dialog requests and returns the remote target, nil if not known.
+func (c *SIPClient) updateRemote(callID string, res sip.Response) sip.Uri {
+	var target sip.Uri
+	if res.IsSuccess() {
+		target = c.remoteTarget(res)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sess, ok := c.calls[callID]
+	if !ok {
+		return target
+	}
+	if target != nil {
+		sess.remoteTarget = target
+	}
+	if res.IsSuccess() {
+		sess.remoteSDP = res.Body()
+	}
+	if toHdr, ok := res.To(); ok && toHdr.Params != nil {
+		if tag, ok := toHdr.Params.Get("tag"); ok {
+			if sess.remoteAddr.Params == nil {
+				sess.remoteAddr.Params = sip.NewParams()
+			}
+			sess.remoteAddr.Params = sess.remoteAddr.Params.Add("tag", tag)
+		}
+	}
+	return target
 }
 
-// Answer answers an incoming call identified by callID.
+// SetLocalSDP sets the SDP answer sent when callID is answered.
+func (c *SIPClient) SetLocalSDP(callID, sdp string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sess, ok := c.calls[callID]; ok {
+		sess.localSDP = sdp
+	}
+}
+
+// Progress sends 183 Session Progress with sdp for the INVITE req, which
+// opens an early dialog for early media. It returns the To tag, which must
+// be set with SetLocalTag once the call is tracked.
+func (c *SIPClient) Progress(req sip.Request, sdp string) (string, error) {
+	res := sip.NewResponseFromRequest("", req, statusSessionProgress, "Session Progress", "")
+	tag := util.RandString(8)
+	toHdr, ok := res.To()
+	if ok {
+		toHdr.Params = toHdr.Params.Add("tag", sip.String{Str: tag})
+	}
+	reqTo, _ := req.To()
+	if reqTo != nil {
+		res.AppendHeader(c.contactAddress(reqTo.Address, req.Source()).AsContactHeader())
+	}
+	ctype := sip.ContentType("application/sdp")
+	res.AppendHeader(&ctype)
+	res.SetBody(sdp, true)
+	if _, err := c.srv.Respond(res); err != nil {
+		return "", fmt.Errorf("send 183: %w", err)
+	}
+	return tag, nil
+}
+
+// SetLocalTag sets the To tag a tracked INVITE was given by Progress.
+func (c *SIPClient) SetLocalTag(callID, tag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sess, ok := c.calls[callID]; ok {
+		sess.localTag = tag
+	}
+}
+
+// RemoteSDP returns the SDP of the 2xx answering callID.
+func (c *SIPClient) RemoteSDP(callID string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sess, ok := c.calls[callID]; ok {
+		return sess.remoteSDP
+	}
+	return ""
+}
+
+// Answer answers an incoming call identified by callID with 200 OK carrying
+// the local SDP. The To tag of the response, the one of an early dialog if
+// Progress opened it, becomes the local tag of the dialog.
 func (c *SIPClient) Answer(ctx context.Context, callID string) error {
 	coreLog.Infof("SIP Answer call %s", callID)
 	c.mu.Lock()
 	sess, ok := c.calls[callID]
-	c.mu.Unlock()
 	if !ok || sess.serverTx == nil || sess.inviteReq == nil {
+		c.mu.Unlock()
 		return fmt.Errorf("call %s not found", callID)
 	}
+	if sess.localTag == "" {
+		sess.localTag = util.RandString(8)
+	}
+	tag := sip.String{Str: sess.localTag}
+	if sess.localAddr.Params == nil {
+		sess.localAddr.Params = sip.NewParams()
+	}
+	sess.localAddr.Params = sess.localAddr.Params.Add("tag", tag)
+	req, contact, localSDP := sess.inviteReq, sess.contact, sess.localSDP
+	c.mu.Unlock()
 
-	res := sip.NewResponseFromRequest("", sess.inviteReq, statusOK, "OK", "")
-	tag := util.RandString(8)
+	res := sip.NewResponseFromRequest("", req, statusOK, "OK", "")
 	if toHdr, ok := res.To(); ok {
-		toHdr.Params = toHdr.Params.Add("tag", sip.String{Str: tag})
-		sess.localAddr.Params = sess.localAddr.Params.Add("tag", sip.String{Str: tag})
+		if toHdr.Params == nil {
+			toHdr.Params = sip.NewParams()
+		}
+		toHdr.Params = toHdr.Params.Add("tag", tag)
+	}
+	res.AppendHeader(contact.AsContactHeader())
+	if localSDP != "" {
+		ctype := sip.ContentType("application/sdp")
+		res.AppendHeader(&ctype)
+		res.SetBody(localSDP, true)
 	}
 	if _, err := c.srv.Respond(res); err != nil {
 		return fmt.Errorf("send 200 OK: %w", err)
@@ -185,6 +617,32 @@ func (c *SIPClient) Answer(ctx context.Context, callID string) error {
 	return nil
 }
 
+// Reject ends an incoming call identified by callID that was not answered
+// with a final non-2xx response and forgets it.
+func (c *SIPClient) Reject(callID string, status sip.StatusCode, reason string) error {
+	coreLog.Infof("SIP Reject call %s: %d %s", callID, status, reason)
+	c.mu.Lock()
+	sess, ok := c.calls[callID]
+	delete(c.calls, callID)
+	c.mu.Unlock()
+	if !ok || sess.inviteReq == nil {
+		return fmt.Errorf("call %s not found", callID)
+	}
+	res := sip.NewResponseFromRequest("", sess.inviteReq, status, reason, "")
+	if sess.localTag != "" {
+		if toHdr, ok := res.To(); ok {
+			if toHdr.Params == nil {
+				toHdr.Params = sip.NewParams()
+			}
+			toHdr.Params = toHdr.Params.Add("tag", sip.String{Str: sess.localTag})
+		}
+	}
+	if _, err := c.srv.Respond(res); err != nil {
+		return fmt.Errorf("send %d: %w", status, err)
+	}
+	return nil
+}
+
 // Hangup terminates a call identified by callID.
 func (c *SIPClient) Hangup(ctx context.Context, callID string) error {
 	coreLog.Infof("SIP Hangup call %s", callID)
@@ -198,13 +656,13 @@ func (c *SIPClient) Hangup(ctx context.Context, callID string) error {
 		return fmt.Errorf("call %s not found", callID)
 	}
 
-	cid := sip.CallID(callID)
+	cid := callIDHeader(callID)
 	rb := sip.NewRequestBuilder().
 		SetMethod(sip.BYE).
-		SetRecipient(sess.remoteAddr.Uri).
+		SetRecipient(sess.target()).
 		SetFrom(sess.localAddr).
 		SetTo(sess.remoteAddr).
-		SetContact(sess.localAddr).
+		SetContact(sess.contact).
 		SetCallID(&cid).
 		SetSeqNo(sess.cseq)
 
@@ -212,6 +670,7 @@ func (c *SIPClient) Hangup(ctx context.Context, callID string) error {
 	if err != nil {
 		return fmt.Errorf("build BYE: %w", err)
 	}
+	c.prepare(req)
 
 	if _, err := c.srv.Request(req); err != nil {
 		return fmt.Errorf("send BYE: %w", err)
@@ -237,14 +696,14 @@ func (c *SIPClient) DialDtmf(ctx context.Context, callID, digits string) error {
 	}
 
 	body := fmt.Sprintf("Signal=%s\r\nDuration=250\r\n", digits)
-	cid := sip.CallID(callID)
+	cid := callIDHeader(callID)
 	ctype := sip.ContentType("application/dtmf-relay")
 	rb := sip.NewRequestBuilder().
 		SetMethod(sip.INFO).
-		SetRecipient(sess.remoteAddr.Uri).
+		SetRecipient(sess.target()).
 		SetFrom(sess.localAddr).
 		SetTo(sess.remoteAddr).
-		SetContact(sess.localAddr).
+		SetContact(sess.contact).
 		SetCallID(&cid).
 		SetSeqNo(sess.cseq).
 		SetContentType(&ctype).
@@ -254,15 +713,9 @@ func (c *SIPClient) DialDtmf(ctx context.Context, callID, digits string) error {
 	if err != nil {
 		return fmt.Errorf("build INFO: %w", err)
 	}
+	c.prepare(req)
 	if _, err := c.srv.Request(req); err != nil {
 		return fmt.Errorf("send INFO: %w", err)
 	}
 	return nil
 }
-
-// BridgeAudio connects audio between two calls.
-func (c *SIPClient) BridgeAudio(ctx context.Context, srcID, dstID string) error {
-	coreLog.Infof("SIP BridgeAudio %s <-> %s", srcID, dstID)
-	tgvoip.ConnectSIPMedia(tgvoip.NewController(), func([]int16) {}, func([]int16) {})
-	return nil
-}
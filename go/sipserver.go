@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	gosip "github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// rehostableServer is a gosip.Server whose advertised host can be changed.
+// gosip writes the host it was created with into the Via header of every
+// request, so a changed public address needs a new server: the listener is
+// closed and opened again on the same address with the new host, and the
+// request handlers are registered again. Transactions pending on the old
+// server are lost; dialogs survive as their requests use new transactions.
+type rehostableServer struct {
+	create func(host string) gosip.Server
+
+	mu       sync.RWMutex
+	srv      gosip.Server
+	network  string
+	addr     string
+	handlers map[sip.RequestMethod]gosip.RequestHandler
+}
+
+// newRehostableServer creates a server advertising host. create builds a
+// server for a host without listening.
+func newRehostableServer(host string, create func(host string) gosip.Server) *rehostableServer {
+	return &rehostableServer{
+		create:   create,
+		srv:      create(host),
+		handlers: make(map[sip.RequestMethod]gosip.RequestHandler),
+	}
+}
+
+func (s *rehostableServer) current() gosip.Server {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.srv
+}
+
+// Rehost replaces the server by one advertising host.
+func (s *rehostableServer) Rehost(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.srv.Shutdown()
+	s.srv = s.create(host)
+	for method, handler := range s.handlers {
+		if err := s.srv.OnRequest(method, handler); err != nil {
+			return err
+		}
+	}
+	if err := s.srv.Listen(s.network, s.addr); err != nil {
+		return fmt.Errorf("sip listen: %w", err)
+	}
+	return nil
+}
+
+func (s *rehostableServer) Shutdown() { s.current().Shutdown() }
+
+// Listen opens the listener; a rehosted server listens on the same address.
+// Listen options are not kept.
+func (s *rehostableServer) Listen(network, addr string, options ...transport.ListenOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.srv.Listen(network, addr, options...); err != nil {
+		return err
+	}
+	s.network, s.addr = network, addr
+	return nil
+}
+
+func (s *rehostableServer) Send(msg sip.Message) error { return s.current().Send(msg) }
+
+func (s *rehostableServer) Request(req sip.Request) (sip.ClientTransaction, error) {
+	return s.current().Request(req)
+}
+
+func (s *rehostableServer) RequestWithContext(ctx context.Context, req sip.Request, options ...gosip.RequestWithContextOption) (sip.Response, error) {
+	return s.current().RequestWithContext(ctx, req, options...)
+}
+
+func (s *rehostableServer) OnRequest(method sip.RequestMethod, handler gosip.RequestHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = handler
+	return s.srv.OnRequest(method, handler)
+}
+
+func (s *rehostableServer) Respond(res sip.Response) (sip.ServerTransaction, error) {
+	return s.current().Respond(res)
+}
+
+func (s *rehostableServer) RespondOnRequest(req sip.Request, status sip.StatusCode, reason, body string, headers []sip.Header) (sip.ServerTransaction, error) {
+	return s.current().RespondOnRequest(req, status, reason, body, headers)
+}
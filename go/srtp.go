@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SRTP policies of a trunk.
+const (
+	srtpOff       = "off"       // plain RTP, encrypted offers are rejected
+	srtpOptional  = "optional"  // encrypt if the peer supports SDES
+	srtpMandatory = "mandatory" // refuse calls without SRTP
+)
+
+// SDES crypto suites (RFC 4568 6.2).
+const (
+	suiteAES80 = "AES_CM_128_HMAC_SHA1_80"
+	suiteAES32 = "AES_CM_128_HMAC_SHA1_32"
+)
+
+const (
+	srtpKeyLen      = 16
+	srtpSaltLen     = 14
+	srtpAuthKeyLen  = 20
+	srtcpTagLen     = 10 // SRTCP always uses 80 bit tags (RFC 4568 6.2.1)
+	srtpReplayWidth = 64
+)
+
+// srtpTagLens maps supported suites to their SRTP authentication tag length.
+var srtpTagLens = map[string]int{suiteAES80: 10, suiteAES32: 4}
+
+var (
+	errSRTPAuth   = errors.New("SRTP authentication failed")
+	errSRTPReplay = errors.New("SRTP packet replayed")
+	errSRTPShort  = errors.New("SRTP packet too short")
+)
+
+// cryptoAttribute is an SDP a=crypto line with an inline master key.
+type cryptoAttribute struct {
+	Tag   int
+	Suite string
+	Key   []byte // master key followed by master salt
+}
+
+// newCryptoAttribute creates an attribute with a random master key.
+func newCryptoAttribute(tag int, suite string) (*cryptoAttribute, error) {
+	key := make([]byte, srtpKeyLen+srtpSaltLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &cryptoAttribute{Tag: tag, Suite: suite, Key: key}, nil
+}
+
+// parseCryptoAttribute parses the value of an a=crypto attribute, e.g.
+// "1 AES_CM_128_HMAC_SHA1_80 inline:<base64>|2^31". Lifetimes are ignored;
+// MKIs and several keys are not supported.
+func parseCryptoAttribute(v string) (*cryptoAttribute, error) {
+	fields := strings.Fields(v)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid crypto attribute %q", v)
+	}
+	tag, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid crypto tag %q", fields[0])
+	}
+	params := strings.TrimPrefix(fields[2], "inline:")
+	if params == fields[2] || strings.Contains(params, ";") {
+		return nil, fmt.Errorf("unsupported crypto key parameters %q", fields[2])
+	}
+	keyParts := strings.Split(params, "|")
+	for _, p := range keyParts[1:] {
+		if strings.Contains(p, ":") {
+			return nil, errors.New("crypto keys with MKI are not supported")
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(keyParts[0])
+	if err != nil {
+		// Some implementations omit the padding.
+		if key, err = base64.RawStdEncoding.DecodeString(keyParts[0]); err != nil {
+			return nil, fmt.Errorf("invalid crypto key: %w", err)
+		}
+	}
+	if len(key) != srtpKeyLen+srtpSaltLen {
+		return nil, fmt.Errorf("crypto key has %d bytes, want %d", len(key), srtpKeyLen+srtpSaltLen)
+	}
+	return &cryptoAttribute{Tag: tag, Suite: fields[1], Key: key}, nil
+}
+
+func (a *cryptoAttribute) String() string {
+	return fmt.Sprintf("%d %s inline:%s", a.Tag, a.Suite, base64.StdEncoding.EncodeToString(a.Key))
+}
+
+// supported reports whether the suite of a is implemented.
+func (a *cryptoAttribute) supported() bool {
+	_, ok := srtpTagLens[a.Suite]
+	return ok
+}
+
+// srtpSession protects outgoing and verifies incoming media of a call.
+type srtpSession struct {
+	out *srtpContext
+	in  *srtpContext
+}
+
+// newSRTPSession creates a session sending with the local key and receiving
+// with the remote key.
+func newSRTPSession(local, remote *cryptoAttribute) (*srtpSession, error) {
+	out, err := newSRTPContext(local)
+	if err != nil {
+		return nil, err
+	}
+	in, err := newSRTPContext(remote)
+	if err != nil {
+		return nil, err
+	}
+	return &srtpSession{out: out, in: in}, nil
+}
+
+// Protect encrypts and authenticates an RTP packet.
+func (s *srtpSession) Protect(pkt []byte) ([]byte, error) { return s.out.protectRTP(pkt) }
+
+// Unprotect verifies and decrypts an SRTP packet.
+func (s *srtpSession) Unprotect(pkt []byte) ([]byte, error) { return s.in.unprotectRTP(pkt) }
+
+// ProtectRTCP encrypts and authenticates an RTCP packet.
+func (s *srtpSession) ProtectRTCP(pkt []byte) ([]byte, error) { return s.out.protectRTCP(pkt) }
+
+// UnprotectRTCP verifies and decrypts an SRTCP packet.
+func (s *srtpSession) UnprotectRTCP(pkt []byte) ([]byte, error) { return s.in.unprotectRTCP(pkt) }
+
+// srtpContext is the cryptographic state of one direction (RFC 3711). It
+// is not safe for concurrent use; each direction is driven by one goroutine.
+type srtpContext struct {
+	tagLen int
+
+	rtpBlock  cipher.Block
+	rtpSalt   []byte
+	rtpAuth   hash.Hash
+	rtcpBlock cipher.Block
+	rtcpSalt  []byte
+	rtcpAuth  hash.Hash
+
+	streams   map[uint32]*srtpStream
+	rtcpIndex uint32
+	rtcpSeen  replayWindow
+}
+
+// srtpStream tracks the packet index of one SSRC.
+type srtpStream struct {
+	roc     uint32
+	lastSeq uint16
+	started bool
+	seen    replayWindow
+}
+
+func newSRTPContext(a *cryptoAttribute) (*srtpContext, error) {
+	tagLen, ok := srtpTagLens[a.Suite]
+	if !ok {
+		return nil, fmt.Errorf("unsupported crypto suite %s", a.Suite)
+	}
+	masterKey, masterSalt := a.Key[:srtpKeyLen], a.Key[srtpKeyLen:]
+	c := &srtpContext{tagLen: tagLen, streams: make(map[uint32]*srtpStream)}
+	var err error
+	derive := func(label byte, n int) []byte {
+		if err != nil {
+			return nil
+		}
+		var out []byte
+		out, err = srtpDeriveKey(masterKey, masterSalt, label, n)
+		return out
+	}
+	rtpKey, rtpAuth := derive(0, srtpKeyLen), derive(1, srtpAuthKeyLen)
+	c.rtpSalt = derive(2, srtpSaltLen)
+	rtcpKey, rtcpAuth := derive(3, srtpKeyLen), derive(4, srtpAuthKeyLen)
+	c.rtcpSalt = derive(5, srtpSaltLen)
+	if err != nil {
+		return nil, err
+	}
+	if c.rtpBlock, err = aes.NewCipher(rtpKey); err != nil {
+		return nil, err
+	}
+	if c.rtcpBlock, err = aes.NewCipher(rtcpKey); err != nil {
+		return nil, err
+	}
+	c.rtpAuth = hmac.New(sha1.New, rtpAuth)
+	c.rtcpAuth = hmac.New(sha1.New, rtcpAuth)
+	return c, nil
+}
+
+// srtpDeriveKey is the AES-CM key derivation function with a key derivation
+// rate of zero (RFC 3711 4.3).
+func srtpDeriveKey(masterKey, masterSalt []byte, label byte, n int) ([]byte, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, masterSalt)
+	iv[7] ^= label
+	out := make([]byte, n)
+	cipher.NewCTR(block, iv).XORKeyStream(out, out)
+	return out, nil
+}
+
+// srtpIV builds the AES-CM counter of a packet (RFC 3711 4.1.1).
+func srtpIV(salt []byte, ssrc uint32, index uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], ssrc)
+	for i := range b {
+		iv[4+i] ^= b[i]
+	}
+	for i := 0; i < 6; i++ {
+		iv[8+i] ^= byte(index >> (8 * (5 - i)))
+	}
+	return iv
+}
+
+// rtpHeaderLen returns the length of the RTP header including CSRCs and
+// the header extension.
+func rtpHeaderLen(pkt []byte) (int, error) {
+	if len(pkt) < 12 || pkt[0]>>6 != 2 {
+		return 0, errors.New("not an RTP packet")
+	}
+	n := 12 + 4*int(pkt[0]&0x0f)
+	if pkt[0]&0x10 != 0 {
+		if len(pkt) < n+4 {
+			return 0, errSRTPShort
+		}
+		n += 4 + 4*int(binary.BigEndian.Uint16(pkt[n+2:]))
+	}
+	if len(pkt) < n {
+		return 0, errSRTPShort
+	}
+	return n, nil
+}
+
+func (c *srtpContext) stream(ssrc uint32) *srtpStream {
+	s, ok := c.streams[ssrc]
+	if !ok {
+		s = &srtpStream{}
+		c.streams[ssrc] = s
+	}
+	return s
+}
+
+// estimateIndex guesses the rollover counter of seq (RFC 3711 3.3.1).
+func (s *srtpStream) estimateIndex(seq uint16) (roc uint32, index uint64) {
+	roc = s.roc
+	if s.started {
+		switch {
+		case s.lastSeq < 1<<15 && int(seq)-int(s.lastSeq) > 1<<15 && roc > 0:
+			roc--
+		case s.lastSeq >= 1<<15 && int(s.lastSeq)-int(seq) > 1<<15:
+			roc++
+		}
+	}
+	return roc, uint64(roc)<<16 | uint64(seq)
+}
+
+// update records seq after a packet was accepted or sent.
+func (s *srtpStream) update(roc uint32, seq uint16) {
+	if !s.started || roc > s.roc || (roc == s.roc && seq > s.lastSeq) {
+		s.roc, s.lastSeq = roc, seq
+	}
+	s.started = true
+}
+
+func (c *srtpContext) rtpTag(authenticated []byte, roc uint32) []byte {
+	c.rtpAuth.Reset()
+	c.rtpAuth.Write(authenticated)
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], roc)
+	c.rtpAuth.Write(b[:])
+	return c.rtpAuth.Sum(nil)[:c.tagLen]
+}
+
+func (c *srtpContext) protectRTP(pkt []byte) ([]byte, error) {
+	hdr, err := rtpHeaderLen(pkt)
+	if err != nil {
+		return nil, err
+	}
+	seq := binary.BigEndian.Uint16(pkt[2:])
+	ssrc := binary.BigEndian.Uint32(pkt[8:])
+	s := c.stream(ssrc)
+	if s.started && seq < s.lastSeq && s.lastSeq-seq > 1<<15 {
+		s.roc++
+	}
+	s.lastSeq, s.started = seq, true
+	index := uint64(s.roc)<<16 | uint64(seq)
+
+	out := make([]byte, len(pkt), len(pkt)+c.tagLen)
+	copy(out, pkt)
+	cipher.NewCTR(c.rtpBlock, srtpIV(c.rtpSalt, ssrc, index)).XORKeyStream(out[hdr:], out[hdr:])
+	return append(out, c.rtpTag(out, s.roc)...), nil
+}
+
+func (c *srtpContext) unprotectRTP(pkt []byte) ([]byte, error) {
+	if len(pkt) < 12+c.tagLen {
+		return nil, errSRTPShort
+	}
+	body, tag := pkt[:len(pkt)-c.tagLen], pkt[len(pkt)-c.tagLen:]
+	hdr, err := rtpHeaderLen(body)
+	if err != nil {
+		return nil, err
+	}
+	seq := binary.BigEndian.Uint16(body[2:])
+	ssrc := binary.BigEndian.Uint32(body[8:])
+	s := c.stream(ssrc)
+	roc, index := s.estimateIndex(seq)
+	if s.started && !s.seen.check(index) {
+		return nil, errSRTPReplay
+	}
+	if !hmac.Equal(tag, c.rtpTag(body, roc)) {
+		return nil, errSRTPAuth
+	}
+	out := make([]byte, len(body))
+	copy(out, body)
+	cipher.NewCTR(c.rtpBlock, srtpIV(c.rtpSalt, ssrc, index)).XORKeyStream(out[hdr:], out[hdr:])
+	s.seen.accept(index)
+	s.update(roc, seq)
+	return out, nil
+}
+
+func (c *srtpContext) rtcpTag(authenticated []byte) []byte {
+	c.rtcpAuth.Reset()
+	c.rtcpAuth.Write(authenticated)
+	return c.rtcpAuth.Sum(nil)[:srtcpTagLen]
+}
+
+// protectRTCP encrypts a compound RTCP packet. The SRTCP index with the
+// E flag set follows the encrypted part (RFC 3711 3.4).
+func (c *srtpContext) protectRTCP(pkt []byte) ([]byte, error) {
+	if len(pkt) < 8 {
+		return nil, errSRTPShort
+	}
+	ssrc := binary.BigEndian.Uint32(pkt[4:])
+	index := c.rtcpIndex
+	c.rtcpIndex = (c.rtcpIndex + 1) & 0x7fffffff
+
+	out := make([]byte, len(pkt), len(pkt)+4+srtcpTagLen)
+	copy(out, pkt)
+	cipher.NewCTR(c.rtcpBlock, srtpIV(c.rtcpSalt, ssrc, uint64(index))).XORKeyStream(out[8:], out[8:])
+	out = binary.BigEndian.AppendUint32(out, index|1<<31)
+	return append(out, c.rtcpTag(out)...), nil
+}
+
+func (c *srtpContext) unprotectRTCP(pkt []byte) ([]byte, error) {
+	if len(pkt) < 8+4+srtcpTagLen {
+		return nil, errSRTPShort
+	}
+	body, tag := pkt[:len(pkt)-srtcpTagLen], pkt[len(pkt)-srtcpTagLen:]
+	if !hmac.Equal(tag, c.rtcpTag(body)) {
+		return nil, errSRTPAuth
+	}
+	e := binary.BigEndian.Uint32(body[len(body)-4:])
+	body = body[:len(body)-4]
+	index := e & 0x7fffffff
+	if !c.rtcpSeen.check(uint64(index)) {
+		return nil, errSRTPReplay
+	}
+	c.rtcpSeen.accept(uint64(index))
+	out := make([]byte, len(body))
+	copy(out, body)
+	if e&(1<<31) != 0 {
+		ssrc := binary.BigEndian.Uint32(body[4:])
+		cipher.NewCTR(c.rtcpBlock, srtpIV(c.rtcpSalt, ssrc, uint64(index))).XORKeyStream(out[8:], out[8:])
+	}
+	return out, nil
+}
+
+// replayWindow remembers the most recent packet indices (RFC 3711 3.3.2).
+type replayWindow struct {
+	top     uint64
+	bitmap  uint64 // bit i set if index top-i was received
+	started bool
+}
+
+func (w *replayWindow) check(index uint64) bool {
+	if !w.started || index > w.top {
+		return true
+	}
+	diff := w.top - index
+	return diff < srtpReplayWidth && w.bitmap&(1<<diff) == 0
+}
+
+func (w *replayWindow) accept(index uint64) {
+	switch {
+	case !w.started:
+		w.top, w.bitmap, w.started = index, 1, true
+	case index > w.top:
+		shift := index - w.top
+		if shift >= srtpReplayWidth {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.top = index
+	default:
+		w.bitmap |= 1 << (w.top - index)
+	}
+}
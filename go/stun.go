@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// STUN message constants (RFC 5389, RFC 5780).
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingSuccess  = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunHeaderLen       = 20
+	stunMappedAddress   = 0x0001
+	stunXORMappedAddr   = 0x0020
+	stunOtherAddress    = 0x802c
+	stunDefaultPort     = "3478"
+	stunRetransmissions = 4
+	stunInitialRTO      = 500 * time.Millisecond
+)
+
+// The Binding request for an RTP port is made while a call is set up, so it
+// gives up after 300 ms. The server address is resolved again after
+// stunResolveInterval.
+const (
+	stunMediaAttempts   = 2
+	stunMediaRTO        = 100 * time.Millisecond
+	stunResolveInterval = 5 * time.Minute
+)
+
+// NAT types reported by classifyNAT.
+const (
+	natNone          = "no NAT"
+	natIndependent   = "endpoint-independent mapping (cone NAT)"
+	natSymmetric     = "address-dependent mapping (symmetric NAT)"
+	natUndetermined  = "NAT with unknown mapping behaviour"
+	natNoOtherServer = "STUN server does not report OTHER-ADDRESS"
+)
+
+var errSTUNMalformed = errors.New("malformed STUN response")
+
+// stunResult is the outcome of a Binding transaction.
+type stunResult struct {
+	Mapped *net.UDPAddr
+	Other  *net.UDPAddr // alternate server address, nil if not offered
+}
+
+// stunBinding sends a Binding request from conn to server and returns the
+// mapped address. The request is sent up to attempts times, waiting rto for
+// the first response and twice as long for each retransmission.
+func stunBinding(conn net.PacketConn, server *net.UDPAddr, rto time.Duration, attempts int) (*stunResult, error) {
+	req := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, err
+	}
+	txID := req[8:20]
+
+	buf := make([]byte, 1500)
+	for i := 0; i < attempts; i++ {
+		if _, err := conn.WriteTo(req, server); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(rto)
+		conn.SetReadDeadline(deadline)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n < stunHeaderLen || !bytes.Equal(buf[8:20], txID) {
+				continue
+			}
+			conn.SetReadDeadline(time.Time{})
+			return parseSTUNResponse(buf[:n])
+		}
+		rto *= 2
+	}
+	conn.SetReadDeadline(time.Time{})
+	return nil, fmt.Errorf("stun %s: no response", server)
+}
+
+func parseSTUNResponse(msg []byte) (*stunResult, error) {
+	if binary.BigEndian.Uint16(msg[0:]) != stunBindingSuccess ||
+		binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie {
+		return nil, fmt.Errorf("unexpected STUN message type %#04x", binary.BigEndian.Uint16(msg[0:]))
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	if stunHeaderLen+length > len(msg) {
+		return nil, errSTUNMalformed
+	}
+	res := &stunResult{}
+	var mapped *net.UDPAddr
+	for off := stunHeaderLen; off+4 <= stunHeaderLen+length; {
+		typ := binary.BigEndian.Uint16(msg[off:])
+		l := int(binary.BigEndian.Uint16(msg[off+2:]))
+		val := off + 4
+		if val+l > len(msg) {
+			return nil, errSTUNMalformed
+		}
+		switch typ {
+		case stunXORMappedAddr:
+			addr, err := parseSTUNAddress(msg[val:val+l], msg[4:20])
+			if err != nil {
+				return nil, err
+			}
+			res.Mapped = addr
+		case stunMappedAddress:
+			addr, err := parseSTUNAddress(msg[val:val+l], nil)
+			if err != nil {
+				return nil, err
+			}
+			mapped = addr
+		case stunOtherAddress:
+			if addr, err := parseSTUNAddress(msg[val:val+l], nil); err == nil {
+				res.Other = addr
+			}
+		}
+		off = val + (l+3)&^3 // attributes are padded to 4 bytes
+	}
+	if res.Mapped == nil {
+		res.Mapped = mapped
+	}
+	if res.Mapped == nil {
+		return nil, errors.New("STUN response without mapped address")
+	}
+	return res, nil
+}
+
+// parseSTUNAddress decodes a (XOR-)MAPPED-ADDRESS value. xor holds the magic
+// cookie and transaction ID for XOR-MAPPED-ADDRESS and is nil otherwise.
+func parseSTUNAddress(v, xor []byte) (*net.UDPAddr, error) {
+	if len(v) < 4 {
+		return nil, errSTUNMalformed
+	}
+	var ipLen int
+	switch v[1] {
+	case 0x01:
+		ipLen = net.IPv4len
+	case 0x02:
+		ipLen = net.IPv6len
+	default:
+		return nil, errSTUNMalformed
+	}
+	if len(v) < 4+ipLen {
+		return nil, errSTUNMalformed
+	}
+	port := binary.BigEndian.Uint16(v[2:])
+	ip := make(net.IP, ipLen)
+	copy(ip, v[4:4+ipLen])
+	if xor != nil {
+		port ^= stunMagicCookie >> 16
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// resolveSTUNServer resolves "host[:port]" of a STUN server.
+func resolveSTUNServer(server string) (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr("udp4", withDefaultPort(server, stunDefaultPort))
+}
+
+// stunServer is a STUN server whose address is resolved once and reused, so
+// that looking up the mapping of a socket does not wait for DNS. It is safe
+// for concurrent use.
+type stunServer struct {
+	name string
+
+	mu       sync.Mutex
+	addr     *net.UDPAddr
+	resolved time.Time
+}
+
+// newSTUNServer creates a stunServer for "host[:port]" and resolves it.
+func newSTUNServer(name string) *stunServer {
+	s := &stunServer{name: name}
+	if _, err := s.Addr(); err != nil {
+		coreLog.Warnf("resolve STUN server %s: %v", name, err)
+	}
+	return s
+}
+
+// Addr returns the address of the server. A failed lookup keeps the last
+// known address.
+func (s *stunServer) Addr() (*net.UDPAddr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.addr != nil && time.Since(s.resolved) < stunResolveInterval {
+		return s.addr, nil
+	}
+	addr, err := resolveSTUNServer(s.name)
+	if err != nil {
+		if s.addr != nil {
+			return s.addr, nil
+		}
+		return nil, err
+	}
+	s.addr, s.resolved = addr, time.Now()
+	return addr, nil
+}
+
+// MappedAddr discovers the public address of an existing socket, e.g. an
+// RTP port, within the short timeout of call setup.
+func (s *stunServer) MappedAddr(conn net.PacketConn) (*net.UDPAddr, error) {
+	srv, err := s.Addr()
+	if err != nil {
+		return nil, err
+	}
+	res, err := stunBinding(conn, srv, stunMediaRTO, stunMediaAttempts)
+	if err != nil {
+		return nil, err
+	}
+	return res.Mapped, nil
+}
+
+// discoverPublicAddress binds localAddr, asks server for the mapped address
+// and classifies the NAT by repeating the request to the alternate address
+// the server reports. The socket is closed before returning so that the
+// port can be reused.
+func discoverPublicAddress(localAddr, server string) (*net.UDPAddr, string, error) {
+	srv, err := resolveSTUNServer(server)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := net.ListenPacket("udp4", localAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+
+	res, err := stunBinding(conn, srv, stunInitialRTO, stunRetransmissions)
+	if err != nil {
+		return nil, "", err
+	}
+	var second *net.UDPAddr
+	if res.Other != nil {
+		if r, err := stunBinding(conn, res.Other, stunInitialRTO, stunRetransmissions); err == nil {
+			second = r.Mapped
+		}
+	}
+	return res.Mapped, classifyNAT(conn.LocalAddr().(*net.UDPAddr), res.Mapped, second, res.Other != nil), nil
+}
+
+// classifyNAT derives the NAT mapping behaviour from the mapped addresses
+// seen by two STUN server addresses.
+func classifyNAT(local, first, second *net.UDPAddr, hasOther bool) string {
+	switch {
+	case first.Port == local.Port && (local.IP.IsUnspecified() || first.IP.Equal(local.IP)):
+		return natNone
+	case !hasOther:
+		return natNoOtherServer
+	case second == nil:
+		return natUndetermined
+	case second.IP.Equal(first.IP) && second.Port == first.Port:
+		return natIndependent
+	default:
+		return natSymmetric
+	}
+}
+
+// advertisedAddress is the address the gateway places in Contact headers
+// and SDP. It may change when STUN detects a new mapping. host6 is the IPv6
+// address offered to IPv6 peers on dual-stack hosts. It is safe for
+// concurrent use.
+type advertisedAddress struct {
+	mu    sync.RWMutex
+	host  string
+	host6 string
+	port  int
+	port6 int
+}
+
+func (a *advertisedAddress) set(host string, port int) {
+	a.mu.Lock()
+	a.host, a.port = host, port
+	a.mu.Unlock()
+}
+
+func (a *advertisedAddress) setIPv6(host string, port int) {
+	a.mu.Lock()
+	a.host6, a.port6 = host, port
+	a.mu.Unlock()
+}
+
+// Host returns the advertised host, empty if not known yet.
+func (a *advertisedAddress) Host() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.host
+}
+
+// HostPort returns the advertised "host:port".
+func (a *advertisedAddress) HostPort() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return net.JoinHostPort(a.host, strconv.Itoa(a.port))
+}
+
+// HostFor returns the advertised host of the address family of peer, an IP
+// literal or "ip:port". IPv4 is used if no IPv6 address is advertised.
+func (a *advertisedAddress) HostFor(peer string) string {
+	host, _ := a.hostPortFor(peer)
+	return host
+}
+
+// HostPortFor returns "host:port" for peer, see HostFor.
+func (a *advertisedAddress) HostPortFor(peer string) string {
+	host, port := a.hostPortFor(peer)
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func (a *advertisedAddress) hostPortFor(peer string) (string, int) {
+	if h, _, err := net.SplitHostPort(peer); err == nil {
+		peer = h
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.host6 != "" && isIPv6(peer) {
+		return a.host6, a.port6
+	}
+	return a.host, a.port
+}
+
+// watchPublicAddress periodically repeats STUN discovery from an ephemeral
+// port and updates addr and the Via host of srv when the public IP changes.
+func watchPublicAddress(ctx context.Context, server string, interval time.Duration, addr *advertisedAddress, srv *rehostableServer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		mapped, _, err := discoverPublicAddress(":0", server)
+		if err != nil {
+			coreLog.Warnf("STUN refresh via %s failed: %v", server, err)
+			continue
+		}
+		host := mapped.IP.String()
+		if old := addr.Host(); old != host {
+			addr.mu.Lock()
+			addr.host = host
+			addr.mu.Unlock()
+			coreLog.Warnf("public address changed from %s to %s, restarting the SIP listener", old, host)
+			if err := srv.Rehost(host); err != nil {
+				coreLog.Errorf("restart SIP listener for %s: %v", host, err)
+			}
+		}
+	}
+}
@@ -1,42 +1,86 @@
 package main
 
 import (
+	"fmt"
+
 	client "github.com/zelenin/go-tdlib/client"
 	"tg2sip/tgvoip"
 )
 
-// createTelegramCall starts a Telegram call to the specified user.
-func createTelegramCall(cl *client.Client, userID int64) error {
-	protocol := &client.CallProtocol{UdpP2p: true, UdpReflector: true, MinLayer: 65, MaxLayer: 92}
-	if _, err := cl.CreateCall(&client.CreateCallRequest{UserId: userID, Protocol: protocol}); err != nil {
-		return err
-	}
+// callProtocol is the protocol offered for Telegram calls.
+var callProtocol = &client.CallProtocol{UdpP2p: true, UdpReflector: true, MinLayer: 65, MaxLayer: 92}
 
-	ctrl := tgvoip.NewController()
-	key := make([]byte, 256)
-	eps := []tgvoip.Endpoint{{ID: 1, IPv4: "0.0.0.0", Port: 0}}
-	opts := tgvoip.DSPOptions{EchoCancellation: true, NoiseSuppression: true, AutoGain: true}
-	_ = ctrl.Configure(key, eps, opts)
-	ctrl.SetAudioCallbacks(func([]int16) {}, func([]int16) {})
-	ctrl.Close()
-	return nil
+// createTelegramCall starts a Telegram call to the specified user and
+// returns its ID. The voice connection is set up once the call is ready.
+func createTelegramCall(cl *client.Client, userID int64) (int64, error) {
+	id, err := cl.CreateCall(&client.CreateCallRequest{UserId: userID, Protocol: callProtocol})
+	if err != nil {
+		return 0, err
+	}
+	return int64(id.Id), nil
 }
 
 // acceptTelegramCall accepts an incoming Telegram call.
 func acceptTelegramCall(cl *client.Client, callID int64) error {
-	protocol := &client.CallProtocol{UdpP2p: true, UdpReflector: true, MinLayer: 65, MaxLayer: 92}
-	if _, err := cl.AcceptCall(&client.AcceptCallRequest{CallId: int32(callID), Protocol: protocol}); err != nil {
-		return err
+	_, err := cl.AcceptCall(&client.AcceptCallRequest{CallId: int32(callID), Protocol: callProtocol})
+	return err
+}
+
+// callEndpoints converts the servers of a ready Telegram call to tgvoip
+// endpoints. Reflectors advertising IPv6 are passed with both addresses.
+// WebRTC and TCP servers are skipped since libtgvoip only relays over UDP.
+func callEndpoints(servers []*client.CallServer) []tgvoip.Endpoint {
+	var eps []tgvoip.Endpoint
+	for _, srv := range servers {
+		refl, ok := srv.Type.(*client.CallServerTypeTelegramReflector)
+		if !ok || refl.IsTcp {
+			continue
+		}
+		eps = append(eps, tgvoip.Endpoint{
+			ID:      int64(srv.Id),
+			IPv4:    srv.IpAddress,
+			IPv6:    srv.Ipv6Address,
+			Port:    int(srv.Port),
+			PeerTag: refl.PeerTag,
+		})
 	}
+	return eps
+}
 
+// configureTelegramMedia creates a tgvoip controller for a ready call,
+// outgoing if the gateway placed it.
+func configureTelegramMedia(cfg *AccountSettings, ready *client.CallStateReady, outgoing bool) (tgvoip.Controller, error) {
+	eps := callEndpoints(ready.Servers)
+	if len(eps) == 0 {
+		return nil, fmt.Errorf("no usable call servers among %d", len(ready.Servers))
+	}
 	ctrl := tgvoip.NewController()
-	key := make([]byte, 256)
-	eps := []tgvoip.Endpoint{{ID: 1, IPv4: "0.0.0.0", Port: 0}}
-	opts := tgvoip.DSPOptions{EchoCancellation: true, NoiseSuppression: true, AutoGain: true}
-	_ = ctrl.Configure(key, eps, opts)
-	ctrl.SetAudioCallbacks(func([]int16) {}, func([]int16) {})
-	ctrl.Close()
-	return nil
+	opts := tgvoip.DSPOptions{EchoCancellation: cfg.AECEnabled(), NoiseSuppression: cfg.NSEnabled(), AutoGain: cfg.AGCEnabled()}
+	if err := ctrl.Configure(ready.EncryptionKey, outgoing, eps, opts); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetNetworkType(tgvoip.NetworkEthernet)
+	return ctrl, nil
+}
+
+// tgvoipMedia adapts a tgvoip controller to the call Controller interface.
+type tgvoipMedia struct {
+	tgvoip.Controller
+}
+
+func (m tgvoipMedia) Stop() {
+	m.Controller.Stop()
+	m.Close()
+}
+
+// logStats records the traffic of the Telegram leg of call callID.
+func (m tgvoipMedia) logStats(callID string) {
+	s := m.Stats()
+	sent, received := s.BytesSentWiFi+s.BytesSentMobile, s.BytesReceivedWiFi+s.BytesReceivedMobile
+	coreLog.Infof("call %s tgvoip: %d bytes sent, %d received via relay %d", callID, sent, received, m.PreferredRelayID())
+	metrics.Add("tgvoip_bytes_sent", int64(sent))
+	metrics.Add("tgvoip_bytes_received", int64(received))
 }
 
 // discardTelegramCall terminates an ongoing Telegram call.
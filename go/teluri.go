@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// telHost is the host of the sip: URIs that stand in for tel: URIs, which
+// have none.
+const telHost = "localhost"
+
+// telToSIP maps a tel: URI to the equivalent sip: URI with user=phone
+// (RFC 3261 19.1.6). Parameters of the number stay in the user part,
+// escaped, so that telephoneSubscriber sees them.
+func telToSIP(uri string) string {
+	subscriber := strings.ReplaceAll(uri[len("tel:"):], ";", "%3B")
+	return "sip:" + subscriber + "@" + telHost + ";user=phone"
+}
+
+// rewriteTelURIs replaces the tel: URIs of the request line and the To and
+// From headers of the SIP message in msg, which gosip cannot parse. Other
+// messages are returned unchanged.
+func rewriteTelURIs(msg []byte) []byte {
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	if end < 0 || !bytes.Contains(bytes.ToLower(msg[:end]), []byte("tel:")) {
+		return msg
+	}
+	lines := strings.Split(string(msg[:end]), "\r\n")
+	changed := false
+	if parts := strings.Split(lines[0], " "); len(parts) == 3 && hasTelScheme(parts[1]) {
+		parts[1] = telToSIP(parts[1])
+		lines[0] = strings.Join(parts, " ")
+		changed = true
+	}
+	for i, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "to", "t", "from", "f":
+		default:
+			continue
+		}
+		if v, ok := rewriteTelAddress(value); ok {
+			lines[i+1] = name + ":" + v
+			changed = true
+		}
+	}
+	if !changed {
+		return msg
+	}
+	out := []byte(strings.Join(lines, "\r\n"))
+	return append(out, msg[end:]...)
+}
+
+// rewriteTelAddress replaces a tel: URI in a name-addr or addr-spec header
+// value. The parameters of an addr-spec belong to the header.
+func rewriteTelAddress(value string) (string, bool) {
+	if start := strings.IndexByte(value, '<'); start >= 0 {
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 || !hasTelScheme(value[start+1:start+end]) {
+			return value, false
+		}
+		return value[:start+1] + telToSIP(value[start+1:start+end]) + value[start+end:], true
+	}
+	trimmed := strings.TrimLeft(value, " \t")
+	if !hasTelScheme(trimmed) {
+		return value, false
+	}
+	uri, params, _ := strings.Cut(trimmed, ";")
+	if params != "" {
+		params = ";" + params
+	}
+	// In an addr-spec the URI parameter would be taken for a header one.
+	return value[:len(value)-len(trimmed)] + "<" + telToSIP(uri) + ">" + params, true
+}
+
+func hasTelScheme(uri string) bool {
+	return len(uri) > len("tel:") && strings.EqualFold(uri[:len("tel:")], "tel:")
+}
+
+// telConn is a UDP socket whose datagrams have tel: URIs rewritten before
+// gosip parses them. A datagram that would outgrow the read buffer is left
+// as it is.
+type telConn struct {
+	*net.UDPConn
+}
+
+func (c telConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(buf)
+	if err != nil {
+		return n, addr, err
+	}
+	if msg := rewriteTelURIs(buf[:n]); len(msg) != n && len(msg) <= len(buf) {
+		n = copy(buf, msg)
+	}
+	return n, addr, nil
+}
+
+// telUDPProtocol is gosip's UDP protocol reading through telConn, so that
+// requests to tel: URIs reach the gateway as sip: URIs with user=phone.
+type telUDPProtocol struct {
+	connections transport.ConnectionPool
+	log         log.Logger
+}
+
+// telProtocolFactory returns a gosip protocol factory that serves UDP with
+// telUDPProtocol and every other network with base.
+func telProtocolFactory(base transport.ProtocolFactory) transport.ProtocolFactory {
+	return func(network string, output chan<- sip.Message, errs chan<- error, cancel <-chan struct{}, msgMapper sip.MessageMapper, logger log.Logger) (transport.Protocol, error) {
+		if !strings.EqualFold(network, "udp") {
+			return base(network, output, errs, cancel, msgMapper, logger)
+		}
+		p := &telUDPProtocol{log: logger.WithPrefix("transport.Protocol")}
+		p.connections = transport.NewConnectionPool(output, errs, cancel, msgMapper, p.log)
+		return p, nil
+	}
+}
+
+func (p *telUDPProtocol) Done() <-chan struct{} { return p.connections.Done() }
+func (p *telUDPProtocol) Network() string       { return "UDP" }
+func (p *telUDPProtocol) Reliable() bool        { return false }
+func (p *telUDPProtocol) Streamed() bool        { return false }
+func (p *telUDPProtocol) String() string        { return "transport.Protocol<UDP tel>" }
+
+func (p *telUDPProtocol) Listen(target *transport.Target, options ...transport.ListenOption) error {
+	target = transport.FillTargetHostAndPort("udp", target)
+	laddr, err := net.ResolveUDPAddr("udp", target.Addr())
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", target.Addr(), err)
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", laddr, err)
+	}
+	// Keyed by local port like gosip's own UDP protocol, see Send.
+	key := transport.ConnectionKey(fmt.Sprintf("udp:0.0.0.0:%d", laddr.Port))
+	return p.connections.Put(transport.NewConnection(telConn{conn}, key, "udp", p.log), 0)
+}
+
+func (p *telUDPProtocol) Send(target *transport.Target, msg sip.Message) error {
+	target = transport.FillTargetHostAndPort("udp", target)
+	if target.Host == "" {
+		return fmt.Errorf("send SIP message to %s: empty remote host", target.Addr())
+	}
+	raddr, err := net.ResolveUDPAddr("udp", target.Addr())
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", target.Addr(), err)
+	}
+	_, port, err := net.SplitHostPort(msg.Source())
+	if err != nil {
+		return fmt.Errorf("source port of SIP message: %w", err)
+	}
+	for _, conn := range p.connections.All() {
+		if parts := strings.Split(string(conn.Key()), ":"); parts[2] == port {
+			_, err := conn.WriteTo([]byte(msg.String()), raddr)
+			return err
+		}
+	}
+	return fmt.Errorf("no UDP connection on port %s", port)
+}
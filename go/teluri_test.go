@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestRewriteTelURIs(t *testing.T) {
+	const body = "\r\n\r\nv=0\r\n"
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{
+			name: "request line and To",
+			msg:  "INVITE tel:+79161234567 SIP/2.0\r\nTo: <tel:+79161234567>\r\nFrom: <sip:pbx@example.com>;tag=1" + body,
+			want: "INVITE sip:+79161234567@localhost;user=phone SIP/2.0\r\nTo: <sip:+79161234567@localhost;user=phone>\r\nFrom: <sip:pbx@example.com>;tag=1" + body,
+		},
+		{
+			name: "local number with phone-context",
+			msg:  "INVITE tel:1234;phone-context=+7916 SIP/2.0\r\nt: \"Bob\" <TEL:1234;phone-context=+7916>" + body,
+			want: "INVITE sip:1234%3Bphone-context=+7916@localhost;user=phone SIP/2.0\r\nt: \"Bob\" <sip:1234%3Bphone-context=+7916@localhost;user=phone>" + body,
+		},
+		{
+			name: "addr-spec keeps header parameters",
+			msg:  "INVITE sip:100@gw SIP/2.0\r\nFrom: tel:+200;tag=abc" + body,
+			want: "INVITE sip:100@gw SIP/2.0\r\nFrom: <sip:+200@localhost;user=phone>;tag=abc" + body,
+		},
+		{
+			name: "other headers untouched",
+			msg:  "INVITE sip:100@gw SIP/2.0\r\nP-Called-Party-ID: <tel:+300>" + body,
+			want: "INVITE sip:100@gw SIP/2.0\r\nP-Called-Party-ID: <tel:+300>" + body,
+		},
+		{
+			name: "response",
+			msg:  "SIP/2.0 200 OK\r\nTo: <sip:100@gw>;tag=x" + body,
+			want: "SIP/2.0 200 OK\r\nTo: <sip:100@gw>;tag=x" + body,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(rewriteTelURIs([]byte(tt.msg))); got != tt.want {
+				t.Errorf("rewriteTelURIs() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
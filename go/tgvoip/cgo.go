@@ -6,6 +6,7 @@ package tgvoip
 #cgo CXXFLAGS: -std=c++17 -I../../libtgvoip
 #cgo LDFLAGS: -L../../libtgvoip -ltgvoip -lstdc++ -lm -lopus
 #include <stdlib.h>
+#include <string.h>
 #include "VoIPController.h"
 #include "NetworkSocket.h"
 #include "logging.h"
@@ -17,7 +18,10 @@ using tgvoip::Endpoint;
 struct tgvoip_endpoint {
     long long id;
     char* ip;
+    char* ip6;
     int port;
+    int has_peer_tag;
+    unsigned char peer_tag[16];
 };
 
 struct tgvoip_dsp {
@@ -34,14 +38,22 @@ static void tgvoip_free(VoIPController* c) {
     delete c;
 }
 
-static void tgvoip_configure(VoIPController* c, char* key, int keyLen, struct tgvoip_endpoint* eps, int epCount, struct tgvoip_dsp dsp) {
+static void tgvoip_configure(VoIPController* c, char* key, int keyLen, int outgoing, struct tgvoip_endpoint* eps, int epCount, struct tgvoip_dsp dsp) {
     if(key && keyLen>0){
-        c->SetEncryptionKey(key, true);
+        c->SetEncryptionKey(key, outgoing != 0);
     }
     std::vector<Endpoint> vec;
     for(int i=0;i<epCount;i++){
         tgvoip::IPv4Address v4(std::string(eps[i].ip));
         tgvoip::IPv6Address v6;
+        if(eps[i].ip6 && eps[i].ip6[0]){
+            v6=tgvoip::IPv6Address(std::string(eps[i].ip6));
+        }
+        if(eps[i].has_peer_tag){
+            Endpoint e(eps[i].id, eps[i].port, v4, v6, Endpoint::UDP_RELAY, eps[i].peer_tag);
+            vec.push_back(e);
+            continue;
+        }
         Endpoint e(eps[i].id, eps[i].port, v4, v6, Endpoint::UDP_P2P_INET, NULL);
         vec.push_back(e);
     }
@@ -49,14 +61,52 @@ static void tgvoip_configure(VoIPController* c, char* key, int keyLen, struct tg
     c->SetEchoCancellationStrength(dsp.aec);
 }
 
-extern void goInputCallback(int16_t* data, size_t length, void* user);
-extern void goOutputCallback(int16_t* data, size_t length, void* user);
+extern void goInputCallback(int16_t* data, size_t length, uintptr_t user);
+extern void goOutputCallback(int16_t* data, size_t length, uintptr_t user);
+extern void goStateCallback(uintptr_t user, int state);
 
-static void tgvoip_set_callbacks(VoIPController* c, void* user) {
+static void tgvoip_state_changed(VoIPController* c, int state) {
+    goStateCallback((uintptr_t)c->implData, state);
+}
+
+// tgvoip_bind routes the audio and state callbacks of c to slot user. The
+// audio callbacks must be set before the call is established.
+static void tgvoip_bind(VoIPController* c, uintptr_t user) {
+    c->implData = (void*)user;
     c->SetAudioDataCallbacks(
         [user](int16_t* data, size_t len){ goInputCallback(data, len, user); },
         [user](int16_t* data, size_t len){ goOutputCallback(data, len, user); }
     );
+    VoIPController::Callbacks cb = {};
+    cb.connectionStateChanged = tgvoip_state_changed;
+    c->SetCallbacks(cb);
+}
+
+static void tgvoip_start(VoIPController* c) { c->Start(); }
+static void tgvoip_connect(VoIPController* c) { c->Connect(); }
+static void tgvoip_stop(VoIPController* c) { c->Stop(); }
+static void tgvoip_set_mic_mute(VoIPController* c, int mute) { c->SetMicMute(mute != 0); }
+static void tgvoip_set_network_type(VoIPController* c, int type) { c->SetNetworkType(type); }
+static long long tgvoip_preferred_relay(VoIPController* c) { return c->GetPreferredRelayID(); }
+static int tgvoip_last_error(VoIPController* c) { return c->GetLastError(); }
+
+struct tgvoip_traffic {
+    unsigned long long sent_wifi;
+    unsigned long long recvd_wifi;
+    unsigned long long sent_mobile;
+    unsigned long long recvd_mobile;
+};
+
+static struct tgvoip_traffic tgvoip_stats(VoIPController* c) {
+    VoIPController::TrafficStats s;
+    c->GetStats(&s);
+    struct tgvoip_traffic t = {s.bytesSentWifi, s.bytesRecvdWifi, s.bytesSentMobile, s.bytesRecvdMobile};
+    return t;
+}
+
+// tgvoip_debug_string returns a copy the caller frees.
+static char* tgvoip_debug_string(VoIPController* c) {
+    return strdup(c->GetDebugString().c_str());
 }
 
 extern void goTgvoipLog(char level, const char* msg);
@@ -65,20 +115,68 @@ static void tgvoip_init_logger() { tgvoip_set_log_callback(goTgvoipLog); }
 import "C"
 
 import (
-	"runtime/cgo"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
 type controller struct {
-	ptr    *C.VoIPController
-	handle cgo.Handle
+	ptr     *C.VoIPController
+	slot    int // index in slots, -1 without callbacks
+	started bool
+	stopped bool
+}
+
+// maxControllers bounds the controllers with callbacks at a time.
+const maxControllers = 4096
+
+// controllerSlot holds what the callbacks of a controller need.
+type controllerSlot struct {
+	rings atomic.Pointer[AudioRings]
+	state atomic.Pointer[func(State)]
+}
+
+// slots are indexed by the user data of the callbacks, so finding the rings
+// on the audio thread is an atomic load instead of a cgo.Handle lookup.
+var (
+	slots     [maxControllers]controllerSlot
+	slotMu    sync.Mutex
+	freeSlots []int
+	nextSlot  int
+)
+
+func allocSlot() int {
+	slotMu.Lock()
+	defer slotMu.Unlock()
+	if n := len(freeSlots); n > 0 {
+		slot := freeSlots[n-1]
+		freeSlots = freeSlots[:n-1]
+		return slot
+	}
+	if nextSlot == maxControllers {
+		return -1
+	}
+	nextSlot++
+	return nextSlot - 1
+}
+
+func freeSlot(slot int) {
+	slots[slot].rings.Store(nil)
+	slots[slot].state.Store(nil)
+	slotMu.Lock()
+	freeSlots = append(freeSlots, slot)
+	slotMu.Unlock()
 }
 
 func newController() Controller {
-	return &controller{ptr: C.tgvoip_new()}
+	c := &controller{ptr: C.tgvoip_new(), slot: allocSlot()}
+	if c.slot >= 0 {
+		C.tgvoip_bind(c.ptr, C.uintptr_t(c.slot))
+	}
+	return c
 }
 
-func (c *controller) Configure(key []byte, endpoints []Endpoint, opts DSPOptions) error {
+func (c *controller) Configure(key []byte, outgoing bool, endpoints []Endpoint, opts DSPOptions) error {
 	var keyPtr *C.char
 	if len(key) > 0 {
 		keyPtr = (*C.char)(unsafe.Pointer(&key[0]))
@@ -87,15 +185,23 @@ func (c *controller) Configure(key []byte, endpoints []Endpoint, opts DSPOptions
 	for i, e := range endpoints {
 		eps[i].id = C.longlong(e.ID)
 		eps[i].ip = C.CString(e.IPv4)
+		eps[i].ip6 = C.CString(e.IPv6)
 		eps[i].port = C.int(e.Port)
+		if len(e.PeerTag) == PeerTagSize {
+			eps[i].has_peer_tag = 1
+			for j, b := range e.PeerTag {
+				eps[i].peer_tag[j] = C.uchar(b)
+			}
+		}
 		defer C.free(unsafe.Pointer(eps[i].ip))
+		defer C.free(unsafe.Pointer(eps[i].ip6))
 	}
 	dsp := C.struct_tgvoip_dsp{aec: toCInt(opts.EchoCancellation), ns: toCInt(opts.NoiseSuppression), agc: toCInt(opts.AutoGain)}
 	var epPtr *C.struct_tgvoip_endpoint
 	if len(eps) > 0 {
 		epPtr = (*C.struct_tgvoip_endpoint)(unsafe.Pointer(&eps[0]))
 	}
-	C.tgvoip_configure(c.ptr, keyPtr, C.int(len(key)), epPtr, C.int(len(eps)), dsp)
+	C.tgvoip_configure(c.ptr, keyPtr, C.int(len(key)), toCInt(outgoing), epPtr, C.int(len(eps)), dsp)
 	return nil
 }
 
@@ -106,41 +212,85 @@ func toCInt(b bool) C.int {
 	return 0
 }
 
-type audioCallbacks struct {
-	in  func([]int16)
-	out func([]int16)
-}
-
 //export goInputCallback
-func goInputCallback(data *C.int16_t, length C.size_t, user unsafe.Pointer) {
-	h := cgo.Handle(user)
-	cb := h.Value().(audioCallbacks)
+func goInputCallback(data *C.int16_t, length C.size_t, user C.uintptr_t) {
 	slice := unsafe.Slice((*int16)(unsafe.Pointer(data)), int(length))
-	if cb.in != nil {
-		cb.in(slice)
+	if rings := slots[user].rings.Load(); rings != nil {
+		rings.read(slice)
+	} else {
+		clear(slice)
 	}
 }
 
 //export goOutputCallback
-func goOutputCallback(data *C.int16_t, length C.size_t, user unsafe.Pointer) {
-	h := cgo.Handle(user)
-	cb := h.Value().(audioCallbacks)
-	slice := unsafe.Slice((*int16)(unsafe.Pointer(data)), int(length))
-	if cb.out != nil {
-		cb.out(slice)
+func goOutputCallback(data *C.int16_t, length C.size_t, user C.uintptr_t) {
+	if rings := slots[user].rings.Load(); rings != nil {
+		rings.write(unsafe.Slice((*int16)(unsafe.Pointer(data)), int(length)))
+	}
+}
+
+//export goStateCallback
+func goStateCallback(user C.uintptr_t, state C.int) {
+	if fn := slots[user].state.Load(); fn != nil {
+		(*fn)(State(state))
+	}
+}
+
+func (c *controller) SetAudioRings(rings *AudioRings) {
+	if c.slot >= 0 {
+		slots[c.slot].rings.Store(rings)
+	}
+}
+
+func (c *controller) SetStateCallback(fn func(State)) {
+	if c.slot >= 0 {
+		slots[c.slot].state.Store(&fn)
 	}
 }
 
-func (c *controller) SetAudioCallbacks(input func([]int16), output func([]int16)) {
-	cb := audioCallbacks{in: input, out: output}
-	c.handle = cgo.NewHandle(cb)
-	C.tgvoip_set_callbacks(c.ptr, unsafe.Pointer(c.handle))
+func (c *controller) Start() {
+	C.tgvoip_start(c.ptr)
+	c.started = true
 }
 
+func (c *controller) Connect() { C.tgvoip_connect(c.ptr) }
+
+func (c *controller) Stop() {
+	if c.started && !c.stopped {
+		C.tgvoip_stop(c.ptr)
+		c.stopped = true
+	}
+}
+
+func (c *controller) SetMicMute(mute bool) { C.tgvoip_set_mic_mute(c.ptr, toCInt(mute)) }
+
+func (c *controller) SetNetworkType(t NetworkType) { C.tgvoip_set_network_type(c.ptr, C.int(t)) }
+
+func (c *controller) Stats() TrafficStats {
+	t := C.tgvoip_stats(c.ptr)
+	return TrafficStats{
+		BytesSentWiFi:       uint64(t.sent_wifi),
+		BytesReceivedWiFi:   uint64(t.recvd_wifi),
+		BytesSentMobile:     uint64(t.sent_mobile),
+		BytesReceivedMobile: uint64(t.recvd_mobile),
+	}
+}
+
+func (c *controller) DebugString() string {
+	s := C.tgvoip_debug_string(c.ptr)
+	defer C.free(unsafe.Pointer(s))
+	return C.GoString(s)
+}
+
+func (c *controller) PreferredRelayID() int64 { return int64(C.tgvoip_preferred_relay(c.ptr)) }
+
+func (c *controller) LastError() Error { return Error(C.tgvoip_last_error(c.ptr)) }
+
 func (c *controller) Close() {
+	c.Stop()
 	C.tgvoip_free(c.ptr)
-	if c.handle != 0 {
-		c.handle.Delete()
+	if c.slot >= 0 {
+		freeSlot(c.slot)
 	}
 }
 
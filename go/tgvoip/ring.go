@@ -0,0 +1,160 @@
+package tgvoip
+
+import (
+	"sync/atomic"
+)
+
+// FrameSize is the number of samples of the audio frames libtgvoip passes
+// to its callbacks, 20 ms at 48 kHz.
+const FrameSize = 960
+
+// FrameRing is a single-producer single-consumer queue of preallocated
+// audio frames. The producer writes into the slot returned by Reserve and
+// publishes it with Commit; the consumer reads the slot returned by Peek
+// and frees it with Release. Neither side locks or allocates, so the ring
+// can be used from the libtgvoip audio threads.
+type FrameRing struct {
+	frames [][]int16
+	mask   uint64
+	head   atomic.Uint64 // next slot to read
+	tail   atomic.Uint64 // next slot to write
+	notify chan struct{}
+
+	overflows  atomic.Int64
+	underflows atomic.Int64
+}
+
+// NewFrameRing creates a ring of at least n frames of size samples. n is
+// rounded up to a power of two.
+func NewFrameRing(n, size int) *FrameRing {
+	slots := 1
+	for slots < n {
+		slots <<= 1
+	}
+	r := &FrameRing{frames: make([][]int16, slots), mask: uint64(slots - 1), notify: make(chan struct{}, 1)}
+	pool := make([]int16, slots*size)
+	for i := range r.frames {
+		r.frames[i] = pool[i*size : (i+1)*size : (i+1)*size]
+	}
+	return r
+}
+
+// Len returns the number of committed frames.
+func (r *FrameRing) Len() int {
+	return int(r.tail.Load() - r.head.Load())
+}
+
+// Reserve returns the next free frame, nil if the ring is full.
+func (r *FrameRing) Reserve() []int16 {
+	t := r.tail.Load()
+	if t-r.head.Load() > r.mask {
+		r.overflows.Add(1)
+		return nil
+	}
+	return r.frames[t&r.mask]
+}
+
+// Commit publishes the frame returned by Reserve and wakes the consumer.
+func (r *FrameRing) Commit() {
+	r.tail.Add(1)
+	r.Signal()
+}
+
+// Peek returns the oldest committed frame, nil if the ring is empty.
+func (r *FrameRing) Peek() []int16 {
+	h := r.head.Load()
+	if h == r.tail.Load() {
+		r.underflows.Add(1)
+		return nil
+	}
+	return r.frames[h&r.mask]
+}
+
+// Release frees the frame returned by Peek and wakes the producer.
+func (r *FrameRing) Release() {
+	r.head.Add(1)
+	r.Signal()
+}
+
+// Signal wakes the goroutine waiting on Ready without blocking.
+func (r *FrameRing) Signal() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Ready is signalled when frames are committed or released.
+func (r *FrameRing) Ready() <-chan struct{} {
+	return r.notify
+}
+
+// Overflows returns the number of frames that found the ring full.
+func (r *FrameRing) Overflows() int64 { return r.overflows.Load() }
+
+// Underflows returns the number of reads that found the ring empty.
+func (r *FrameRing) Underflows() int64 { return r.underflows.Load() }
+
+// comfortNoise fills pcm with low level white noise, about -65 dBov, so
+// gaps do not sound like a dropped line. seed is the generator state.
+func comfortNoise(pcm []int16, seed *uint32) {
+	x := *seed
+	if x == 0 {
+		x = 0x9e3779b9
+	}
+	for i := range pcm {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		pcm[i] = int16(int32(x) >> 26)
+	}
+	*seed = x
+}
+
+// AudioRings connect a controller with the media goroutines of a call.
+// Input carries audio sent to Telegram, read by the libtgvoip input
+// callback; Output carries audio received from Telegram, written by the
+// output callback. Input underflows are filled with silence or, with
+// ComfortNoise, comfort noise; Output overflows drop the frame.
+type AudioRings struct {
+	Input        *FrameRing
+	Output       *FrameRing
+	ComfortNoise bool
+	noiseSeed    uint32
+}
+
+// NewAudioRings creates rings holding frames frames in each direction.
+func NewAudioRings(frames int, comfortNoise bool) *AudioRings {
+	return &AudioRings{
+		Input:        NewFrameRing(frames, FrameSize),
+		Output:       NewFrameRing(frames, FrameSize),
+		ComfortNoise: comfortNoise,
+	}
+}
+
+// read fills data, the frame libtgvoip is about to send, from Input.
+func (a *AudioRings) read(data []int16) {
+	if f := a.Input.Peek(); f != nil {
+		n := copy(data, f)
+		clear(data[n:])
+		a.Input.Release()
+		return
+	}
+	if a.ComfortNoise {
+		comfortNoise(data, &a.noiseSeed)
+	} else {
+		clear(data)
+	}
+	a.Input.Signal()
+}
+
+// write queues data, a frame libtgvoip played, on Output.
+func (a *AudioRings) write(data []int16) {
+	f := a.Output.Reserve()
+	if f == nil {
+		return
+	}
+	n := copy(f, data)
+	clear(f[n:])
+	a.Output.Commit()
+}
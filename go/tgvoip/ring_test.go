@@ -0,0 +1,32 @@
+package tgvoip
+
+import "testing"
+
+func BenchmarkFrameRing(b *testing.B) {
+	r := NewFrameRing(8, FrameSize)
+	frame := make([]int16, FrameSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(r.Reserve(), frame)
+		r.Commit()
+		copy(frame, r.Peek())
+		r.Release()
+	}
+}
+
+func BenchmarkAudioRings(b *testing.B) {
+	a := NewAudioRings(8, true)
+	frame := make([]int16, FrameSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.write(frame)
+		copy(frame, a.Output.Peek())
+		a.Output.Release()
+		copy(a.Input.Reserve(), frame)
+		a.Input.Commit()
+		a.read(frame)
+		a.read(frame) // underflow, filled with comfort noise
+	}
+}
@@ -7,8 +7,30 @@ type controller struct{}
 
 func newController() Controller { return &controller{} }
 
-func (c *controller) Configure(key []byte, endpoints []Endpoint, opts DSPOptions) error { return nil }
+func (c *controller) Configure(key []byte, outgoing bool, endpoints []Endpoint, opts DSPOptions) error {
+	return nil
+}
 
-func (c *controller) SetAudioCallbacks(input func([]int16), output func([]int16)) {}
+func (c *controller) SetAudioRings(rings *AudioRings) {}
+
+func (c *controller) SetStateCallback(fn func(State)) {}
+
+func (c *controller) Start() {}
+
+func (c *controller) Connect() {}
+
+func (c *controller) Stop() {}
+
+func (c *controller) SetMicMute(mute bool) {}
+
+func (c *controller) SetNetworkType(t NetworkType) {}
+
+func (c *controller) Stats() TrafficStats { return TrafficStats{} }
+
+func (c *controller) DebugString() string { return "" }
+
+func (c *controller) PreferredRelayID() int64 { return 0 }
+
+func (c *controller) LastError() Error { return ErrorUnknown }
 
 func (c *controller) Close() {}
@@ -12,9 +12,16 @@ func SetLogCallback(cb func(level byte, msg string)) {
 type Endpoint struct {
 	ID   int64
 	IPv4 string
+	IPv6 string // empty if the endpoint has no IPv6 address
 	Port int
+	// PeerTag is the 16 byte tag of a Telegram reflector, nil for
+	// peer-to-peer endpoints.
+	PeerTag []byte
 }
 
+// PeerTagSize is the length of a reflector peer tag.
+const PeerTagSize = 16
+
 // DSPOptions groups audio processing flags.
 type DSPOptions struct {
 	EchoCancellation bool
@@ -22,10 +29,118 @@ type DSPOptions struct {
 	AutoGain         bool
 }
 
+// State is the connection state of a controller.
+type State int
+
+// Connection states, as numbered by libtgvoip.
+const (
+	StateWaitInit State = iota + 1
+	StateWaitInitAck
+	StateEstablished
+	StateFailed
+	StateReconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateWaitInit:
+		return "wait_init"
+	case StateWaitInitAck:
+		return "wait_init_ack"
+	case StateEstablished:
+		return "established"
+	case StateFailed:
+		return "failed"
+	case StateReconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// Error is the reason a controller failed.
+type Error int
+
+// Failure reasons, as numbered by libtgvoip.
+const (
+	ErrorUnknown Error = iota
+	ErrorIncompatible
+	ErrorTimeout
+	ErrorAudioIO
+	ErrorProxy
+)
+
+func (e Error) String() string {
+	switch e {
+	case ErrorIncompatible:
+		return "incompatible protocol"
+	case ErrorTimeout:
+		return "timeout"
+	case ErrorAudioIO:
+		return "audio I/O"
+	case ErrorProxy:
+		return "proxy"
+	}
+	return "unknown"
+}
+
+// NetworkType tells libtgvoip what kind of network the gateway uses, which
+// selects its bitrate and data saving.
+type NetworkType int
+
+// Network types, as numbered by libtgvoip.
+const (
+	NetworkUnknown NetworkType = iota
+	NetworkGPRS
+	NetworkEDGE
+	Network3G
+	NetworkHSPA
+	NetworkLTE
+	NetworkWiFi
+	NetworkEthernet
+	NetworkOtherHighSpeed
+	NetworkOtherLowSpeed
+	NetworkDialup
+	NetworkOtherMobile
+)
+
+// TrafficStats are the bytes a controller sent and received, split by
+// network type. libtgvoip counts Wi-Fi and wired networks as WiFi.
+type TrafficStats struct {
+	BytesSentWiFi       uint64
+	BytesReceivedWiFi   uint64
+	BytesSentMobile     uint64
+	BytesReceivedMobile uint64
+}
+
 // Controller represents a tgvoip call instance.
 type Controller interface {
-	Configure(key []byte, endpoints []Endpoint, opts DSPOptions) error
-	SetAudioCallbacks(input func([]int16), output func([]int16))
+	// Configure sets the encryption key of the call, outgoing if this side
+	// placed it, the endpoints to connect to and the DSP options.
+	Configure(key []byte, outgoing bool, endpoints []Endpoint, opts DSPOptions) error
+	// SetAudioRings connects the audio callbacks with rings. They only
+	// copy frames, never block and never call into Go code of the call.
+	SetAudioRings(rings *AudioRings)
+	// SetStateCallback registers fn for connection state changes. fn runs
+	// on a libtgvoip thread and must not block or call Stop or Close.
+	SetStateCallback(fn func(State))
+	// Start starts the network threads; Connect then contacts the
+	// endpoints. Both must follow Configure.
+	Start()
+	Connect()
+	// Stop stops all threads. Only Close may follow.
+	Stop()
+	SetMicMute(mute bool)
+	SetNetworkType(t NetworkType)
+	// Stats returns the bytes exchanged so far. libtgvoip keeps no
+	// packet counters.
+	Stats() TrafficStats
+	// DebugString returns libtgvoip's multi-line diagnostics of the call.
+	DebugString() string
+	// PreferredRelayID returns the endpoint ID of the reflector in use.
+	PreferredRelayID() int64
+	// LastError returns why the controller reached StateFailed.
+	LastError() Error
+	// Close stops the controller if needed and frees it.
 	Close()
 }
 
@@ -35,6 +150,6 @@ func NewController() Controller {
 }
 
 // ConnectSIPMedia links SIP media streams with a tgvoip controller.
-func ConnectSIPMedia(ctrl Controller, in func([]int16), out func([]int16)) {
-	ctrl.SetAudioCallbacks(in, out)
+func ConnectSIPMedia(ctrl Controller, rings *AudioRings) {
+	ctrl.SetAudioRings(rings)
 }